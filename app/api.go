@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"splitwise-api/internal"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/lpernett/godotenv"
+	"google.golang.org/grpc"
 )
 
 var log internal.CustomLogger = internal.Log
@@ -24,6 +26,10 @@ type Api interface {
 type ApiImpl struct {
 	srv    *http.Server
 	router *mux.Router
+	errChn chan error
+	// gRPC server of the users, expenses and balances on its own port
+	grpcSrv  *grpc.Server
+	grpcAddr string
 }
 
 func CreateApp() (*ApiImpl, error) {
@@ -34,53 +40,143 @@ func CreateApp() (*ApiImpl, error) {
 
 	return &ApiImpl{
 		router: mux.NewRouter().StrictSlash(true),
+		errChn: make(chan error, 1),
 	}, nil
 }
 
 func (api *ApiImpl) SetupRoutes() {
-	// Add User Routes
-	userHandler, err := internal.NewUserHandler()
+	// Authenticate every request
+	authHandler, err := internal.NewAuthHandler()
+	if err != nil {
+		log.Error(fmt.Sprintf("error occurred in auth routes initialization: %s", err))
+		panic(err)
+	}
+	rateLimiter, err := internal.RateLimiterFromEnv()
+	if err != nil {
+		log.Error(fmt.Sprintf("error occurred in rate limiter initialization: %s", err))
+		panic(err)
+	}
+	idempotency, err := internal.IdempotencyFromEnv()
+	if err != nil {
+		log.Error(fmt.Sprintf("error occurred in idempotency initialization: %s", err))
+		panic(err)
+	}
+	bodyLimit, err := internal.BodyLimitMiddleware()
 	if err != nil {
+		log.Error(fmt.Sprintf("error occurred in body limit initialization: %s", err))
+		panic(err)
+	}
+	api.router.Use(
+		internal.RequestIdMiddleware,
+		internal.AccessLogMiddleware,
+		internal.RecoveryMiddleware,
+		bodyLimit,
+		rateLimiter.IPMiddleware,
+		authHandler.Middleware,
+		rateLimiter.Middleware,
+		idempotency.Middleware,
+	)
+
+	// Add the mock OIDC issuer used for local development and offline testing
+	if os.Getenv("OIDC_MOCK_ISSUER") == "true" {
+		mockIssuer, err := internal.NewMockIssuer(os.Getenv("OIDC_ISSUER_URL"), os.Getenv("OIDC_CLIENT_ID"))
+		if err != nil {
+			log.Error(fmt.Sprintf("error occurred in mock oidc issuer initialization: %s", err))
+			panic(err)
+		}
+		internal.MockIssuerRouter(api.router, mockIssuer)
+	}
+
+	// Mount the routes under /v1, the unversioned routes are deprecated aliases
+	// kept until their sunset. Handlers of a new version get their own subrouter.
+	deprecation, err := internal.DeprecationFromEnv()
+	if err != nil {
+		log.Error(fmt.Sprintf("error occurred in legacy routes initialization: %s", err))
+		panic(err)
+	}
+
+	// Add Auth Routes
+	h := handlers{auth: authHandler}
+
+	// Add User Routes
+	if h.user, err = internal.NewUserHandler(); err != nil {
 		log.Error(fmt.Sprintf("error occurred in user routes initialization: %s", err))
 		panic(err)
 	}
-	internal.UserRouter(api.router, *userHandler)
 
 	// Add Expense Routes
-	expenseHandler, err := internal.NewExpenseHandler()
-	if err != nil {
+	if h.expense, err = internal.NewExpenseHandler(); err != nil {
 		log.Error(fmt.Sprintf("error occurred in expense routes initialization: %s", err))
 		panic(err)
 	}
-	internal.ExpenseRouter(api.router, *expenseHandler)
 
 	// Add Lender Routes
-	lenderHandler, err := internal.NewLenderHandler()
-	if err != nil {
+	if h.lender, err = internal.NewLenderHandler(); err != nil {
 		log.Error(fmt.Sprintf("error occurred in lender routes initialization: %s", err))
 		panic(err)
 	}
-	internal.LenderRouter(api.router, *lenderHandler)
-}
 
-func (api *ApiImpl) Init() error {
-	db, err := internal.PostgresClientInit(nil)
+	// Add Admin Routes
+	if h.admin, err = internal.NewAdminHandler(); err != nil {
+		log.Error(fmt.Sprintf("error occurred in admin routes initialization: %s", err))
+		panic(err)
+	}
 
-	// Migrate the DB schema
-	internal.MigrateSchema(db)
+	// Add Audit Routes
+	if h.audit, err = internal.NewAuditHandler(); err != nil {
+		log.Error(fmt.Sprintf("error occurred in audit routes initialization: %s", err))
+		panic(err)
+	}
 
-	if err != nil {
-		log.Error(fmt.Sprintf("error occurred in app initialization: %s", err))
-		return err
+	// Add the GraphQL endpoint, unversioned as its schema evolves without breaking changes
+	if h.graphQL, err = internal.NewGraphQLHandler(h.user, h.expense, h.lender); err != nil {
+		log.Error(fmt.Sprintf("error occurred in graphql initialization: %s", err))
+		panic(err)
 	}
-	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
-	defer cancel()
-	if err := db.Ping(&ctx); err != nil {
-		log.Error(fmt.Sprintf("error occurred in db connection: %s", err))
-		return err
+
+	// Add the gRPC services, sharing the handlers of the routes
+	api.grpcSrv = internal.NewGRPCServer(h.auth, h.user, h.expense, h.lender, rateLimiter, idempotency)
+
+	// Add the routes of the handlers and their OpenAPI document, every route should be in it
+	if err := registerRoutes(api.router, h, deprecation); err != nil {
+		log.Error(fmt.Sprintf("error occurred in openapi initialization: %s", err))
+		panic(err)
 	}
-	// Initialize routes
-	api.router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+}
+
+// Handlers of the API routes
+type handlers struct {
+	auth    *internal.AuthHandler
+	user    *internal.UserHandler
+	expense *internal.ExpenseHandler
+	lender  *internal.LenderHandler
+	admin   *internal.AdminHandler
+	audit   *internal.AuditHandler
+	graphQL *internal.GraphQLHandler
+}
+
+// Register the routes of the handlers under every version, then the OpenAPI
+// document of the router. It fails when a route is not in the document.
+func registerRoutes(router *mux.Router, h handlers, deprecation *internal.Deprecation) error {
+	routers := []*mux.Router{internal.VersionRouter(router, internal.LegacyVersion)}
+	if legacy := internal.LegacyRouter(router, deprecation); legacy != nil {
+		routers = append(routers, legacy)
+	}
+	for _, r := range routers {
+		internal.AuthRouter(r, *h.auth)
+		internal.UserRouter(r, *h.user)
+		internal.ExpenseRouter(r, *h.expense)
+		internal.LenderRouter(r, *h.lender)
+		internal.AdminRouter(r, *h.admin)
+		internal.AuditRouter(r, *h.audit)
+	}
+	internal.GraphQLRouter(router, h.graphQL)
+	return internal.OpenAPIRouter(router)
+}
+
+// Add the status and health check routes
+func healthRoutes(router *mux.Router, db internal.IClient) {
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		msg := "API RUNNING"
 		status := 200
@@ -89,7 +185,7 @@ func (api *ApiImpl) Init() error {
 	}).Methods("GET")
 
 	// Health Check
-	api.router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		msg := "API RUNNING"
 		status := 200
@@ -109,6 +205,28 @@ func (api *ApiImpl) Init() error {
 		resp := internal.SuccessResp(&status, &msg, map[string]string{"status": "HEALTHY"})
 		json.NewEncoder(w).Encode(resp)
 	}).Methods("GET")
+}
+
+func (api *ApiImpl) Init() error {
+	db, err := internal.PostgresClientInit(nil)
+	if err != nil {
+		log.Error(fmt.Sprintf("error occurred in app initialization: %s", err))
+		return err
+	}
+
+	// Migrate the DB schema
+	if err := internal.MigrateSchema(db); err != nil {
+		log.Error(fmt.Sprintf("error occurred in schema migration: %s", err))
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	if err := db.Ping(&ctx); err != nil {
+		log.Error(fmt.Sprintf("error occurred in db connection: %s", err))
+		return err
+	}
+	// Initialize routes
+	healthRoutes(api.router, db)
 
 	// Setup Routes for Services
 	api.SetupRoutes()
@@ -117,33 +235,86 @@ func (api *ApiImpl) Init() error {
 	if PORT == ":" {
 		PORT = ":8080"
 	}
+	api.grpcAddr = ":" + os.Getenv("GRPC_PORT")
+	if api.grpcAddr == ":" {
+		api.grpcAddr = ":9090"
+	}
 
 	// Initialize the server
 	api.srv = &http.Server{
-		Addr:    PORT,
-		Handler: api.router,
+		Addr:              PORT,
+		Handler:           api.router,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		MaxHeaderBytes:    1 << 20,
 	}
 	return nil
 }
 
+// Start the HTTP and gRPC servers. Errors binding the ports are returned, later
+// errors of the servers are reported on Done.
 func (api *ApiImpl) Start() error {
+	listener, err := net.Listen("tcp", api.srv.Addr)
+	if err != nil {
+		log.Error(fmt.Sprintf("error occurred in app start: %s", err))
+		return err
+	}
+	grpcListener, err := net.Listen("tcp", api.grpcAddr)
+	if err != nil {
+		listener.Close()
+		log.Error(fmt.Sprintf("error occurred in grpc start: %s", err))
+		return err
+	}
 	go func() {
-		// Start the server
-		if err := api.srv.ListenAndServe(); err != http.ErrServerClosed {
-			log.Error(fmt.Sprintf("error occurred in app start: %s", err))
-			panic(err)
+		if err := api.srv.Serve(listener); err != http.ErrServerClosed {
+			log.Error(fmt.Sprintf("error occurred in app serve: %s", err))
+			api.stopped(err)
 		}
 	}()
+	go func() {
+		if err := api.grpcSrv.Serve(grpcListener); err != nil {
+			log.Error(fmt.Sprintf("error occurred in grpc serve: %s", err))
+			api.stopped(err)
+		}
+	}()
+	log.Info(fmt.Sprintf("grpc server listening on %s", api.grpcAddr))
 	return nil
 }
 
+// Report the error of the first server that stopped
+func (api *ApiImpl) stopped(err error) {
+	select {
+	case api.errChn <- err:
+	default:
+	}
+}
+
+// Channel receiving the error that stopped the server
+func (api *ApiImpl) Done() <-chan error {
+	return api.errChn
+}
+
 func (api *ApiImpl) Stop(t time.Duration) {
 	// Create a context with a timeout
 	ctx, cancel := context.WithTimeout(context.Background(), t)
 	defer cancel()
 
+	// Let the pending calls finish, then cancel the remaining ones
+	grpcStopped := make(chan struct{})
+	go func() {
+		api.grpcSrv.GracefulStop()
+		close(grpcStopped)
+	}()
 	if err := api.srv.Shutdown(ctx); err != nil {
 		log.Error(fmt.Sprintf("error occurred in app stop: %s", err))
 		panic(err)
 	}
+	select {
+	case <-grpcStopped:
+	case <-ctx.Done():
+		log.Error("error occurred in grpc stop: timeout, cancelling the pending calls")
+		api.grpcSrv.Stop()
+	}
 }
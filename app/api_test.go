@@ -0,0 +1,81 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"splitwise-api/internal"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Router with every route of the API, the handlers are not called
+func newTestRouter(t *testing.T) *mux.Router {
+	t.Helper()
+	h := handlers{
+		auth:    &internal.AuthHandler{},
+		user:    &internal.UserHandler{},
+		expense: &internal.ExpenseHandler{},
+		lender:  &internal.LenderHandler{},
+		admin:   &internal.AdminHandler{},
+		audit:   &internal.AuditHandler{},
+	}
+	var err error
+	if h.graphQL, err = internal.NewGraphQLHandler(h.user, h.expense, h.lender); err != nil {
+		t.Fatalf("graphql handler: %v", err)
+	}
+	router := mux.NewRouter().StrictSlash(true)
+	healthRoutes(router, nil)
+	if err := registerRoutes(router, h, &internal.Deprecation{Enabled: true}); err != nil {
+		t.Fatalf("register routes: %v", err)
+	}
+	return router
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	router := newTestRouter(t)
+	spec, err := internal.BuildOpenAPI(router)
+	if err != nil {
+		t.Fatalf("build openapi: %v", err)
+	}
+	var document struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &document); err != nil {
+		t.Fatalf("decode openapi: %v", err)
+	}
+	routes := 0
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		if route.GetHandler() == nil || err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			routes++
+			if _, ok := document.Paths[template][strings.ToLower(method)]; !ok {
+				t.Errorf("%s %s is not in the openapi document", method, template)
+			}
+		}
+		return nil
+	})
+	for _, route := range []string{"POST /v1/expense", "POST /expense", "GET /health", "POST " + internal.GraphQLPath} {
+		method, template, _ := strings.Cut(route, " ")
+		if _, ok := document.Paths[template][strings.ToLower(method)]; !ok {
+			t.Errorf("%s is not in the openapi document", route)
+		}
+	}
+	if routes < 50 {
+		t.Errorf("walked %d routes, the router is missing routes", routes)
+	}
+}
+
+func TestOpenAPIFailsOnUndocumentedRoute(t *testing.T) {
+	router := newTestRouter(t)
+	router.HandleFunc("/v1/undocumented", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	_, err := internal.BuildOpenAPI(router)
+	if err == nil || !strings.Contains(err.Error(), "GET /v1/undocumented") {
+		t.Errorf("build openapi error = %v, want the undocumented route", err)
+	}
+}
@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Scopes granted to API keys
+const (
+	ScopeExpensesRead  = "expenses:read"
+	ScopeExpensesWrite = "expenses:write"
+	ScopeBalancesRead  = "balances:read"
+	ScopeBalancesWrite = "balances:write"
+	ScopeUsersRead     = "users:read"
+	ScopeUsersWrite    = "users:write"
+	ScopeAdmin         = "admin"
+)
+
+// Scope an API key needs for every action
+var actionScopes = map[Action]string{
+	ActionExpenseCreate:  ScopeExpensesWrite,
+	ActionExpenseRead:    ScopeExpensesRead,
+	ActionBalanceRead:    ScopeBalancesRead,
+	ActionBalanceSettle:  ScopeBalancesWrite,
+	ActionPaymentConfirm: ScopeBalancesWrite,
+	ActionUserRead:       ScopeUsersRead,
+	ActionUserContact:    ScopeUsersRead,
+	ActionUserManage:     ScopeUsersWrite,
+	ActionAdmin:          ScopeAdmin,
+}
+
+const (
+	apiKeyPrefix = "sk_"
+	// How often the last use of a key is written
+	apiKeyLastUsedInterval = time.Minute
+)
+
+type ApiKeyService struct {
+	dao IDao[ApiKey]
+}
+
+func ApiKeyServiceInit() (*ApiKeyService, error) {
+	Log.Info("api key service init...")
+	dao, err := DaoInit[ApiKey](nil)
+	if err != nil {
+		Log.Error(fmt.Sprintf("api key service init error: %s", err.Error()))
+		return nil, err
+	}
+	return &ApiKeyService{dao: dao}, nil
+}
+
+// Generate a key of the form sk_<prefix>_<secret>
+func generateApiKey() (string, string, string, error) {
+	prefixBytes := make([]byte, 6)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return "", "", "", err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", "", "", err
+	}
+	prefix := hex.EncodeToString(prefixBytes)
+	key := apiKeyPrefix + prefix + "_" + base64.RawURLEncoding.EncodeToString(secretBytes)
+	return key, prefix, hashApiKey(key), nil
+}
+
+func hashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Whether a bearer token is an API key rather than a user token
+func IsApiKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// Create an API key
+// @param ctx *context.Context: Context
+// @param req ApiKeyRequest: Validated name, scopes and expiry
+// @param createdBy *uuid.UUID: The user creating the key, nil for other keys
+// @return *ApiKeySecret: The key with its secret
+// @return error: The error if any
+func (ks *ApiKeyService) Create(ctx *context.Context, req ApiKeyRequest, createdBy *uuid.UUID) (*ApiKeySecret, error) {
+	key, prefix, hash, err := generateApiKey()
+	if err != nil {
+		return nil, err
+	}
+	apiKey := &ApiKey{
+		KId:       GenerateUUIdV6(),
+		Name:      req.Name,
+		Prefix:    prefix,
+		KeyHash:   hash,
+		Scopes:    req.Scopes,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err := ks.dao.Create(ctx, apiKey); err != nil {
+		Log.Error(fmt.Sprintf("create api key error: %s", err.Error()))
+		return nil, err
+	}
+	Log.Info(fmt.Sprintf("api key: %s created", apiKey.KId))
+	return &ApiKeySecret{ApiKey: apiKey, Key: key}, nil
+}
+
+// List the API keys, most recent first
+func (ks *ApiKeyService) List(ctx *context.Context) ([]*ApiKey, error) {
+	apiKeys := []*ApiKey{}
+	if resp := ks.dao.Client(ctx).DbClient(ctx).Order("created_at DESC").Find(&apiKeys); resp.Error != nil {
+		Log.Error(fmt.Sprintf("list api keys error: %s", resp.Error.Error()))
+		return nil, resp.Error
+	}
+	return apiKeys, nil
+}
+
+// Revoke an API key
+func (ks *ApiKeyService) Revoke(ctx *context.Context, id uuid.UUID) (*ApiKey, error) {
+	var apiKey *ApiKey
+	err := ks.update(ctx, id, func(tx *gorm.DB, key *ApiKey) error {
+		apiKey = key
+		if key.RevokedAt != nil {
+			return nil
+		}
+		revokedAt := time.Now().UTC()
+		key.RevokedAt = &revokedAt
+		return tx.Model(key).Update("revoked_at", revokedAt).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	Log.Info(fmt.Sprintf("api key: %s revoked", id))
+	return apiKey, nil
+}
+
+// Replace the secret of an API key, keeping its id and scopes
+func (ks *ApiKeyService) Rotate(ctx *context.Context, id uuid.UUID) (*ApiKeySecret, error) {
+	var secret *ApiKeySecret
+	err := ks.update(ctx, id, func(tx *gorm.DB, apiKey *ApiKey) error {
+		if apiKey.RevokedAt != nil {
+			return fmt.Errorf("%w: api key %s is revoked", ErrConflict, id)
+		}
+		key, prefix, hash, err := generateApiKey()
+		if err != nil {
+			return err
+		}
+		rotatedAt := time.Now().UTC()
+		apiKey.Prefix, apiKey.KeyHash, apiKey.RotatedAt = prefix, hash, &rotatedAt
+		secret = &ApiKeySecret{ApiKey: apiKey, Key: key}
+		return tx.Model(apiKey).Select("prefix", "key_hash", "rotated_at").Updates(apiKey).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	Log.Info(fmt.Sprintf("api key: %s rotated", id))
+	return secret, nil
+}
+
+func (ks *ApiKeyService) update(ctx *context.Context, id uuid.UUID, fn func(*gorm.DB, *ApiKey) error) error {
+	dbClient := ks.dao.Client(ctx)
+	return dbClient.DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		var apiKeys []*ApiKey
+		if resp := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("k_id = ?", id).Find(&apiKeys); resp.Error != nil {
+			return resp.Error
+		}
+		if len(apiKeys) == 0 {
+			return NewNotFoundError("api key", id)
+		}
+		return fn(tx, apiKeys[0])
+	})
+}
+
+// Resolve an API key and record its use
+// @param ctx *context.Context: Context
+// @param key string: The bearer token
+// @return *ApiKey: The active key
+// @return error: ErrUnauthorized when the key is unknown, expired or revoked
+func (ks *ApiKeyService) Authenticate(ctx *context.Context, key string) (*ApiKey, error) {
+	prefix, _, found := strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !found {
+		return nil, fmt.Errorf("%w: malformed api key", ErrUnauthorized)
+	}
+	dbClient := ks.dao.Client(ctx).DbClient(ctx)
+	var apiKeys []*ApiKey
+	if resp := dbClient.Where("prefix = ?", prefix).Find(&apiKeys); resp.Error != nil {
+		return nil, resp.Error
+	}
+	if len(apiKeys) == 0 || subtle.ConstantTimeCompare([]byte(apiKeys[0].KeyHash), []byte(hashApiKey(key))) != 1 {
+		return nil, fmt.Errorf("%w: invalid api key", ErrUnauthorized)
+	}
+	apiKey := apiKeys[0]
+	now := time.Now().UTC()
+	if apiKey.RevokedAt != nil || (apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(now)) {
+		return nil, fmt.Errorf("%w: api key expired or revoked", ErrUnauthorized)
+	}
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > apiKeyLastUsedInterval {
+		apiKey.LastUsedAt = &now
+		if resp := dbClient.Model(apiKey).Update("last_used_at", now); resp.Error != nil {
+			Log.Error(fmt.Sprintf("api key last used error: %s", resp.Error.Error()))
+		}
+	}
+	return apiKey, nil
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestApiKeyService(t *testing.T) (*fakeDB, *ApiKeyService) {
+	fake, client := newFakeDB(t)
+	return fake, &ApiKeyService{dao: &Dao[ApiKey]{dbClient: client}}
+}
+
+func TestApiKeyAuthenticate(t *testing.T) {
+	now := time.Now().UTC()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	recently := now.Add(-apiKeyLastUsedInterval / 2)
+
+	tests := []struct {
+		name string
+		// Changes the stored key and returns the bearer token presented
+		setup   func(apiKey *ApiKey, key string) string
+		err     error
+		touched bool
+	}{
+		{"never used", func(apiKey *ApiKey, key string) string { return key }, nil, true},
+		{"used long ago", func(apiKey *ApiKey, key string) string {
+			apiKey.LastUsedAt = &past
+			return key
+		}, nil, true},
+		{"used recently", func(apiKey *ApiKey, key string) string {
+			apiKey.LastUsedAt = &recently
+			return key
+		}, nil, false},
+		{"not expired yet", func(apiKey *ApiKey, key string) string {
+			apiKey.ExpiresAt = &future
+			return key
+		}, nil, true},
+		{"expired", func(apiKey *ApiKey, key string) string {
+			apiKey.ExpiresAt = &past
+			return key
+		}, ErrUnauthorized, false},
+		{"revoked", func(apiKey *ApiKey, key string) string {
+			apiKey.RevokedAt = &past
+			return key
+		}, ErrUnauthorized, false},
+		{"wrong secret", func(apiKey *ApiKey, key string) string {
+			return apiKeyPrefix + apiKey.Prefix + "_wrong"
+		}, ErrUnauthorized, false},
+		{"unknown prefix", func(apiKey *ApiKey, key string) string {
+			return apiKeyPrefix + "000000000000_secret"
+		}, ErrUnauthorized, false},
+		{"malformed", func(apiKey *ApiKey, key string) string {
+			return apiKeyPrefix + apiKey.Prefix
+		}, ErrUnauthorized, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, service := newTestApiKeyService(t)
+			fake.filterColumns = []string{"prefix"}
+			key, prefix, hash, err := generateApiKey()
+			if err != nil {
+				t.Fatalf("generate api key: %v", err)
+			}
+			apiKey := &ApiKey{KId: GenerateUUIdV6(), Name: "ci", Prefix: prefix, KeyHash: hash, Scopes: []string{ScopeExpensesRead}, CreatedAt: past}
+			token := test.setup(apiKey, key)
+			fake.AddRows(t, apiKey)
+
+			ctx := context.Background()
+			authenticated, err := service.Authenticate(&ctx, token)
+			if !errors.Is(err, test.err) || (test.err == nil) != (err == nil) {
+				t.Fatalf("authenticate error = %v, want %v", err, test.err)
+			}
+			if err == nil && (authenticated.KId != apiKey.KId || !authenticated.HasScope(ScopeExpensesRead)) {
+				t.Errorf("authenticated key = %+v, want %+v", authenticated, apiKey)
+			}
+			if touched := len(fake.Find(`UPDATE "api_keys" SET "last_used_at"`)) > 0; touched != test.touched {
+				t.Errorf("last used at written = %v, want %v", touched, test.touched)
+			}
+		})
+	}
+}
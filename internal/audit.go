@@ -0,0 +1,421 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	auditTable = "audit_entries"
+	// Statement setting holding the rows read before an update or delete
+	auditBeforeKey = "audit:before"
+)
+
+// Columns whose values are never written to the audit log
+var auditRedactedColumns = map[string]bool{
+	"password_hash": true,
+	"key_hash":      true,
+	"refresh_jti":   true,
+	"email":         true,
+	"phone_no":      true,
+}
+
+// Columns whose changes alone are not audited
+var auditIgnoredColumns = map[string]bool{
+	"last_used_at": true,
+}
+
+// Register the callbacks auditing every create, upsert, update and delete made
+// through gorm. The audit entries are written in the transaction of the change,
+// so a failed audit write fails the change. Raw SQL and the idempotency records
+// are not audited, writes should go through gorm.
+func RegisterAuditCallbacks(db *gorm.DB) error {
+	callback := db.Callback()
+	if err := callback.Create().Before("gorm:create").Register("audit:before_create", auditSnapshotUpsert); err != nil {
+		return err
+	}
+	if err := callback.Create().After("gorm:create").Register("audit:create", auditCreate); err != nil {
+		return err
+	}
+	if err := callback.Update().Before("gorm:update").Register("audit:before_update", auditSnapshot); err != nil {
+		return err
+	}
+	if err := callback.Update().After("gorm:update").Register("audit:update", auditUpdate); err != nil {
+		return err
+	}
+	if err := callback.Delete().Before("gorm:delete").Register("audit:before_delete", auditSnapshot); err != nil {
+		return err
+	}
+	return callback.Delete().After("gorm:delete").Register("audit:delete", auditDelete)
+}
+
+func isAudited(db *gorm.DB) bool {
+	stmt := db.Statement
+	return db.Error == nil && stmt.Schema != nil && stmt.Table != auditTable && stmt.Table != idempotencyTable && len(stmt.Schema.PrimaryFields) > 0
+}
+
+// Actor of the writes made with the context
+func auditActor(ctx context.Context) (string, *uuid.UUID) {
+	principal := PrincipalFromContext(ctx)
+	switch {
+	case principal != nil && principal.User != nil:
+		return AuditActorUser, &principal.User.UId
+	case principal != nil && principal.ApiKey != nil:
+		return AuditActorApiKey, &principal.ApiKey.KId
+	case RequestIdFromContext(ctx) != "":
+		return AuditActorAnonymous, nil
+	default:
+		return AuditActorSystem, nil
+	}
+}
+
+// JSON friendly value of a column read into a map
+func auditValue(column string, value interface{}) interface{} {
+	if auditRedactedColumns[column] {
+		return "[redacted]"
+	}
+	switch v := value.(type) {
+	case [16]byte:
+		return uuid.UUID(v).String()
+	case []byte:
+		return string(v)
+	}
+	return value
+}
+
+// Whether a column is unchanged, encrypted values are compared decrypted as
+// they are sealed with a new nonce on every write
+func auditEqual(column string, before interface{}, after interface{}) bool {
+	beforeValue, isBeforeString := before.(string)
+	afterValue, isAfterString := after.(string)
+	if isBeforeString && isAfterString && strings.HasPrefix(beforeValue, encryptedPrefix) && strings.HasPrefix(afterValue, encryptedPrefix) {
+		if keyring, err := PIIKeyring(); err == nil {
+			beforePlaintext, errBefore := keyring.Decrypt(column, beforeValue)
+			afterPlaintext, errAfter := keyring.Decrypt(column, afterValue)
+			return errBefore == nil && errAfter == nil && beforePlaintext == afterPlaintext
+		}
+	}
+	return reflect.DeepEqual(before, after)
+}
+
+// Column values of the model being created
+func auditModelRows(stmt *gorm.Statement) []map[string]interface{} {
+	var rows []map[string]interface{}
+	appendRow := func(rv reflect.Value) {
+		row := map[string]interface{}{}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName == "" {
+				continue
+			}
+			value, _ := field.ValueOf(stmt.Context, rv)
+			row[field.DBName] = auditValue(field.DBName, value)
+		}
+		rows = append(rows, row)
+	}
+	switch rv := reflect.Indirect(stmt.ReflectValue); rv.Kind() {
+	case reflect.Struct:
+		appendRow(rv)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			appendRow(reflect.Indirect(rv.Index(i)))
+		}
+	}
+	return rows
+}
+
+// Primary keys of the model of the statement, nil when any of them is zero
+func auditModelKeys(stmt *gorm.Statement) []map[string]interface{} {
+	var keys []map[string]interface{}
+	appendKey := func(rv reflect.Value) bool {
+		key := map[string]interface{}{}
+		for _, field := range stmt.Schema.PrimaryFields {
+			value, isZero := field.ValueOf(stmt.Context, rv)
+			if isZero {
+				return false
+			}
+			key[field.DBName] = value
+		}
+		keys = append(keys, key)
+		return true
+	}
+	switch rv := reflect.Indirect(stmt.ReflectValue); rv.Kind() {
+	case reflect.Struct:
+		if !appendKey(rv) {
+			return nil
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if !appendKey(reflect.Indirect(rv.Index(i))) {
+				return nil
+			}
+		}
+	}
+	return keys
+}
+
+func auditEntityId(primaryFields []*schema.Field, row map[string]interface{}) string {
+	ids := make([]string, len(primaryFields))
+	for i, field := range primaryFields {
+		ids[i] = fmt.Sprint(auditValue(field.DBName, row[field.DBName]))
+	}
+	return strings.Join(ids, ":")
+}
+
+// Condition matching the rows with the given primary keys
+func auditKeyCondition(primaryFields []*schema.Field, rows []map[string]interface{}) clause.Expression {
+	conditions := make([]clause.Expression, 0, len(rows))
+	for _, row := range rows {
+		columns := make([]clause.Expression, 0, len(primaryFields))
+		for _, field := range primaryFields {
+			columns = append(columns, clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: row[field.DBName]})
+		}
+		conditions = append(conditions, clause.And(columns...))
+	}
+	return clause.Or(conditions...)
+}
+
+// Read the rows an update or delete is about to change
+func auditSnapshot(db *gorm.DB) {
+	if !isAudited(db) {
+		return
+	}
+	auditSnapshotRows(db, db.Session(&gorm.Session{NewDB: true}).Table(db.Statement.Table))
+}
+
+// Read the rows an upsert is about to change. They are locked, so the upsert
+// cannot be preceded by a concurrent one changing them.
+func auditSnapshotUpsert(db *gorm.DB) {
+	if _, ok := db.Statement.Clauses["ON CONFLICT"]; !ok || !isAudited(db) {
+		return
+	}
+	auditSnapshotRows(db, db.Session(&gorm.Session{NewDB: true}).Table(db.Statement.Table).Clauses(clause.Locking{Strength: "UPDATE"}))
+}
+
+func auditSnapshotRows(db *gorm.DB, query *gorm.DB) {
+	stmt := db.Statement
+	where, hasWhere := stmt.Clauses["WHERE"]
+	if hasWhere {
+		query = query.Clauses(where.Expression)
+	}
+	// Writes through a model are scoped to its primary key by gorm:update and gorm:delete
+	if keys := auditModelKeys(stmt); len(keys) > 0 {
+		query = query.Clauses(auditKeyCondition(stmt.Schema.PrimaryFields, keys))
+	} else if !hasWhere {
+		return
+	}
+	rows := []map[string]interface{}{}
+	if err := query.Find(&rows).Error; err != nil {
+		db.AddError(fmt.Errorf("audit: %w", err))
+		return
+	}
+	stmt.Settings.Store(auditBeforeKey, rows)
+}
+
+func auditBefore(stmt *gorm.Statement) []map[string]interface{} {
+	before, ok := stmt.Settings.Load(auditBeforeKey)
+	if !ok {
+		return nil
+	}
+	return before.([]map[string]interface{})
+}
+
+func auditCreate(db *gorm.DB) {
+	if !isAudited(db) || db.RowsAffected == 0 {
+		return
+	}
+	stmt := db.Statement
+	if _, ok := stmt.Clauses["ON CONFLICT"]; ok {
+		auditUpsert(db)
+		return
+	}
+	var entries []*AuditEntry
+	for _, row := range auditModelRows(stmt) {
+		entries = append(entries, newAuditEntry(stmt, AuditActionCreate, auditEntityId(stmt.Schema.PrimaryFields, row), nil, row))
+	}
+	writeAuditEntries(db, entries)
+}
+
+// Audit the rows an upsert inserted or updated. The model holds the values to
+// insert rather than the ones stored on a conflict, so the rows are read back.
+func auditUpsert(db *gorm.DB) {
+	stmt := db.Statement
+	keys := auditModelKeys(stmt)
+	if len(keys) == 0 {
+		return
+	}
+	after := []map[string]interface{}{}
+	query := db.Session(&gorm.Session{NewDB: true}).Table(stmt.Table).Clauses(auditKeyCondition(stmt.Schema.PrimaryFields, keys))
+	if err := query.Find(&after).Error; err != nil {
+		db.AddError(fmt.Errorf("audit: %w", err))
+		return
+	}
+	beforeById := map[string]map[string]interface{}{}
+	for _, row := range auditBefore(stmt) {
+		beforeById[auditEntityId(stmt.Schema.PrimaryFields, row)] = row
+	}
+	var entries []*AuditEntry
+	for _, afterRow := range after {
+		entityId := auditEntityId(stmt.Schema.PrimaryFields, afterRow)
+		beforeRow, ok := beforeById[entityId]
+		if !ok {
+			for column, value := range afterRow {
+				afterRow[column] = auditValue(column, value)
+			}
+			entries = append(entries, newAuditEntry(stmt, AuditActionUpsert, entityId, nil, afterRow))
+			continue
+		}
+		if changedBefore, changedAfter, audited := auditChanges(beforeRow, afterRow); audited {
+			entries = append(entries, newAuditEntry(stmt, AuditActionUpsert, entityId, changedBefore, changedAfter))
+		}
+	}
+	writeAuditEntries(db, entries)
+}
+
+// Columns changed between two versions of a row, and whether the change is audited
+func auditChanges(beforeRow map[string]interface{}, afterRow map[string]interface{}) (map[string]interface{}, map[string]interface{}, bool) {
+	changedBefore, changedAfter := map[string]interface{}{}, map[string]interface{}{}
+	audited := false
+	for column, value := range afterRow {
+		if auditEqual(column, beforeRow[column], value) {
+			continue
+		}
+		changedBefore[column], changedAfter[column] = auditValue(column, beforeRow[column]), auditValue(column, value)
+		audited = audited || !auditIgnoredColumns[column]
+	}
+	return changedBefore, changedAfter, audited
+}
+
+func auditUpdate(db *gorm.DB) {
+	stmt := db.Statement
+	before := auditBefore(stmt)
+	if !isAudited(db) || len(before) == 0 || db.RowsAffected == 0 {
+		return
+	}
+	after := []map[string]interface{}{}
+	query := db.Session(&gorm.Session{NewDB: true}).Table(stmt.Table).Clauses(auditKeyCondition(stmt.Schema.PrimaryFields, before))
+	if err := query.Find(&after).Error; err != nil {
+		db.AddError(fmt.Errorf("audit: %w", err))
+		return
+	}
+	afterById := map[string]map[string]interface{}{}
+	for _, row := range after {
+		afterById[auditEntityId(stmt.Schema.PrimaryFields, row)] = row
+	}
+	var entries []*AuditEntry
+	for _, beforeRow := range before {
+		entityId := auditEntityId(stmt.Schema.PrimaryFields, beforeRow)
+		afterRow, ok := afterById[entityId]
+		if !ok {
+			continue
+		}
+		if changedBefore, changedAfter, audited := auditChanges(beforeRow, afterRow); audited {
+			entries = append(entries, newAuditEntry(stmt, AuditActionUpdate, entityId, changedBefore, changedAfter))
+		}
+	}
+	writeAuditEntries(db, entries)
+}
+
+func auditDelete(db *gorm.DB) {
+	stmt := db.Statement
+	before := auditBefore(stmt)
+	if !isAudited(db) || len(before) == 0 || db.RowsAffected == 0 {
+		return
+	}
+	var entries []*AuditEntry
+	for _, row := range before {
+		for column, value := range row {
+			row[column] = auditValue(column, value)
+		}
+		entries = append(entries, newAuditEntry(stmt, AuditActionDelete, auditEntityId(stmt.Schema.PrimaryFields, row), row, nil))
+	}
+	writeAuditEntries(db, entries)
+}
+
+func newAuditEntry(stmt *gorm.Statement, action string, entityId string, before map[string]interface{}, after map[string]interface{}) *AuditEntry {
+	actorType, actorId := auditActor(stmt.Context)
+	entry := &AuditEntry{
+		AId:        GenerateUUIdV6(),
+		ActorType:  actorType,
+		ActorId:    actorId,
+		Action:     action,
+		EntityType: stmt.Table,
+		EntityId:   entityId,
+		RequestId:  RequestIdFromContext(stmt.Context),
+		CreatedAt:  time.Now().UTC(),
+	}
+	if before != nil {
+		entry.Before, _ = json.Marshal(before)
+	}
+	if after != nil {
+		entry.After, _ = json.Marshal(after)
+	}
+	return entry
+}
+
+func writeAuditEntries(db *gorm.DB, entries []*AuditEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	if err := db.Session(&gorm.Session{NewDB: true}).Create(&entries).Error; err != nil {
+		Log.Error(fmt.Sprintf("audit write error: %s", err.Error()))
+		db.AddError(fmt.Errorf("audit: %w", err))
+	}
+}
+
+type AuditService struct {
+	dao IDao[AuditEntry]
+}
+
+func AuditServiceInit() (*AuditService, error) {
+	Log.Info("audit service init...")
+	dao, err := DaoInit[AuditEntry](nil)
+	if err != nil {
+		Log.Error(fmt.Sprintf("audit service init error: %s", err.Error()))
+		return nil, err
+	}
+	return &AuditService{dao: dao}, nil
+}
+
+// Search the audit log, most recent first
+// @param ctx *context.Context: Context
+// @param filter AuditFilter: Filters and pagination
+// @return *Page[AuditEntry]: The matching entries
+// @return error: The error if any
+func (as *AuditService) Search(ctx *context.Context, filter AuditFilter) (*Page[AuditEntry], error) {
+	query := as.dao.Client(ctx).DbClient(ctx).Model(&AuditEntry{})
+	if filter.ActorId != nil {
+		query = query.Where("actor_id = ?", *filter.ActorId)
+	}
+	for column, value := range map[string]string{"action": filter.Action, "entity_type": filter.EntityType, "entity_id": filter.EntityId, "request_id": filter.RequestId} {
+		if value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+	if filter.From != nil {
+		query = query.Where("created_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		query = query.Where("created_at < ?", *filter.To)
+	}
+	query = query.Session(&gorm.Session{})
+	page := &Page[AuditEntry]{Items: []AuditEntry{}, Page: filter.Page, PageSize: filter.PageSize}
+	if resp := query.Count(&page.Total); resp.Error != nil {
+		Log.Error(fmt.Sprintf("search audit log error: %s", resp.Error.Error()))
+		return nil, resp.Error
+	}
+	resp := query.Order("created_at DESC, a_id DESC").Offset((filter.Page - 1) * filter.PageSize).Limit(filter.PageSize).Find(&page.Items)
+	if resp.Error != nil {
+		Log.Error(fmt.Sprintf("search audit log error: %s", resp.Error.Error()))
+		return nil, resp.Error
+	}
+	return page, nil
+}
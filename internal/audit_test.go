@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var auditInsertRegexp = regexp.MustCompile(`^INSERT INTO "audit_entries" \(([^)]*)\) VALUES \((.*)`)
+
+// Before and after values of the audit entries written for a table, from
+// inserts of a single entry
+func auditEntries(t *testing.T, fake *fakeDB, table string) []map[string]map[string]interface{} {
+	t.Helper()
+	var entries []map[string]map[string]interface{}
+	for _, statement := range fake.Find(`INSERT INTO "audit_entries"`) {
+		match := auditInsertRegexp.FindStringSubmatch(statement.Query)
+		if match == nil {
+			t.Fatalf("unexpected audit insert %q", statement.Query)
+		}
+		values := map[string]driver.Value{}
+		columns, placeholders := strings.Split(match[1], ","), strings.Split(match[2], ",")
+		for i, column := range columns {
+			if index, err := strconv.Atoi(strings.Trim(placeholders[i], "$()")); err == nil {
+				values[strings.Trim(column, `"`)] = statement.Args[index-1]
+			}
+		}
+		if values["entity_type"] != table {
+			continue
+		}
+		entry := map[string]map[string]interface{}{}
+		for _, name := range []string{"before", "after"} {
+			if data, ok := values[name].([]byte); ok {
+				var row map[string]interface{}
+				if err := json.Unmarshal(data, &row); err != nil {
+					t.Fatalf("decode audit %s: %v", name, err)
+				}
+				entry[name] = row
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditUpsertReadsBalanceBack(t *testing.T) {
+	lenderId, borrowerId := GenerateUUIdV6(), GenerateUUIdV6()
+	tests := []struct {
+		name   string
+		stored float64
+		exists bool
+		before map[string]interface{}
+		after  float64
+	}{
+		{"new balance", 0, false, nil, 5},
+		{"existing balance", 10, true, map[string]interface{}{"amount": 10.0}, 15},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, client := newFakeDB(t)
+			if test.exists {
+				fake.AddRows(t, NewLender(lenderId, borrowerId, test.stored))
+			}
+			fake.onWrite = func(statement fakeStatement) {
+				if strings.HasPrefix(statement.Query, `INSERT INTO "lends"`) {
+					fake.ClearRows("lends")
+					fake.AddRows(t, NewLender(lenderId, borrowerId, test.stored+5))
+				}
+			}
+
+			ctx := context.Background()
+			if err := upsertLend(client.DbClient(&ctx), NewLender(lenderId, borrowerId, 5)); err != nil {
+				t.Fatalf("upsert error = %v", err)
+			}
+			entries := auditEntries(t, fake, "lends")
+			if len(entries) != 1 {
+				t.Fatalf("audit entries = %d, want 1", len(entries))
+			}
+			if before := entries[0]["before"]; (before == nil) != (test.before == nil) || (before != nil && before["amount"] != test.before["amount"]) {
+				t.Errorf("audit before = %v, want %v", before, test.before)
+			}
+			if after := entries[0]["after"]["amount"]; after != test.after {
+				t.Errorf("audit after amount = %v, want %v", after, test.after)
+			}
+		})
+	}
+}
+
+func TestSeedLedgerIsAudited(t *testing.T) {
+	fake, client := newFakeDB(t)
+	lend := NewLender(GenerateUUIdV6(), GenerateUUIdV6(), 12)
+	fake.AddRows(t, lend)
+
+	if err := SeedLedger(client); err != nil {
+		t.Fatalf("seed ledger error = %v", err)
+	}
+	entries := auditEntries(t, fake, "ledger_entries")
+	if len(entries) != 1 {
+		t.Fatalf("audit entries = %d, want 1", len(entries))
+	}
+	after := entries[0]["after"]
+	if after["l_id"] != lend.LId.String() || after["amount"] != 12.0 || after["source"] != LedgerSourceOpening {
+		t.Errorf("audit after = %v", after)
+	}
+}
+
+func TestMergeFoldedSharesAreAudited(t *testing.T) {
+	admin := NewUser("Admin", "admin@example.com", "")
+	admin.IsAdmin = true
+	user := NewUser("Ann", "ann@example.com", "")
+	placeholder := NewPlaceholderUser("", "ann.work@example.com", "")
+	expense := NewExpense("equal", 30, "", GenerateUUIdV6(), []*ExpenseBorrower{{BorrowerId: placeholder.UId, Amount: 10}, {BorrowerId: user.UId, Amount: 5}})
+	fake, service := newTestUserService(t)
+	fake.AddRows(t, user, placeholder, expense.ExpenseBorrowers[0], expense.ExpenseBorrowers[1])
+	fake.onWrite = func(statement fakeStatement) {
+		if strings.HasPrefix(statement.Query, `UPDATE "expense_borrowers" SET "amount"`) {
+			fake.ClearRows("expense_borrowers")
+			fake.AddRows(t, expense.ExpenseBorrowers[0], &ExpenseBorrower{ExpenseId: expense.ExId, BorrowerId: user.UId, Amount: 15})
+		}
+	}
+	handler := &UserHandler{service: service}
+
+	if _, err := handler.MergeUser(userContext(admin), &MergeUserRequest{UserPath: UserPath{UId: user.UId}, PlaceholderId: placeholder.UId}); err != nil {
+		t.Fatalf("merge error = %v", err)
+	}
+	if statements := fake.Find("UPDATE expense_borrowers AS"); len(statements) > 0 {
+		t.Errorf("shares folded with raw SQL: %q", statements[0].Query)
+	}
+	folded := false
+	for _, entry := range auditEntries(t, fake, "expense_borrowers") {
+		folded = folded || (entry["before"]["amount"] == 5.0 && entry["after"]["amount"] == 15.0)
+	}
+	if !folded {
+		t.Error("folding the share of the placeholder into the user's was not audited")
+	}
+}
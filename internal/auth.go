@@ -0,0 +1,587 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Returned when the caller is not authenticated or the credentials are invalid
+var ErrUnauthorized = errors.New("unauthorized")
+
+const (
+	accessTokenType  = "access"
+	refreshTokenType = "refresh"
+	oidcStateType    = "oidc_state"
+	tokenIssuer      = "splitwise-api"
+	// Cookie holding the state of a pending OIDC login
+	OIDCStateCookie = "oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+// Routes that can be called without authentication, keyed by method and path
+// template without the version prefix, see IsPublicRoute
+var PublicRoutes = map[string]bool{
+	"GET /":                         true,
+	"GET /health":                   true,
+	"GET /openapi.json":             true,
+	"GET /docs":                     true,
+	"GET /docs/redoc.standalone.js": true,
+	"POST /user":                    true,
+	"POST /auth/login":              true,
+	"POST /auth/refresh":            true,
+	// OIDC login and the mock issuer
+	"GET /auth/oidc/login":                            true,
+	"GET /auth/oidc/callback":                         true,
+	"GET /oidc/mock/.well-known/openid-configuration": true,
+	"GET /oidc/mock/jwks":                             true,
+	"GET /oidc/mock/authorize":                        true,
+	"POST /oidc/mock/token":                           true,
+}
+
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Type      string    `json:"typ"`
+	SessionId uuid.UUID `json:"sid"`
+}
+
+// State of a pending OIDC login, kept in a signed cookie between the redirects
+type oidcStateClaims struct {
+	jwt.RegisteredClaims
+	Type         string `json:"typ"`
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"verifier"`
+}
+
+type contextKey string
+
+const authContextKey contextKey = "auth"
+
+// Authenticated caller of a request
+// Callers authenticated by an API key have no user or session.
+type Principal struct {
+	User    *User
+	Session *Session
+	ApiKey  *ApiKey
+}
+
+func ContextWithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, authContextKey, principal)
+}
+
+// Authenticated caller of the request, nil for anonymous requests
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(authContextKey).(*Principal)
+	return principal
+}
+
+type AuthService struct {
+	dao        IDao[Session]
+	apiKeys    *ApiKeyService
+	provider   IdentityProvider
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+func AuthServiceInit() (*AuthService, error) {
+	Log.Info("auth service init...")
+	AUTH_SECRET := os.Getenv("AUTH_SECRET")
+	if len(AUTH_SECRET) < 32 {
+		Log.Error("env not found: AUTH_SECRET")
+		return nil, errors.New("AUTH_SECRET is not set or shorter than 32 characters")
+	}
+	accessTTL, err := durationEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	refreshTTL, err := durationEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	dao, err := DaoInit[Session](nil)
+	if err != nil {
+		Log.Error(fmt.Sprintf("auth service init error: %s", err.Error()))
+		return nil, err
+	}
+	apiKeys, err := ApiKeyServiceInit()
+	if err != nil {
+		return nil, err
+	}
+	provider, err := OIDCProviderFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return &AuthService{dao: dao, apiKeys: apiKeys, provider: provider, secret: []byte(AUTH_SECRET), accessTTL: accessTTL, refreshTTL: refreshTTL}, nil
+}
+
+func durationEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		Log.Error(fmt.Sprintf("invalid env %s: %s", name, err.Error()))
+		return 0, err
+	}
+	return duration, nil
+}
+
+// Bcrypt hash of a password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Compared against when the user does not exist, so that unknown users take as
+// long to reject as wrong passwords
+var dummyPasswordHash, _ = HashPassword("splitwise-api-dummy-password")
+
+// Verify the credentials and start a new session
+// @param ctx *context.Context: Context
+// @param req LoginRequest: Validated credentials
+// @return *TokenPair: Access and refresh tokens of the new session
+// @return error: ErrUnauthorized when the credentials are invalid
+func (as *AuthService) Login(ctx *context.Context, req LoginRequest) (*TokenPair, error) {
+	dbClient := as.dao.Client(ctx).DbClient(ctx)
+	user, err := findUserByContact(dbClient, req.Email, req.PhoneNo)
+	if err != nil {
+		return nil, err
+	}
+	hash := dummyPasswordHash
+	if user != nil && user.PasswordHash != "" && user.DeletedAt == nil {
+		hash = user.PasswordHash
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil || hash == dummyPasswordHash {
+		return nil, fmt.Errorf("%w: invalid credentials", ErrUnauthorized)
+	}
+	session := NewSession(user.UId, as.refreshTTL)
+	if resp := dbClient.Create(session); resp.Error != nil {
+		return nil, resp.Error
+	}
+	Log.Info(fmt.Sprintf("user: %s logged in, session: %s", user.UId, session.SId))
+	return as.issueTokens(session)
+}
+
+// Start an OIDC login
+// @param ctx *context.Context: Context
+// @param loginHint string: Optional email passed to the identity provider
+// @return string: URL of the identity provider to redirect to
+// @return string: Signed state to store in the OIDCStateCookie
+// @return error: The error if any
+func (as *AuthService) OIDCLogin(ctx *context.Context, loginHint string) (string, string, error) {
+	if as.provider == nil {
+		return "", "", fmt.Errorf("%w: oidc login is not configured", ErrNotFound)
+	}
+	state, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now().UTC()
+	claims := oidcStateClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(oidcStateTTL)),
+		},
+		Type:         oidcStateType,
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+	}
+	stateToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(as.secret)
+	if err != nil {
+		return "", "", err
+	}
+	authURL, err := as.provider.AuthCodeURL(*ctx, state, nonce, pkceChallenge(verifier))
+	if err != nil {
+		return "", "", err
+	}
+	if loginHint != "" {
+		authURL += "&" + url.Values{"login_hint": {loginHint}}.Encode()
+	}
+	return authURL, stateToken, nil
+}
+
+// Complete an OIDC login, provisioning the user or linking it by email
+// @param ctx *context.Context: Context
+// @param code string: Authorization code returned by the identity provider
+// @param state string: State returned by the identity provider
+// @param stateToken string: Signed state from the OIDCStateCookie
+// @return *TokenPair: Access and refresh tokens of the new session
+// @return error: ErrUnauthorized when the state or ID token is invalid
+func (as *AuthService) OIDCCallback(ctx *context.Context, code string, state string, stateToken string) (*TokenPair, error) {
+	if as.provider == nil {
+		return nil, fmt.Errorf("%w: oidc login is not configured", ErrNotFound)
+	}
+	claims := &oidcStateClaims{}
+	_, err := jwt.ParseWithClaims(stateToken, claims, func(t *jwt.Token) (interface{}, error) {
+		return as.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(tokenIssuer))
+	if err != nil || claims.Type != oidcStateType {
+		return nil, fmt.Errorf("%w: invalid or expired login state", ErrUnauthorized)
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(claims.State)) != 1 {
+		return nil, fmt.Errorf("%w: login state mismatch", ErrUnauthorized)
+	}
+	identity, err := as.provider.Exchange(*ctx, code, claims.CodeVerifier, claims.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	var session *Session
+	dbClient := as.dao.Client(ctx)
+	err = dbClient.DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		user, err := linkIdentity(tx, identity)
+		if err != nil {
+			return err
+		}
+		session = NewSession(user.UId, as.refreshTTL)
+		return tx.Create(session).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	Log.Info(fmt.Sprintf("user: %s logged in with oidc, session: %s", session.UId, session.SId))
+	return as.issueTokens(session)
+}
+
+// Find the user of an identity, linking an existing user with the same verified
+// email or creating a new one
+func linkIdentity(tx *gorm.DB, identity *Identity) (*User, error) {
+	var users []*User
+	resp := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("oidc_issuer = ? AND oidc_subject = ?", identity.Issuer, identity.Subject).Find(&users)
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if len(users) > 0 {
+		if !users[0].IsActive() {
+			return nil, fmt.Errorf("%w: user is deleted", ErrUnauthorized)
+		}
+		return users[0], nil
+	}
+	if !identity.EmailVerified {
+		return nil, fmt.Errorf("%w: email is not verified by the identity provider", ErrUnauthorized)
+	}
+	user, err := findUserByContact(tx, identity.Email, "")
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		name := identity.Name
+		if name == "" {
+			name = identity.Email
+		}
+		user = NewUser(name, identity.Email, "")
+		user.OidcIssuer, user.OidcSubject, user.EmailVerifiedAt = identity.Issuer, identity.Subject, &user.CreatedAt
+		if resp := tx.Create(user); resp.Error != nil {
+			return nil, resp.Error
+		}
+		Log.Info(fmt.Sprintf("user: %s provisioned from oidc", user.UId))
+		return user, nil
+	}
+	if !user.IsActive() {
+		return nil, fmt.Errorf("%w: user is deleted", ErrUnauthorized)
+	}
+	if user.OidcSubject != "" {
+		return nil, fmt.Errorf("%w: user is linked to another identity", ErrUnauthorized)
+	}
+	// Placeholder users become regular users when they sign in
+	now := time.Now().UTC()
+	user.OidcIssuer, user.OidcSubject, user.IsPlaceholder, user.EmailVerifiedAt = identity.Issuer, identity.Subject, false, &now
+	if resp := tx.Model(user).Select("oidc_issuer", "oidc_subject", "is_placeholder", "email_verified_at").Updates(user); resp.Error != nil {
+		return nil, resp.Error
+	}
+	Log.Info(fmt.Sprintf("user: %s linked to oidc subject", user.UId))
+	return user, nil
+}
+
+// Exchange a refresh token for a new token pair. Refresh tokens are rotated and
+// reusing an old one revokes the session.
+// @param ctx *context.Context: Context
+// @param refreshToken string: The refresh token
+// @return *TokenPair: New access and refresh tokens
+// @return error: ErrUnauthorized when the token is invalid, expired or revoked
+func (as *AuthService) Refresh(ctx *context.Context, refreshToken string) (*TokenPair, error) {
+	claims, err := as.parseToken(refreshToken, refreshTokenType)
+	if err != nil {
+		return nil, err
+	}
+	var session *Session
+	reused := false
+	dbClient := as.dao.Client(ctx)
+	err = dbClient.DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		var sessions []*Session
+		if resp := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("s_id = ?", claims.SessionId).Find(&sessions); resp.Error != nil {
+			return resp.Error
+		}
+		if len(sessions) == 0 || sessions[0].RevokedAt != nil || sessions[0].ExpiresAt.Before(time.Now()) {
+			return fmt.Errorf("%w: session expired or revoked", ErrUnauthorized)
+		}
+		session = sessions[0]
+		// No new tokens for a user deleted, erased or merged since the login
+		if _, err := sessionUser(tx, session); err != nil {
+			return err
+		}
+		if claims.ID != session.RefreshJti.String() {
+			// The token was already exchanged, it may have been stolen
+			reused = true
+			Log.Warn(fmt.Sprintf("refresh token reused, revoking session: %s", session.SId))
+			return tx.Model(session).Update("revoked_at", time.Now().UTC()).Error
+		}
+		session.RefreshJti = GenerateUUIdV6()
+		return tx.Model(session).Update("refresh_jti", session.RefreshJti).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, fmt.Errorf("%w: refresh token already used, session revoked", ErrUnauthorized)
+	}
+	return as.issueTokens(session)
+}
+
+// Revoke the session of the caller, or every session of the user
+// @param ctx *context.Context: Context
+// @param principal *Principal: The authenticated caller
+// @param all bool: Whether to revoke every session of the user
+// @return error: The error if any
+func (as *AuthService) Logout(ctx *context.Context, principal *Principal, all bool) error {
+	if principal.Session == nil {
+		return fmt.Errorf("%w: api keys have no session", ErrForbidden)
+	}
+	query := as.dao.Client(ctx).DbClient(ctx).Model(&Session{}).Where("revoked_at IS NULL")
+	if all {
+		query = query.Where("uid = ?", principal.User.UId)
+	} else {
+		query = query.Where("s_id = ?", principal.Session.SId)
+	}
+	if resp := query.Update("revoked_at", time.Now().UTC()); resp.Error != nil {
+		Log.Error(fmt.Sprintf("logout error: %s", resp.Error.Error()))
+		return resp.Error
+	}
+	return nil
+}
+
+// Set the password of a user. The current password is required when one is set.
+// Every other session of the user is revoked.
+// @param ctx *context.Context: Context
+// @param principal *Principal: The authenticated caller
+// @param req ChangePasswordRequest: Validated passwords
+// @return error: ErrUnauthorized when the current password is wrong, ErrForbidden for API keys
+func (as *AuthService) ChangePassword(ctx *context.Context, principal *Principal, req ChangePasswordRequest) error {
+	if principal.Session == nil {
+		return fmt.Errorf("%w: api keys have no password", ErrForbidden)
+	}
+	user := principal.User
+	if user.PasswordHash != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)); err != nil {
+			return fmt.Errorf("%w: current password is wrong", ErrUnauthorized)
+		}
+	}
+	hash, err := HashPassword(req.NewPassword)
+	if err != nil {
+		return err
+	}
+	dbClient := as.dao.Client(ctx)
+	return dbClient.DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		if resp := tx.Model(user).Update("password_hash", hash); resp.Error != nil {
+			return resp.Error
+		}
+		resp := tx.Model(&Session{}).Where("uid = ? AND s_id <> ? AND revoked_at IS NULL", user.UId, principal.Session.SId).Update("revoked_at", time.Now().UTC())
+		return resp.Error
+	})
+}
+
+// Resolve the caller of an access token or API key
+// @param ctx *context.Context: Context
+// @param accessToken string: The bearer token
+// @return *Principal: The user and session of the token, or the API key
+// @return error: ErrUnauthorized when the token is invalid, expired or revoked
+func (as *AuthService) Authenticate(ctx *context.Context, accessToken string) (*Principal, error) {
+	if IsApiKey(accessToken) {
+		apiKey, err := as.apiKeys.Authenticate(ctx, accessToken)
+		if err != nil {
+			return nil, err
+		}
+		return &Principal{ApiKey: apiKey}, nil
+	}
+	claims, err := as.parseToken(accessToken, accessTokenType)
+	if err != nil {
+		return nil, err
+	}
+	dbClient := as.dao.Client(ctx).DbClient(ctx)
+	var sessions []*Session
+	resp := dbClient.Where("s_id = ? AND revoked_at IS NULL", claims.SessionId).Find(&sessions)
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if len(sessions) == 0 {
+		return nil, fmt.Errorf("%w: session expired or revoked", ErrUnauthorized)
+	}
+	session := sessions[0]
+	user, err := sessionUser(dbClient, session)
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{User: user, Session: session}, nil
+}
+
+// User a session was opened for
+// @param db *gorm.DB: Client or transaction to read the user with
+// @param session *Session: The session
+// @return *User: The user
+// @return error: ErrUnauthorized when the user was deleted, erased or merged
+func sessionUser(db *gorm.DB, session *Session) (*User, error) {
+	var users []*User
+	if resp := db.Where("uid = ?", session.UId).Find(&users); resp.Error != nil {
+		return nil, resp.Error
+	}
+	if len(users) == 0 || !users[0].IsActive() {
+		return nil, fmt.Errorf("%w: session expired or revoked", ErrUnauthorized)
+	}
+	return users[0], nil
+}
+
+func (as *AuthService) issueTokens(session *Session) (*TokenPair, error) {
+	now := time.Now().UTC()
+	sign := func(tokenType string, id string, expiresAt time.Time) (string, error) {
+		claims := tokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        id,
+				Issuer:    tokenIssuer,
+				Subject:   session.UId.String(),
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(expiresAt),
+			},
+			Type:      tokenType,
+			SessionId: session.SId,
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(as.secret)
+	}
+	accessToken, err := sign(accessTokenType, GenerateUUIdV6().String(), now.Add(as.accessTTL))
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := sign(refreshTokenType, session.RefreshJti.String(), session.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(as.accessTTL.Seconds()),
+		SessionId:    session.SId,
+	}, nil
+}
+
+func (as *AuthService) parseToken(token string, tokenType string) (*tokenClaims, error) {
+	claims := &tokenClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		return as.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(tokenIssuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnauthorized, err.Error())
+	}
+	if claims.Type != tokenType {
+		return nil, fmt.Errorf("%w: expected %s token", ErrUnauthorized, tokenType)
+	}
+	return claims, nil
+}
+
+// Token of an Authorization: Bearer header
+func BearerToken(r *http.Request) (string, bool) {
+	return parseBearer(r.Header.Get("Authorization"))
+}
+
+func parseBearer(authorization string) (string, bool) {
+	scheme, token, found := strings.Cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// Whether a route is public, PublicRoutes lists the routes without their version
+func IsPublicRoute(method string, template string) bool {
+	_, unversioned := SplitVersion(template)
+	return PublicRoutes[method+" "+unversioned]
+}
+
+func isPublicRoute(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return false
+	}
+	return IsPublicRoute(r.Method, template)
+}
+
+// Middleware injecting the authenticated caller into the request context.
+// Requests without a valid access token or API key are rejected unless the route is public.
+func (as *AuthService) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		token, found := BearerToken(r)
+		if !found {
+			if isPublicRoute(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			writeUnauthorized(w, fmt.Errorf("%w: missing bearer token", ErrUnauthorized))
+			return
+		}
+		principal, err := as.Authenticate(&ctx, token)
+		if err != nil {
+			if isPublicRoute(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !errors.Is(err, ErrUnauthorized) {
+				Log.Error(fmt.Sprintf("authentication error: %s", err.Error()))
+				err = fmt.Errorf("%w: authentication failed", ErrUnauthorized)
+			}
+			writeUnauthorized(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ContextWithPrincipal(ctx, principal)))
+	})
+}
+
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	statusCode, resp := NewErrorResp(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", `Bearer realm="splitwise-api"`)
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(resp)
+}
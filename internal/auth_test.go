@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuthService(t *testing.T) (*fakeDB, *AuthService) {
+	fake, client := newFakeDB(t)
+	return fake, &AuthService{dao: &Dao[Session]{dbClient: client}, secret: []byte("test secret"), accessTTL: time.Minute, refreshTTL: time.Hour}
+}
+
+func TestAuthenticateLoadsSessionUser(t *testing.T) {
+	user := NewUser("Ann", "ann@example.com", "")
+	deleted := NewUser("Bob", "bob@example.com", "")
+	deletedAt := time.Now().UTC()
+	deleted.DeletedAt = &deletedAt
+
+	tests := []struct {
+		name string
+		user *User
+		err  error
+	}{
+		{"active user", user, nil},
+		{"deleted user", deleted, ErrUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, service := newTestAuthService(t)
+			session := NewSession(test.user.UId, service.refreshTTL)
+			fake.AddRows(t, session, test.user)
+			tokens, err := service.issueTokens(session)
+			if err != nil {
+				t.Fatalf("issue tokens error = %v", err)
+			}
+
+			ctx := context.Background()
+			principal, err := service.Authenticate(&ctx, tokens.AccessToken)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("authenticate error = %v, want %v", err, test.err)
+			}
+			if err == nil && principal.User.UId != test.user.UId {
+				t.Errorf("principal user = %s, want %s", principal.User.UId, test.user.UId)
+			}
+		})
+	}
+}
+
+func TestRefreshRejectsInactiveUsers(t *testing.T) {
+	now := time.Now().UTC()
+	active := NewUser("Ann", "ann@example.com", "")
+	deleted := NewUser("Deleted", "", "")
+	deleted.DeletedAt = &now
+	erased := NewUser("Erased", "", "")
+	erased.ErasedAt = &now
+	merged := NewPlaceholderUser("Merged", "", "")
+	merged.MergedInto = &active.UId
+
+	tests := []struct {
+		name string
+		user *User
+		err  error
+	}{
+		{"active user", active, nil},
+		{"deleted user", deleted, ErrUnauthorized},
+		{"erased user", erased, ErrUnauthorized},
+		{"merged user", merged, ErrUnauthorized},
+		{"missing user", nil, ErrUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, service := newTestAuthService(t)
+			session := NewSession(GenerateUUIdV6(), service.refreshTTL)
+			if test.user != nil {
+				session.UId = test.user.UId
+				fake.AddRows(t, test.user)
+			}
+			fake.AddRows(t, session)
+			tokens, err := service.issueTokens(session)
+			if err != nil {
+				t.Fatalf("issue tokens error = %v", err)
+			}
+
+			ctx := context.Background()
+			if _, err := service.Refresh(&ctx, tokens.RefreshToken); !errors.Is(err, test.err) {
+				t.Fatalf("refresh error = %v, want %v", err, test.err)
+			}
+			if rotated := len(fake.Find(`UPDATE "sessions" SET "refresh_jti"`)) > 0; rotated != (test.err == nil) {
+				t.Errorf("refresh token rotated = %v", rotated)
+			}
+		})
+	}
+}
+
+func TestLinkIdentityRejectsInactiveUsers(t *testing.T) {
+	now := time.Now().UTC()
+	identity := &Identity{Issuer: "https://issuer.example.com", Subject: "subject", Email: "ann@example.com", EmailVerified: true}
+	active := NewUser("Ann", "ann@example.com", "")
+	deleted := NewUser("Deleted", "", "")
+	deleted.DeletedAt = &now
+	erased := NewUser("Erased", "", "")
+	erased.ErasedAt = &now
+	merged := NewPlaceholderUser("Merged", "", "")
+	merged.MergedInto = &active.UId
+
+	tests := []struct {
+		name string
+		user *User
+		err  error
+	}{
+		{"active user", active, nil},
+		{"deleted user", deleted, ErrUnauthorized},
+		{"erased user", erased, ErrUnauthorized},
+		{"merged user", merged, ErrUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, service := newTestAuthService(t)
+			linked := *test.user
+			linked.OidcIssuer, linked.OidcSubject = identity.Issuer, identity.Subject
+			fake.AddRows(t, &linked)
+
+			ctx := context.Background()
+			user, err := linkIdentity(service.dao.Client(&ctx).DbClient(&ctx), identity)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("link identity error = %v, want %v", err, test.err)
+			}
+			if err == nil && user.UId != linked.UId {
+				t.Errorf("linked user = %s, want %s", user.UId, linked.UId)
+			}
+		})
+	}
+}
+
+func TestLoginAfterEncryptingLegacyContact(t *testing.T) {
+	fake, service := newTestAuthService(t)
+	fake.filterColumns = []string{"email_index"}
+	hash, err := HashPassword("secret password")
+	if err != nil {
+		t.Fatalf("hash password: %v", err)
+	}
+	// Stored in plaintext before the encryption, with its original case
+	user := NewUser("Ann", "Ann.Lee@Example.com ", "")
+	user.PasswordHash = hash
+	fake.AddRows(t, user)
+	// Store the index written by the migration
+	fake.onWrite = func(statement fakeStatement) {
+		if !strings.HasPrefix(statement.Query, `UPDATE "users"`) {
+			return
+		}
+		columns := map[string]driver.Value{}
+		for _, match := range updatedColumnRegexp.FindAllStringSubmatch(statement.Query, -1) {
+			i, _ := strconv.Atoi(match[2])
+			columns[match[1]] = statement.Args[i-1]
+		}
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		for _, row := range fake.rows["users"] {
+			if row["uid"] == columns["uid"] {
+				row["email_index"] = columns["email_index"]
+			}
+		}
+	}
+
+	if err := EncryptUsers(service.dao.Client(nil)); err != nil {
+		t.Fatalf("encrypt users error = %v", err)
+	}
+	ctx := context.Background()
+	if _, err := service.Login(&ctx, LoginRequest{Email: "ann.lee@example.com", Password: "secret password"}); err != nil {
+		t.Errorf("login error = %v, want the legacy user to log in", err)
+	}
+}
@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm/schema"
+)
+
+// Prefix of encrypted values, followed by the key id and the sealed value
+const encryptedPrefix = "enc:v1:"
+
+// Keys used to encrypt personal data at rest. Values are encrypted with the
+// active key and decrypted with the key named in their prefix, so keys can be
+// rotated by adding a new key and making it active.
+type Keyring struct {
+	activeKeyId string
+	keys        map[string]cipher.AEAD
+	indexKey    []byte
+}
+
+var (
+	piiKeyring     *Keyring
+	piiKeyringErr  error
+	piiKeyringOnce sync.Once
+)
+
+func init() {
+	schema.RegisterSerializer("encrypted", EncryptedSerializer{})
+}
+
+// Keyring configured by the environment:
+// PII_ENCRYPTION_KEYS: comma separated <keyId>:<base64 32 byte key> pairs
+// PII_ENCRYPTION_KEY_ID: id of the key new values are encrypted with, the first key by default
+// PII_BLIND_INDEX_KEY: base64 key of the blind indexes, it cannot be rotated without reindexing
+func PIIKeyring() (*Keyring, error) {
+	piiKeyringOnce.Do(func() {
+		piiKeyring, piiKeyringErr = NewKeyring(os.Getenv("PII_ENCRYPTION_KEYS"), os.Getenv("PII_ENCRYPTION_KEY_ID"), os.Getenv("PII_BLIND_INDEX_KEY"))
+		if piiKeyringErr != nil {
+			Log.Error(fmt.Sprintf("pii keyring init error: %s", piiKeyringErr.Error()))
+		}
+	})
+	return piiKeyring, piiKeyringErr
+}
+
+func NewKeyring(encryptionKeys string, activeKeyId string, indexKey string) (*Keyring, error) {
+	if encryptionKeys == "" || indexKey == "" {
+		return nil, errors.New("PII_ENCRYPTION_KEYS and PII_BLIND_INDEX_KEY are not set")
+	}
+	keyring := &Keyring{activeKeyId: activeKeyId, keys: map[string]cipher.AEAD{}}
+	for _, pair := range strings.Split(encryptionKeys, ",") {
+		keyId, encodedKey, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found || keyId == "" || strings.Contains(keyId, ":") {
+			return nil, fmt.Errorf("invalid encryption key %q, expected <keyId>:<base64 key>", keyId)
+		}
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %s should be 32 bytes encoded in base64", keyId)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[keyId] = aead
+		if keyring.activeKeyId == "" {
+			keyring.activeKeyId = keyId
+		}
+	}
+	if _, ok := keyring.keys[keyring.activeKeyId]; !ok {
+		return nil, fmt.Errorf("active encryption key %s not found", keyring.activeKeyId)
+	}
+	key, err := base64.StdEncoding.DecodeString(indexKey)
+	if err != nil || len(key) < 32 {
+		return nil, errors.New("blind index key should be at least 32 bytes encoded in base64")
+	}
+	keyring.indexKey = key
+	return keyring, nil
+}
+
+// Encrypt a value with the active key. The column is authenticated with the
+// value so it cannot be copied to another column.
+func (k *Keyring) Encrypt(column string, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	aead := k.keys[k.activeKeyId]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(column))
+	return encryptedPrefix + k.activeKeyId + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a value, values stored before encryption was enabled are returned as is
+func (k *Keyring) Decrypt(column string, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	keyId, encoded, found := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+	aead, ok := k.keys[keyId]
+	if !found || !ok {
+		return "", fmt.Errorf("decrypt %s: unknown key %s", column, keyId)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("decrypt %s: malformed value", column)
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("decrypt %s: %w", column, err)
+	}
+	return string(plaintext), nil
+}
+
+// Whether a stored value is encrypted with the active key
+func (k *Keyring) IsCurrent(value string) bool {
+	return value == "" || strings.HasPrefix(value, encryptedPrefix+k.activeKeyId+":")
+}
+
+// Keyed hash of a normalised value, used to look up and deduplicate encrypted
+// values without decrypting them
+func (k *Keyring) BlindIndex(column string, value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(column + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Blind index of a contact detail with the configured keyring. Emails and phone
+// numbers are normalised first, so the stored indexes match every lookup.
+func BlindIndex(column string, value string) (string, error) {
+	keyring, err := PIIKeyring()
+	if err != nil {
+		return "", err
+	}
+	switch column {
+	case "email":
+		value = NormalizeEmail(value)
+	case "phone_no":
+		value = NormalizePhoneNo(value)
+	}
+	return keyring.BlindIndex(column, value), nil
+}
+
+// Gorm serializer encrypting string fields, used with the serializer:encrypted tag
+type EncryptedSerializer struct{}
+
+func (EncryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var value string
+	switch v := dbValue.(type) {
+	case nil:
+		return nil
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return fmt.Errorf("decrypt %s: unsupported type %T", field.DBName, dbValue)
+	}
+	keyring, err := PIIKeyring()
+	if err != nil {
+		return err
+	}
+	plaintext, err := keyring.Decrypt(field.DBName, value)
+	if err != nil {
+		return err
+	}
+	field.ReflectValueOf(ctx, dst).SetString(plaintext)
+	return nil
+}
+
+func (EncryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	plaintext, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("encrypt %s: unsupported type %T", field.DBName, fieldValue)
+	}
+	keyring, err := PIIKeyring()
+	if err != nil {
+		return nil, err
+	}
+	return keyring.Encrypt(field.DBName, plaintext)
+}
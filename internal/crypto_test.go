@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testKey(c string) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(c, 32)))
+}
+
+func TestNewKeyring(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     string
+		activeId string
+		indexKey string
+		valid    bool
+	}{
+		{"first key active", "k1:" + testKey("a") + ",k2:" + testKey("b"), "", testKey("i"), true},
+		{"active key", "k1:" + testKey("a") + ", k2:" + testKey("b"), "k2", testKey("i"), true},
+		{"no keys", "", "", testKey("i"), false},
+		{"no index key", "k1:" + testKey("a"), "", "", false},
+		{"unknown active key", "k1:" + testKey("a"), "k2", testKey("i"), false},
+		{"missing key id", testKey("a"), "", testKey("i"), false},
+		{"short key", "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), "", testKey("i"), false},
+		{"key not in base64", "k1:not base64!", "", testKey("i"), false},
+		{"short index key", "k1:" + testKey("a"), "", base64.StdEncoding.EncodeToString([]byte("short")), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewKeyring(test.keys, test.activeId, test.indexKey)
+			if (err == nil) != test.valid {
+				t.Errorf("new keyring error = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old, err := NewKeyring("k1:"+testKey("a"), "", testKey("i"))
+	if err != nil {
+		t.Fatalf("old keyring: %v", err)
+	}
+	rotated, err := NewKeyring("k1:"+testKey("a")+",k2:"+testKey("b"), "k2", testKey("i"))
+	if err != nil {
+		t.Fatalf("rotated keyring: %v", err)
+	}
+	withoutOldKey, err := NewKeyring("k2:"+testKey("b"), "", testKey("i"))
+	if err != nil {
+		t.Fatalf("keyring without the old key: %v", err)
+	}
+	oldValue, err := old.Encrypt("email", "ann@example.com")
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	newValue, err := rotated.Encrypt("email", "ann@example.com")
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if !strings.HasPrefix(newValue, encryptedPrefix+"k2:") || rotated.IsCurrent(oldValue) || !rotated.IsCurrent(newValue) {
+		t.Errorf("rotated value = %q, want it encrypted with the active key k2", newValue)
+	}
+
+	// Flip a character of the sealed value, past the prefix and the nonce
+	tampered := []byte(newValue)
+	i := len(tampered) - 10
+	tampered[i] = map[bool]byte{true: 'A', false: 'B'}[tampered[i] != 'A']
+
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		column  string
+		value   string
+		want    string
+		valid   bool
+	}{
+		{"value of the active key", rotated, "email", newValue, "ann@example.com", true},
+		{"value of a previous key", rotated, "email", oldValue, "ann@example.com", true},
+		{"plaintext value", rotated, "email", "ann@example.com", "ann@example.com", true},
+		{"empty value", rotated, "email", "", "", true},
+		{"unknown key id", withoutOldKey, "email", oldValue, "", false},
+		{"value copied to another column", rotated, "phone_no", newValue, "", false},
+		{"tampered value", rotated, "email", string(tampered), "", false},
+		{"malformed value", rotated, "email", encryptedPrefix + "k2:!!", "", false},
+		{"value without key id", rotated, "email", encryptedPrefix + "k2", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.keyring.Decrypt(test.column, test.value)
+			if (err == nil) != test.valid {
+				t.Fatalf("decrypt error = %v, want valid %v", err, test.valid)
+			}
+			if got != test.want {
+				t.Errorf("decrypt = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestKeyringBlindIndex(t *testing.T) {
+	keyring, err := NewKeyring("k1:"+testKey("a")+",k2:"+testKey("b"), "k2", testKey("i"))
+	if err != nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	other, err := NewKeyring("k1:"+testKey("a"), "", testKey("j"))
+	if err != nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	index := keyring.BlindIndex("email", "ann@example.com")
+	if index == "" || index != keyring.BlindIndex("email", "ann@example.com") {
+		t.Errorf("blind index = %q, want a stable index", index)
+	}
+	if index == keyring.BlindIndex("phone_no", "ann@example.com") || index == other.BlindIndex("email", "ann@example.com") {
+		t.Error("blind index should depend on the column and the index key")
+	}
+	if keyring.BlindIndex("email", "") != "" {
+		t.Error("blind index of an empty value should be empty")
+	}
+}
+
+func TestBlindIndexNormalizesContacts(t *testing.T) {
+	setTestKeyring(t)
+	tests := []struct {
+		column string
+		value  string
+		same   string
+	}{
+		{"email", " Ann@Example.COM ", "ann@example.com"},
+		{"phone_no", "0044 (20) 7946-0958", "+442079460958"},
+	}
+	for _, test := range tests {
+		got, _ := BlindIndex(test.column, test.value)
+		want, _ := BlindIndex(test.column, test.same)
+		if got != want {
+			t.Errorf("blind index of %q = %q, want the index of %q", test.value, got, test.same)
+		}
+	}
+}
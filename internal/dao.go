@@ -51,8 +51,8 @@ func (dao *Dao[T]) Create(ctx *context.Context, entity interface{}) error {
 	dao.dbClient.StartSession(ctx)
 	result := dao.dbClient.DbClient(ctx).Create(entity)
 	dao.dbClient.CommitSession()
-	if result.Error != nil {
-		Log.Info(fmt.Sprintf("entity: %+v created", entity))
+	if result.Error == nil {
+		Log.Info(fmt.Sprintf("entity: %T created", entity))
 	}
 	return result.Error
 }
@@ -65,8 +65,8 @@ func (dao *Dao[T]) Update(ctx *context.Context, entity T) error {
 	dao.dbClient.StartSession(ctx)
 	result := dao.dbClient.DbClient(ctx).Save(entity)
 	dao.dbClient.CommitSession()
-	if result.Error != nil {
-		Log.Info(fmt.Sprintf("entity: %+v updated", entity))
+	if result.Error == nil {
+		Log.Info(fmt.Sprintf("entity: %T updated", entity))
 	}
 	return result.Error
 }
@@ -79,8 +79,8 @@ func (dao *Dao[T]) Delete(ctx *context.Context, entity *T) error {
 	dao.dbClient.StartSession(ctx)
 	result := dao.dbClient.DbClient(ctx).Delete(entity)
 	dao.dbClient.CommitSession()
-	if result.Error != nil {
-		Log.Info(fmt.Sprintf("entity: %+v deleted", entity))
+	if result.Error == nil {
+		Log.Info(fmt.Sprintf("entity: %T deleted", entity))
 	}
 	return result.Error
 }
@@ -93,7 +93,7 @@ func (dao *Dao[T]) Delete(ctx *context.Context, entity *T) error {
 func (dao *Dao[T]) Read(ctx *context.Context, filter map[string]interface{}) ([]T, error) {
 	var results []T
 	resp := dao.dbClient.DbClient(ctx).Where(filter).Find(&results)
-	if resp.Error != nil {
+	if resp.Error == nil {
 		Log.Info(fmt.Sprintf("records Found: %d", len(results)))
 	}
 	return results, resp.Error
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"sync"
+)
+
+// Batching loader of the entities of a request. Keys are queued while the
+// parent entities are resolved, the first load then fetches every queued key
+// with a single call. Every key is fetched at most once.
+type DataLoader[K comparable, V any] struct {
+	fetch   func(ctx context.Context, keys []K) (map[K]V, error)
+	mu      sync.Mutex
+	cache   map[K]V
+	pending map[K]bool
+}
+
+// Loader of the values of the keys returned by fetch, missing keys load the zero value
+func NewDataLoader[K comparable, V any](fetch func(ctx context.Context, keys []K) (map[K]V, error)) *DataLoader[K, V] {
+	return &DataLoader[K, V]{fetch: fetch, cache: map[K]V{}, pending: map[K]bool{}}
+}
+
+// Queue keys to fetch with the next load
+func (l *DataLoader[K, V]) Queue(keys ...K) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queue(keys...)
+}
+
+func (l *DataLoader[K, V]) queue(keys ...K) {
+	for _, key := range keys {
+		if _, ok := l.cache[key]; !ok {
+			l.pending[key] = true
+		}
+	}
+}
+
+// Value of a key, fetched along with the queued keys unless already loaded.
+// Concurrent loads wait for the fetch in progress.
+func (l *DataLoader[K, V]) Load(ctx context.Context, key K) (V, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if value, ok := l.cache[key]; ok {
+		return value, nil
+	}
+	l.queue(key)
+	keys := make([]K, 0, len(l.pending))
+	for pending := range l.pending {
+		keys = append(keys, pending)
+	}
+	l.pending = map[K]bool{}
+	values, err := l.fetch(ctx, keys)
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	for _, k := range keys {
+		l.cache[k] = values[k]
+	}
+	return l.cache[key], nil
+}
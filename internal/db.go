@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -46,11 +48,16 @@ func PostgresClientInit(ctx *context.Context) (IClient, error) {
 		DSN:                  dsn,
 		PreferSimpleProtocol: true,
 	}), &gorm.Config{
-		Logger: GormLogger()})
+		Logger:         GormLogger(),
+		TranslateError: true})
 	if err != nil {
 		Log.Error(fmt.Sprintf("postgres client init error: %s", err.Error()))
 		return nil, err
 	}
+	if err := RegisterAuditCallbacks(db); err != nil {
+		Log.Error(fmt.Sprintf("postgres client audit init error: %s", err.Error()))
+		return nil, err
+	}
 	if ctx == nil {
 		context := context.TODO()
 		ctx = &context
@@ -63,9 +70,11 @@ func PostgresClientInit(ctx *context.Context) (IClient, error) {
 	}, nil
 }
 
+// Client scoped to the context. The shared client is not modified as it is used
+// by concurrent requests, and the audit log reads the caller from the context.
 func (c *PostgresClient) DbClient(ctx *context.Context) *gorm.DB {
 	if ctx != nil {
-		c.SetContext(ctx)
+		return c.Client.WithContext(*ctx)
 	}
 	return c.Client
 }
@@ -117,12 +126,22 @@ func (c *PostgresClient) Ping(ctx *context.Context) error {
 
 // Auto Initialize the schema into DB
 func MigrateSchema(c IClient) error {
+	if err := CheckDuplicateContacts(c); err != nil {
+		return err
+	}
 
 	schemas := []interface{}{
 		&User{},
 		&Lend{},
 		&Expense{},
 		&ExpenseBorrower{},
+		&Settlement{},
+		&LedgerEntry{},
+		&UserPreferences{},
+		&Session{},
+		&ApiKey{},
+		&AuditEntry{},
+		&IdempotencyRecord{},
 	}
 
 	for _, schema := range schemas {
@@ -132,5 +151,158 @@ func MigrateSchema(c IClient) error {
 			return err
 		}
 	}
+	if err := EncryptUsers(c); err != nil {
+		return err
+	}
+	return SeedLedger(c)
+}
+
+// Check that no two users share an email or phone number before the unique
+// indexes are created, so the migration does not fail halfway. The users are
+// listed by id, without their contact details, to be merged or corrected.
+func CheckDuplicateContacts(c IClient) error {
+	db := c.DbClient(nil)
+	if !db.Migrator().HasTable(&User{}) {
+		return nil
+	}
+	keyring, err := PIIKeyring()
+	if err != nil {
+		return err
+	}
+	// Read the stored values without the serializer, they can still be plaintext
+	var rows []struct {
+		UId     uuid.UUID `gorm:"column:uid"`
+		Email   string
+		PhoneNo string
+	}
+	if resp := db.Table("users").Select("uid, email, phone_no").Order("uid").Find(&rows); resp.Error != nil {
+		Log.Error(fmt.Sprintf("postgres client check duplicates error: %s", resp.Error.Error()))
+		return resp.Error
+	}
+	owners := map[string][]string{}
+	var keys []string
+	for _, row := range rows {
+		for _, contact := range []struct{ column, value string }{{"email", row.Email}, {"phone_no", row.PhoneNo}} {
+			value, err := keyring.Decrypt(contact.column, contact.value)
+			if err != nil {
+				return err
+			}
+			if contact.column == "email" {
+				value = NormalizeEmail(value)
+			} else {
+				value = NormalizePhoneNo(value)
+			}
+			if value == "" {
+				continue
+			}
+			key := contact.column + ":" + value
+			if owners[key] == nil {
+				keys = append(keys, key)
+			}
+			owners[key] = append(owners[key], row.UId.String())
+		}
+	}
+	var duplicates []string
+	for _, key := range keys {
+		if len(owners[key]) > 1 {
+			column, _, _ := strings.Cut(key, ":")
+			duplicates = append(duplicates, fmt.Sprintf("%s shared by %s", column, strings.Join(owners[key], ", ")))
+		}
+	}
+	if len(duplicates) > 0 {
+		err := fmt.Errorf("%d emails or phone numbers are shared by several users, merge or correct them before migrating: %s", len(duplicates), strings.Join(duplicates, "; "))
+		Log.Error(fmt.Sprintf("postgres client check duplicates error: %s", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// Encrypt the contact details stored in plaintext or with a previous key and
+// fill their blind indexes, also reindexing the values indexed before they were
+// normalised. The unique indexes of the plaintext columns are replaced by the
+// ones of the blind indexes.
+func EncryptUsers(c IClient) error {
+	keyring, err := PIIKeyring()
+	if err != nil {
+		return err
+	}
+	db := c.DbClient(nil)
+	for _, index := range []string{"idx_users_email", "idx_users_phone_no"} {
+		if db.Migrator().HasIndex(&User{}, index) {
+			if err := db.Migrator().DropIndex(&User{}, index); err != nil {
+				Log.Error(fmt.Sprintf("postgres client drop index error: %s", err.Error()))
+				return err
+			}
+		}
+	}
+	// Read the stored values without the serializer to find the stale rows
+	var rows []struct {
+		UId          uuid.UUID `gorm:"column:uid"`
+		Email        string
+		PhoneNo      string
+		EmailIndex   string
+		PhoneNoIndex string
+	}
+	if resp := db.Table("users").Select("uid, email, phone_no, email_index, phone_no_index").Find(&rows); resp.Error != nil {
+		Log.Error(fmt.Sprintf("postgres client encrypt users error: %s", resp.Error.Error()))
+		return resp.Error
+	}
+	count := 0
+	for _, row := range rows {
+		stale := !keyring.IsCurrent(row.Email) || !keyring.IsCurrent(row.PhoneNo)
+		for _, contact := range []struct{ column, value, index string }{{"email", row.Email, row.EmailIndex}, {"phone_no", row.PhoneNo, row.PhoneNoIndex}} {
+			value, err := keyring.Decrypt(contact.column, contact.value)
+			if err != nil {
+				return err
+			}
+			index, err := BlindIndex(contact.column, value)
+			if err != nil {
+				return err
+			}
+			stale = stale || index != contact.index
+		}
+		if !stale {
+			continue
+		}
+		var user User
+		if resp := db.Where("uid = ?", row.UId).First(&user); resp.Error != nil {
+			return resp.Error
+		}
+		if resp := db.Model(&user).Select("email", "phone_no", "email_index", "phone_no_index").Updates(&user); resp.Error != nil {
+			Log.Error(fmt.Sprintf("postgres client encrypt users error: %s", resp.Error.Error()))
+			return resp.Error
+		}
+		count++
+	}
+	if count > 0 {
+		Log.Info(fmt.Sprintf("encrypted the contact details of %d users", count))
+	}
+	return nil
+}
+
+// Record the current balance of lends without any ledger entries as an
+// opening entry, so the lends can be rebuilt from the ledger.
+func SeedLedger(c IClient) error {
+	db := c.DbClient(nil)
+	var lends []*Lend
+	resp := db.Where("amount <> 0 AND NOT EXISTS (SELECT 1 FROM ledger_entries e WHERE e.l_id = lends.l_id)").Find(&lends)
+	if resp.Error != nil {
+		Log.Error(fmt.Sprintf("postgres client seed ledger error: %s", resp.Error.Error()))
+		return resp.Error
+	}
+	if len(lends) == 0 {
+		return nil
+	}
+	entries := make([]*LedgerEntry, len(lends))
+	for i, lend := range lends {
+		entries[i] = NewLedgerEntry(LedgerSourceOpening, nil, lend.LenderId, lend.BorrowerId, lend.Amount)
+		entries[i].LId, entries[i].CreatedAt = lend.LId, lend.UpdatedAt
+	}
+	// Written through gorm so the opening entries are audited
+	if resp := db.CreateInBatches(entries, 500); resp.Error != nil {
+		Log.Error(fmt.Sprintf("postgres client seed ledger error: %s", resp.Error.Error()))
+		return resp.Error
+	}
+	Log.Info(fmt.Sprintf("seeded ledger with %d opening entries", len(entries)))
 	return nil
 }
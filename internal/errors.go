@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+// Returned when an entity does not exist
+var ErrNotFound = errors.New("not found")
+
+// Returned when a request is malformed or invalid
+var ErrValidation = errors.New("validation failed")
+
+// Returned when a caller made too many requests
+var ErrRateLimited = errors.New("rate limited")
+
+// Returned when an idempotency key is reused with a different request
+var ErrIdempotencyKeyReused = errors.New("idempotency key reused")
+
+// Machine readable code of an error response
+type ErrorCode string
+
+const (
+	CodeValidation           ErrorCode = "validation_failed"
+	CodeInvalidRef           ErrorCode = "invalid_reference"
+	CodeUnauthorized         ErrorCode = "unauthorized"
+	CodeForbidden            ErrorCode = "forbidden"
+	CodeNotFound             ErrorCode = "not_found"
+	CodeConflict             ErrorCode = "conflict"
+	CodePayloadTooLarge      ErrorCode = "payload_too_large"
+	CodeRateLimited          ErrorCode = "rate_limited"
+	CodeIdempotencyKeyReused ErrorCode = "idempotency_key_reused"
+	CodeInternal             ErrorCode = "internal_error"
+)
+
+type NotFoundError struct {
+	Entity string `json:"entity"`
+	Id     string `json:"id"`
+}
+
+func NewNotFoundError(entity string, id interface{}) *NotFoundError {
+	return &NotFoundError{Entity: entity, Id: fmt.Sprint(id)}
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s not found: %s", e.Entity, e.Id)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// Validation failure of a single field
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+type ValidationError struct {
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+func (e *ValidationError) Error() string {
+	return "validationError: " + e.Message
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// Validation error without field details
+func Invalidf(format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Message: fmt.Sprintf(format, args...)}
+}
+
+// Validation error of a single field
+func InvalidField(field string, rule string, param string, message string) *ValidationError {
+	return &ValidationError{Message: message, Fields: []FieldError{{Field: field, Rule: rule, Param: param, Message: message}}}
+}
+
+// Validation error with the failed fields of a validator error
+func newFieldsError(validationErrors validator.ValidationErrors) *ValidationError {
+	fields := make([]FieldError, 0, len(validationErrors))
+	for _, fieldErr := range validationErrors {
+		// Namespace without the struct name, e.g. users[0].amount
+		_, field, found := strings.Cut(fieldErr.Namespace(), ".")
+		if !found {
+			field = fieldErr.Field()
+		}
+		segments := strings.Split(field, ".")
+		for i, segment := range segments {
+			segments[i] = strings.ToLower(segment[:1]) + segment[1:]
+		}
+		fields = append(fields, FieldError{
+			Field:   strings.Join(segments, "."),
+			Rule:    fieldErr.Tag(),
+			Param:   fieldErr.Param(),
+			Message: fieldErr.Error(),
+		})
+	}
+	return &ValidationError{Message: "invalid fields", Fields: fields}
+}
+
+// Treat an error of a request as a validation error, errors that already map
+// to a client error are returned as is
+func NewValidationError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		return newFieldsError(validationErrors)
+	}
+	if status, _, _ := ErrorStatus(err); status != http.StatusInternalServerError {
+		return err
+	}
+	return Invalidf("%s", strings.TrimPrefix(err.Error(), "error: "))
+}
+
+// Map an error to its HTTP status, code and details
+// @param err error: The error
+// @return int: HTTP status
+// @return ErrorCode: Machine readable code
+// @return interface{}: Details of the error, nil when there are none
+func ErrorStatus(err error) (int, ErrorCode, interface{}) {
+	var validationErr *ValidationError
+	var notFoundErr *NotFoundError
+	var policyErr *PolicyError
+	var maxBytesErr *http.MaxBytesError
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		validationErr = newFieldsError(validationErrors)
+	} else {
+		errors.As(err, &validationErr)
+	}
+	switch {
+	case validationErr != nil:
+		if len(validationErr.Fields) > 0 {
+			return http.StatusBadRequest, CodeValidation, validationErr.Fields
+		}
+		return http.StatusBadRequest, CodeValidation, nil
+	case errors.Is(err, ErrValidation):
+		return http.StatusBadRequest, CodeValidation, nil
+	case errors.Is(err, gorm.ErrForeignKeyViolated):
+		return http.StatusBadRequest, CodeInvalidRef, nil
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge, CodePayloadTooLarge, map[string]int64{"limit": maxBytesErr.Limit}
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized, CodeUnauthorized, nil
+	case errors.As(err, &policyErr):
+		return http.StatusForbidden, CodeForbidden, policyErr
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden, CodeForbidden, nil
+	case errors.As(err, &notFoundErr):
+		return http.StatusNotFound, CodeNotFound, notFoundErr
+	case errors.Is(err, ErrNotFound), errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound, CodeNotFound, nil
+	case errors.Is(err, ErrConflict), errors.Is(err, gorm.ErrDuplicatedKey):
+		return http.StatusConflict, CodeConflict, nil
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests, CodeRateLimited, nil
+	case errors.Is(err, ErrIdempotencyKeyReused):
+		return http.StatusUnprocessableEntity, CodeIdempotencyKeyReused, nil
+	}
+	return http.StatusInternalServerError, CodeInternal, nil
+}
+
+// Error envelope of an error. The message of internal errors is not exposed.
+func NewErrorResp(err error) (int, *Response) {
+	statusCode, code, details := ErrorStatus(err)
+	errMsg := err.Error()
+	if statusCode == http.StatusInternalServerError {
+		errMsg = "error: internal server error"
+	}
+	resp := ErrorResp(&statusCode, &errMsg, nil)
+	resp.Code, resp.Details = code, details
+	return statusCode, resp
+}
+
+// Log an error of an operation and write its error envelope
+func WriteError(w http.ResponseWriter, operation string, err error) {
+	Log.Error(fmt.Sprintf("%s error: %s", operation, err.Error()))
+	statusCode, resp := NewErrorResp(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+func TestErrorStatus(t *testing.T) {
+	type request struct {
+		Amount float64 `validate:"gt=0"`
+	}
+	validationErrors := validator.New().Struct(request{})
+	notFound := NewNotFoundError("user", "42")
+	policyErr := &PolicyError{Action: ActionUserManage, Reason: "not the owner"}
+
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		code    ErrorCode
+		details interface{}
+	}{
+		{"validator errors", fmt.Errorf("bind: %w", validationErrors), http.StatusBadRequest, CodeValidation,
+			[]FieldError{{Field: "amount", Rule: "gt", Param: "0", Message: validationErrors.(validator.ValidationErrors)[0].Error()}}},
+		{"invalid field", InvalidField("email", "email", "", "invalid email"), http.StatusBadRequest, CodeValidation,
+			[]FieldError{{Field: "email", Rule: "email", Message: "invalid email"}}},
+		{"invalid request", Invalidf("bad request"), http.StatusBadRequest, CodeValidation, nil},
+		{"validation sentinel", fmt.Errorf("%w: bad request", ErrValidation), http.StatusBadRequest, CodeValidation, nil},
+		{"foreign key", gorm.ErrForeignKeyViolated, http.StatusBadRequest, CodeInvalidRef, nil},
+		{"body too large", &http.MaxBytesError{Limit: 1024}, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, map[string]int64{"limit": 1024}},
+		{"unauthorized", fmt.Errorf("%w: token expired", ErrUnauthorized), http.StatusUnauthorized, CodeUnauthorized, nil},
+		{"policy", fmt.Errorf("update user: %w", policyErr), http.StatusForbidden, CodeForbidden, policyErr},
+		{"forbidden", ErrForbidden, http.StatusForbidden, CodeForbidden, nil},
+		{"entity not found", notFound, http.StatusNotFound, CodeNotFound, notFound},
+		{"not found", fmt.Errorf("%w: user", ErrNotFound), http.StatusNotFound, CodeNotFound, nil},
+		{"record not found", gorm.ErrRecordNotFound, http.StatusNotFound, CodeNotFound, nil},
+		{"conflict", fmt.Errorf("%w: already settled", ErrConflict), http.StatusConflict, CodeConflict, nil},
+		{"duplicated key", gorm.ErrDuplicatedKey, http.StatusConflict, CodeConflict, nil},
+		{"rate limited", ErrRateLimited, http.StatusTooManyRequests, CodeRateLimited, nil},
+		{"idempotency key reused", ErrIdempotencyKeyReused, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused, nil},
+		{"internal", errors.New("connection refused"), http.StatusInternalServerError, CodeInternal, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, code, details := ErrorStatus(test.err)
+			if status != test.status || code != test.code {
+				t.Errorf("status = %d %s, want %d %s", status, code, test.status, test.code)
+			}
+			if !reflect.DeepEqual(details, test.details) {
+				t.Errorf("details = %#v, want %#v", details, test.details)
+			}
+		})
+	}
+}
+
+func TestNewErrorRespHidesInternalErrors(t *testing.T) {
+	status, resp := NewErrorResp(errors.New("dial tcp 10.0.0.5:5432: connection refused"))
+	if status != http.StatusInternalServerError || resp.Message != "error: internal server error" {
+		t.Errorf("response = %d %q, want the internal server error message", status, resp.Message)
+	}
+	status, resp = NewErrorResp(NewNotFoundError("user", "42"))
+	if status != http.StatusNotFound || resp.Message != "user not found: 42" {
+		t.Errorf("response = %d %q, want the not found message", status, resp.Message)
+	}
+}
+
+func TestNewValidationError(t *testing.T) {
+	if err := NewValidationError(nil); err != nil {
+		t.Errorf("nil error = %v", err)
+	}
+	if err := NewValidationError(ErrConflict); err != ErrConflict {
+		t.Errorf("client error = %v, want it unchanged", err)
+	}
+	err := NewValidationError(errors.New("error: unexpected EOF"))
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Message != "unexpected EOF" {
+		t.Errorf("internal error = %#v, want a validation error", err)
+	}
+}
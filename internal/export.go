@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Share of an expense borrowed by the exported user
+type ExportShare struct {
+	ExpenseId   uuid.UUID `json:"expenseId"`
+	LenderId    uuid.UUID `json:"lenderId"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Amount      float64   `json:"amount"`
+	IsPaid      bool      `json:"isPaid"`
+}
+
+// Personal data held about a user
+type UserExport struct {
+	ExportedAt    time.Time      `json:"exportedAt"`
+	User          User           `json:"user"`
+	ExpensesPaid  []*Expense     `json:"expensesPaid"`
+	ExpenseShares []*ExportShare `json:"expenseShares"`
+	Settlements   []*Settlement  `json:"settlements"`
+	Ledger        []*LedgerEntry `json:"ledger"`
+	Balances      []*Lend        `json:"balances"`
+}
+
+// Write the export as a zip archive with a JSON document and a CSV file per section
+// @param w io.Writer: Destination of the archive
+// @return error: The error if any
+func (e *UserExport) WriteArchive(w io.Writer) error {
+	archive := zip.NewWriter(w)
+	file, err := archive.Create("export.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(e); err != nil {
+		return err
+	}
+
+	timestamp := func(t time.Time) string { return t.Format(time.RFC3339) }
+	amount := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+	sections := []struct {
+		name   string
+		header []string
+		rows   [][]string
+	}{
+		{"profile.csv", []string{"uId", "name", "email", "phoneNo", "createdAt"}, [][]string{
+			{e.User.UId.String(), e.User.Name, e.User.Email, e.User.PhoneNo, timestamp(e.User.CreatedAt)},
+		}},
+		{"expenses_paid.csv", []string{"exId", "createdAt", "category", "description", "amount"}, nil},
+		{"expense_shares.csv", []string{"expenseId", "lenderId", "createdAt", "description", "amount", "isPaid"}, nil},
+		{"settlements.csv", []string{"sId", "payerId", "payeeId", "amount", "currency", "rate", "settledAmount", "createdAt"}, nil},
+		{"ledger.csv", []string{"eId", "lenderId", "borrowerId", "amount", "source", "sourceId", "createdAt"}, nil},
+		{"balances.csv", []string{"lId", "lenderId", "borrowerId", "amount", "updatedAt"}, nil},
+	}
+	for _, expense := range e.ExpensesPaid {
+		sections[1].rows = append(sections[1].rows, []string{
+			expense.ExId.String(), timestamp(expense.CreatedAt), expense.Category, expense.Description, amount(expense.Amount),
+		})
+	}
+	for _, share := range e.ExpenseShares {
+		sections[2].rows = append(sections[2].rows, []string{
+			share.ExpenseId.String(), share.LenderId.String(), timestamp(share.CreatedAt), share.Description, amount(share.Amount), strconv.FormatBool(share.IsPaid),
+		})
+	}
+	for _, settlement := range e.Settlements {
+		sections[3].rows = append(sections[3].rows, []string{
+			settlement.SId.String(), settlement.PayerId.String(), settlement.PayeeId.String(), amount(settlement.Amount),
+			settlement.Currency, amount(settlement.Rate), amount(settlement.SettledAmount), timestamp(settlement.CreatedAt),
+		})
+	}
+	for _, entry := range e.Ledger {
+		sourceId := ""
+		if entry.SourceId != nil {
+			sourceId = entry.SourceId.String()
+		}
+		sections[4].rows = append(sections[4].rows, []string{
+			entry.EId.String(), entry.LenderId.String(), entry.BorrowerId.String(), amount(entry.Amount), entry.Source, sourceId, timestamp(entry.CreatedAt),
+		})
+	}
+	for _, lend := range e.Balances {
+		sections[5].rows = append(sections[5].rows, []string{
+			lend.LId.String(), lend.LenderId.String(), lend.BorrowerId.String(), amount(lend.Amount), timestamp(lend.UpdatedAt),
+		})
+	}
+
+	for _, section := range sections {
+		file, err := archive.Create(section.name)
+		if err != nil {
+			return err
+		}
+		writer := csv.NewWriter(file)
+		writer.Write(section.header)
+		writer.WriteAll(section.rows)
+		if err := writer.Error(); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
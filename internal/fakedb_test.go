@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"io"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// Statement sent to the fake database
+type fakeStatement struct {
+	Query string
+	Args  []driver.Value
+}
+
+// In memory stand-in of postgres recording the statements it receives. Selects
+// return the rows registered for their table, whatever their conditions but the
+// equality on the filtered columns, and counts the count registered for their
+// table, zero by default.
+type fakeDB struct {
+	mu         sync.Mutex
+	statements []fakeStatement
+	rows       map[string][]map[string]driver.Value
+	counts     map[string]int64
+	// Called after each write, e.g. to change the rows it writes
+	onWrite func(statement fakeStatement)
+	// Upserts affect no rows, as if they conflicted with a row left unchanged
+	skipUpserts bool
+	// Columns whose equality conditions, e.g. email_index = $1, filter the selects
+	filterColumns []string
+}
+
+var fakeTableRegexp = regexp.MustCompile(`(?i)\bFROM "?(\w+)"?`)
+
+func (f *fakeDB) record(query string, args []driver.NamedValue) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	statement := fakeStatement{Query: query, Args: values}
+	f.mu.Lock()
+	f.statements = append(f.statements, statement)
+	onWrite := f.onWrite
+	f.mu.Unlock()
+	if onWrite != nil && !strings.HasPrefix(query, "SELECT") {
+		onWrite(statement)
+	}
+}
+
+// Statements containing the given text
+func (f *fakeDB) Find(text string) []fakeStatement {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var found []fakeStatement
+	for _, statement := range f.statements {
+		if strings.Contains(statement.Query, text) {
+			found = append(found, statement)
+		}
+	}
+	return found
+}
+
+func (f *fakeDB) query(query string, args []driver.NamedValue) *fakeRows {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	match := fakeTableRegexp.FindStringSubmatch(query)
+	if !strings.HasPrefix(strings.TrimSpace(query), "SELECT") || match == nil {
+		return &fakeRows{}
+	}
+	if strings.Contains(strings.ToLower(query), "count(") {
+		return &fakeRows{columns: []string{"count"}, values: [][]driver.Value{{f.counts[match[1]]}}}
+	}
+	rows := f.rows[match[1]]
+	for _, column := range f.filterColumns {
+		condition := regexp.MustCompile(`\b"?` + column + `"?\s*=\s*\$(\d+)`).FindStringSubmatch(query)
+		if condition == nil {
+			continue
+		}
+		i, _ := strconv.Atoi(condition[1])
+		var filtered []map[string]driver.Value
+		for _, row := range rows {
+			if i <= len(args) && row[column] == args[i-1].Value {
+				filtered = append(filtered, row)
+			}
+		}
+		rows = filtered
+	}
+	result := &fakeRows{}
+	for _, row := range rows {
+		if result.columns == nil {
+			for column := range row {
+				result.columns = append(result.columns, column)
+			}
+			slices.Sort(result.columns)
+		}
+		values := make([]driver.Value, len(result.columns))
+		for i, column := range result.columns {
+			values[i] = row[column]
+		}
+		result.values = append(result.values, values)
+	}
+	return result
+}
+
+func (f *fakeDB) Open(name string) (driver.Conn, error) { return &fakeConn{db: f}, nil }
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db: f}, nil }
+
+func (f *fakeDB) Driver() driver.Driver { return f }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+func (c *fakeConn) Close() error { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.db.record("BEGIN", nil)
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.record("COMMIT", nil)
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.db.record("ROLLBACK", nil)
+	return nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.record(query, args)
+	if c.db.skipUpserts && strings.Contains(query, "ON CONFLICT") {
+		return driver.RowsAffected(0), nil
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.record(query, args)
+	return c.db.query(query, args), nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, namedValues(args))
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, namedValues(args))
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// Client of the fake database, sessions are left to the transactions
+type fakeClient struct {
+	IClient
+	db *gorm.DB
+}
+
+func (c *fakeClient) DbClient(ctx *context.Context) *gorm.DB {
+	if ctx != nil {
+		return c.db.WithContext(*ctx)
+	}
+	return c.db
+}
+
+func (c *fakeClient) StartSession(*context.Context) error { return nil }
+func (c *fakeClient) CommitSession() error                { return nil }
+func (c *fakeClient) AbortSession() error                 { return nil }
+
+// Open a gorm client on a fake database with the audit callbacks of the
+// postgres client
+func newFakeDB(t *testing.T) (*fakeDB, *fakeClient) {
+	t.Helper()
+	setTestKeyring(t)
+	fake := &fakeDB{rows: map[string][]map[string]driver.Value{}, counts: map[string]int64{}}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(fake)}), &gorm.Config{
+		Logger:         logger.Discard,
+		TranslateError: true,
+	})
+	if err != nil {
+		t.Fatalf("open fake db: %v", err)
+	}
+	if err := RegisterAuditCallbacks(db); err != nil {
+		t.Fatalf("register audit callbacks: %v", err)
+	}
+	return fake, &fakeClient{db: db}
+}
+
+// Remove the rows of a table
+func (f *fakeDB) ClearRows(table string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.rows, table)
+}
+
+// Register rows returned by the selects of the table of the models
+func (f *fakeDB) AddRows(t *testing.T, models ...interface{}) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, model := range models {
+		modelSchema, err := schema.Parse(model, &sync.Map{}, schema.NamingStrategy{})
+		if err != nil {
+			t.Fatalf("parse %T: %v", model, err)
+		}
+		rv := reflect.Indirect(reflect.ValueOf(model))
+		row := map[string]driver.Value{}
+		for _, field := range modelSchema.Fields {
+			if field.DBName == "" {
+				continue
+			}
+			value, _ := field.ValueOf(context.Background(), rv)
+			if row[field.DBName], err = driver.DefaultParameterConverter.ConvertValue(value); err != nil {
+				t.Fatalf("convert %s: %v", field.DBName, err)
+			}
+		}
+		f.rows[modelSchema.Table] = append(f.rows[modelSchema.Table], row)
+	}
+}
+
+// Configure the personal data keys once for the tests, the keyring is loaded once
+func setTestKeyring(t *testing.T) {
+	t.Helper()
+	testKeyringOnce.Do(func() {
+		key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+		t.Setenv("PII_ENCRYPTION_KEYS", "test:"+key)
+		t.Setenv("PII_BLIND_INDEX_KEY", key)
+		if _, err := PIIKeyring(); err != nil {
+			t.Fatalf("pii keyring: %v", err)
+		}
+	})
+}
+
+var testKeyringOnce sync.Once
+
+// Context of a request authenticated as the user
+func userContext(user *User) context.Context {
+	return ContextWithPrincipal(context.Background(), &Principal{User: user})
+}
@@ -0,0 +1,656 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/google/uuid"
+	graphql "github.com/graph-gophers/graphql-go"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+	"go.uber.org/zap"
+)
+
+const GraphQLPath = "/graphql"
+
+// Deepest field nesting of a query
+const graphQLMaxDepth = 12
+
+// Most expenses a list of shared expenses returns
+const maxSharedExpenses = 100
+
+const graphQLSchema = `
+scalar Time
+
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+type Query {
+	# Authenticated user, null for API keys
+	me: User
+	user(uId: ID!): User!
+	expense(exId: ID!): Expense!
+	# Balance between two users
+	balance(userId1: ID!, userId2: ID!): Lend!
+}
+
+type Mutation {
+	# Split an expense between its users, see POST /expense
+	createExpense(input: ExpenseInput!): Expense!
+	# Settle all outstanding obligations between two users, see POST /lender/settle-all
+	settleAll(input: SettleAllInput!): Settlement!
+}
+
+type User {
+	uId: ID!
+	name: String!
+	email: String
+	phoneNo: String
+	createdAt: Time!
+	# Placeholder users are created for people invited to an expense before signing up
+	isPlaceholder: Boolean!
+	# Balances with every other user
+	balances: [Lend!]!
+}
+
+# Balance between two users, a positive amount is owed by the borrower
+type Lend {
+	lId: ID!
+	lender: User!
+	borrower: User!
+	amount: Float!
+	updatedAt: Time!
+	# Other user of the balance when listed from the balances of a user
+	counterpart: User
+	# Most recent expenses one of the users paid for the other, at most 100
+	expenses(first: Int = 10): [Expense!]!
+}
+
+type Expense {
+	exId: ID!
+	category: String!
+	amount: Float!
+	description: String!
+	createdAt: Time!
+	lender: User!
+	borrowers: [ExpenseBorrower!]!
+}
+
+type ExpenseBorrower {
+	borrower: User!
+	amount: Float!
+	isPaid: Boolean!
+}
+
+type Settlement {
+	sId: ID!
+	payer: User!
+	payee: User!
+	amount: Float!
+	currency: String
+	rate: Float!
+	settledAmount: Float!
+	createdAt: Time!
+}
+
+# Existing user by id, or a person by email or phone number
+input UserRefInput {
+	uId: ID
+	name: String
+	email: String
+	phoneNo: String
+}
+
+input ExpenseInput {
+	# equal, exact or percent, the lender's preferred split type by default
+	type: String
+	lenderId: ID!
+	amount: Float!
+	description: String
+	users: [UserRefInput!]!
+	percents: [Float!]
+	values: [Float!]
+}
+
+input SettleAllInput {
+	userId1: ID!
+	userId2: ID!
+	currency: String
+	rate: Float
+}
+`
+
+// Body of a GraphQL request
+type GraphQLRequest struct {
+	Query         string                 `json:"query" validate:"required"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// GraphQL endpoint over the users, expenses and balances. The resolvers call
+// the handlers of the REST routes for the root fields, nested fields are
+// loaded by the batching loaders of the request.
+type GraphQLHandler struct {
+	schema   *graphql.Schema
+	users    *UserHandler
+	expenses *ExpenseHandler
+	lenders  *LenderHandler
+}
+
+func NewGraphQLHandler(users *UserHandler, expenses *ExpenseHandler, lenders *LenderHandler) (*GraphQLHandler, error) {
+	handler := &GraphQLHandler{users: users, expenses: expenses, lenders: lenders}
+	schema, err := graphql.ParseSchema(graphQLSchema, &graphQLResolver{handler: handler},
+		graphql.MaxDepth(graphQLMaxDepth),
+		graphql.Logger(graphQLLogger{}),
+		graphql.PanicHandler(graphQLLogger{}),
+	)
+	if err != nil {
+		Log.Error(fmt.Sprintf("graphql schema error: %s", err.Error()))
+		return nil, err
+	}
+	handler.schema = schema
+	return handler, nil
+}
+
+// Execute a query. Errors of the resolvers carry the code and details of their
+// error response in their extensions, the messages of internal errors are not exposed.
+func (g *GraphQLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req GraphQLRequest
+	if err := Bind(r, &req); err != nil {
+		WriteError(w, "graphql", err)
+		return
+	}
+	ctx := context.WithValue(r.Context(), loadersContextKey, g.newLoaders())
+	resp := g.schema.Exec(ctx, req.Query, req.OperationName, req.Variables)
+	for _, queryErr := range resp.Errors {
+		if queryErr.ResolverError == nil {
+			continue
+		}
+		Log.Error(fmt.Sprintf("graphql %v error: %s", queryErr.Path, queryErr.ResolverError.Error()))
+		statusCode, errResp := NewErrorResp(queryErr.ResolverError)
+		queryErr.Message = errResp.Message
+		queryErr.Extensions = map[string]interface{}{"code": errResp.Code, "status": statusCode}
+		if errResp.Details != nil {
+			queryErr.Extensions["details"] = errResp.Details
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		Log.Error(fmt.Sprintf("encode response error: %s", err.Error()))
+	}
+}
+
+// Logs the panics of the resolvers and hides them from the callers
+type graphQLLogger struct{}
+
+func (graphQLLogger) LogPanic(ctx context.Context, value interface{}) {
+	Log.Error(fmt.Sprintf("panic: %v", value),
+		zap.String("requestId", RequestIdFromContext(ctx)),
+		zap.ByteString("stack", debug.Stack()),
+	)
+}
+
+func (graphQLLogger) MakePanicError(ctx context.Context, value interface{}) *gqlerrors.QueryError {
+	queryErr := gqlerrors.Errorf("error: internal server error")
+	queryErr.Extensions = map[string]interface{}{"code": CodeInternal, "status": http.StatusInternalServerError}
+	return queryErr
+}
+
+const loadersContextKey contextKey = "graphqlLoaders"
+
+// Most recent expenses shared by a lender and a borrower
+type sharedExpensesKey struct {
+	LenderId   uuid.UUID
+	BorrowerId uuid.UUID
+	Limit      int
+}
+
+// Loaders of a request, their values are cached for the request only
+type graphQLLoaders struct {
+	users          *DataLoader[uuid.UUID, *User]
+	lends          *DataLoader[uuid.UUID, []*Lend]
+	sharedExpenses *DataLoader[sharedExpensesKey, []*Expense]
+}
+
+// The users of the lends and expenses fetched are queued on the users loader,
+// so the users of a whole list are fetched at once.
+func (g *GraphQLHandler) newLoaders() *graphQLLoaders {
+	loaders := &graphQLLoaders{}
+	loaders.users = NewDataLoader(func(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]*User, error) {
+		users, err := g.users.service.GetMany(&ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		if err := g.users.RedactContacts(ctx, users...); err != nil {
+			return nil, err
+		}
+		byId := make(map[uuid.UUID]*User, len(users))
+		for _, user := range users {
+			byId[user.UId] = user
+		}
+		return byId, nil
+	})
+	loaders.lends = NewDataLoader(func(ctx context.Context, userIds []uuid.UUID) (map[uuid.UUID][]*Lend, error) {
+		lends, err := g.lenders.service.GetLendSummaries(&ctx, userIds)
+		if err != nil {
+			return nil, err
+		}
+		byUser := make(map[uuid.UUID][]*Lend, len(userIds))
+		for _, lend := range lends {
+			byUser[lend.LenderId] = append(byUser[lend.LenderId], lend)
+			byUser[lend.BorrowerId] = append(byUser[lend.BorrowerId], lend)
+			loaders.users.Queue(lend.LenderId, lend.BorrowerId)
+		}
+		return byUser, nil
+	})
+	loaders.sharedExpenses = NewDataLoader(func(ctx context.Context, keys []sharedExpensesKey) (map[sharedExpensesKey][]*Expense, error) {
+		// The keys of a list share their limit, so this is one query per list
+		pairsByLimit := map[int][][2]uuid.UUID{}
+		for _, key := range keys {
+			pairsByLimit[key.Limit] = append(pairsByLimit[key.Limit], [2]uuid.UUID{key.LenderId, key.BorrowerId})
+		}
+		byKey := make(map[sharedExpensesKey][]*Expense, len(keys))
+		for limit, pairs := range pairsByLimit {
+			shared, err := g.expenses.service.ListShared(&ctx, pairs, limit)
+			if err != nil {
+				return nil, err
+			}
+			for _, pair := range pairs {
+				expenses := shared[GenerateUUIDFromUUIDs(pair[0], pair[1])]
+				byKey[sharedExpensesKey{pair[0], pair[1], limit}] = expenses
+				for _, expense := range expenses {
+					loaders.users.Queue(expense.Participants()...)
+				}
+			}
+		}
+		return byKey, nil
+	})
+	return loaders
+}
+
+func loadersFromContext(ctx context.Context) *graphQLLoaders {
+	return ctx.Value(loadersContextKey).(*graphQLLoaders)
+}
+
+// Load a user, siblings are the users listed along with it
+func loadUser(ctx context.Context, id uuid.UUID, siblings []uuid.UUID) (*userResolver, error) {
+	if err := Authorize(ctx, ActionUserRead, Resource{}); err != nil {
+		return nil, err
+	}
+	user, err := loadersFromContext(ctx).users.Load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, NewNotFoundError("user", id)
+	}
+	return &userResolver{user: user, siblings: siblings}, nil
+}
+
+func parseGraphQLId(field string, id graphql.ID) (uuid.UUID, error) {
+	if id == "" {
+		return uuid.Nil, InvalidField(field, "required", "", fmt.Sprintf("%s is required", field))
+	}
+	return parseId(field, string(id))
+}
+
+func valueOrEmpty[T any](value *T) T {
+	var zero T
+	if value == nil {
+		return zero
+	}
+	return *value
+}
+
+// Resolver of the queries and mutations
+type graphQLResolver struct {
+	handler *GraphQLHandler
+}
+
+func (q *graphQLResolver) Me(ctx context.Context) (*userResolver, error) {
+	principal := PrincipalFromContext(ctx)
+	if principal == nil || principal.User == nil {
+		return nil, nil
+	}
+	return &userResolver{user: principal.User}, nil
+}
+
+func (q *graphQLResolver) User(ctx context.Context, args struct{ UId graphql.ID }) (*userResolver, error) {
+	uid, err := parseGraphQLId("uId", args.UId)
+	if err != nil {
+		return nil, err
+	}
+	user, err := call(ctx, q.handler.users.GetUser, &UserPath{UId: uid})
+	if err != nil {
+		return nil, err
+	}
+	return &userResolver{user: user}, nil
+}
+
+func (q *graphQLResolver) Expense(ctx context.Context, args struct{ ExId graphql.ID }) (*expenseResolver, error) {
+	exId, err := parseGraphQLId("exId", args.ExId)
+	if err != nil {
+		return nil, err
+	}
+	expense, err := call(ctx, q.handler.expenses.GetExpense, &ExpensePath{ExId: exId})
+	if err != nil {
+		return nil, err
+	}
+	loadersFromContext(ctx).users.Queue(expense.Participants()...)
+	return &expenseResolver{expense: expense}, nil
+}
+
+func (q *graphQLResolver) Balance(ctx context.Context, args struct{ UserId1, UserId2 graphql.ID }) (*lendResolver, error) {
+	userId1, err := parseGraphQLId("userId1", args.UserId1)
+	if err != nil {
+		return nil, err
+	}
+	userId2, err := parseGraphQLId("userId2", args.UserId2)
+	if err != nil {
+		return nil, err
+	}
+	lend, err := call(ctx, q.handler.lenders.GetBalance, &BalanceRequest{UserId1: userId1, UserId2: userId2})
+	if err != nil {
+		return nil, err
+	}
+	// Pairs without a balance yet have an empty lend
+	if lend.LId == uuid.Nil {
+		lend = NewLender(userId1, userId2, 0)
+	}
+	loadersFromContext(ctx).users.Queue(lend.LenderId, lend.BorrowerId)
+	return newLendResolvers([]*Lend{lend}, uuid.Nil)[0], nil
+}
+
+type userRefInput struct {
+	UId     *graphql.ID
+	Name    *string
+	Email   *string
+	PhoneNo *string
+}
+
+type expenseInput struct {
+	Type        *string
+	LenderId    graphql.ID
+	Amount      float64
+	Description *string
+	Users       []userRefInput
+	Percents    *[]float64
+	Values      *[]float64
+}
+
+func (q *graphQLResolver) CreateExpense(ctx context.Context, args struct{ Input expenseInput }) (*expenseResolver, error) {
+	input := args.Input
+	lenderId, err := parseGraphQLId("lenderId", input.LenderId)
+	if err != nil {
+		return nil, err
+	}
+	req := &ExpenseRequest{
+		Type:        valueOrEmpty(input.Type),
+		LenderId:    lenderId,
+		Amount:      input.Amount,
+		Description: valueOrEmpty(input.Description),
+		Percents:    valueOrEmpty(input.Percents),
+		Values:      valueOrEmpty(input.Values),
+	}
+	for i, user := range input.Users {
+		uid, err := parseId(fmt.Sprintf("users[%d].uId", i), string(valueOrEmpty(user.UId)))
+		if err != nil {
+			return nil, err
+		}
+		req.Users = append(req.Users, UserRef{UId: uid, Name: valueOrEmpty(user.Name), Email: valueOrEmpty(user.Email), PhoneNo: valueOrEmpty(user.PhoneNo)})
+	}
+	expense, err := call(ctx, q.handler.expenses.AddExpense, req)
+	if err != nil {
+		return nil, err
+	}
+	loadersFromContext(ctx).users.Queue(expense.Participants()...)
+	return &expenseResolver{expense: expense}, nil
+}
+
+type settleAllInput struct {
+	UserId1  graphql.ID
+	UserId2  graphql.ID
+	Currency *string
+	Rate     *float64
+}
+
+func (q *graphQLResolver) SettleAll(ctx context.Context, args struct{ Input settleAllInput }) (*settlementResolver, error) {
+	input := args.Input
+	userId1, err := parseGraphQLId("userId1", input.UserId1)
+	if err != nil {
+		return nil, err
+	}
+	userId2, err := parseGraphQLId("userId2", input.UserId2)
+	if err != nil {
+		return nil, err
+	}
+	req := &SettleAllRequest{UserId1: userId1, UserId2: userId2, Currency: valueOrEmpty(input.Currency), Rate: valueOrEmpty(input.Rate)}
+	settlement, err := call(ctx, q.handler.lenders.SettleAll, req)
+	if err != nil {
+		return nil, err
+	}
+	loadersFromContext(ctx).users.Queue(settlement.PayerId, settlement.PayeeId)
+	return &settlementResolver{settlement: settlement}, nil
+}
+
+// The siblings of the resolvers below are the entities listed along with them.
+// They are queued on the loaders so the fields of a list are loaded with a
+// single query rather than one per item.
+type userResolver struct {
+	user     *User
+	siblings []uuid.UUID
+}
+
+func (r *userResolver) UId() graphql.ID {
+	return graphql.ID(r.user.UId.String())
+}
+
+func (r *userResolver) Name() string {
+	return r.user.Name
+}
+
+func (r *userResolver) Email() *string {
+	if r.user.Email == "" {
+		return nil
+	}
+	return &r.user.Email
+}
+
+func (r *userResolver) PhoneNo() *string {
+	if r.user.PhoneNo == "" {
+		return nil
+	}
+	return &r.user.PhoneNo
+}
+
+func (r *userResolver) CreatedAt() graphql.Time {
+	return graphql.Time{Time: r.user.CreatedAt}
+}
+
+func (r *userResolver) IsPlaceholder() bool {
+	return r.user.IsPlaceholder
+}
+
+func (r *userResolver) Balances(ctx context.Context) ([]*lendResolver, error) {
+	if err := Authorize(ctx, ActionBalanceRead, Resource{Owner: r.user.UId}); err != nil {
+		return nil, err
+	}
+	loader := loadersFromContext(ctx).lends
+	loader.Queue(r.siblings...)
+	lends, err := loader.Load(ctx, r.user.UId)
+	if err != nil {
+		return nil, err
+	}
+	return newLendResolvers(lends, r.user.UId), nil
+}
+
+type lendResolver struct {
+	lend *Lend
+	// User the balance was listed from, nil when queried directly
+	viewer   uuid.UUID
+	siblings []*Lend
+}
+
+func newLendResolvers(lends []*Lend, viewer uuid.UUID) []*lendResolver {
+	resolvers := make([]*lendResolver, len(lends))
+	for i, lend := range lends {
+		resolvers[i] = &lendResolver{lend: lend, viewer: viewer, siblings: lends}
+	}
+	return resolvers
+}
+
+func (r *lendResolver) LId() graphql.ID {
+	return graphql.ID(r.lend.LId.String())
+}
+
+func (r *lendResolver) Amount() float64 {
+	return r.lend.Amount
+}
+
+func (r *lendResolver) UpdatedAt() graphql.Time {
+	return graphql.Time{Time: r.lend.UpdatedAt}
+}
+
+func (r *lendResolver) siblingUsers() []uuid.UUID {
+	userIds := make([]uuid.UUID, 0, 2*len(r.siblings))
+	for _, lend := range r.siblings {
+		userIds = append(userIds, lend.LenderId, lend.BorrowerId)
+	}
+	return userIds
+}
+
+func (r *lendResolver) Lender(ctx context.Context) (*userResolver, error) {
+	return loadUser(ctx, r.lend.LenderId, r.siblingUsers())
+}
+
+func (r *lendResolver) Borrower(ctx context.Context) (*userResolver, error) {
+	return loadUser(ctx, r.lend.BorrowerId, r.siblingUsers())
+}
+
+func (r *lendResolver) Counterpart(ctx context.Context) (*userResolver, error) {
+	switch r.viewer {
+	case r.lend.LenderId:
+		return loadUser(ctx, r.lend.BorrowerId, r.siblingUsers())
+	case r.lend.BorrowerId:
+		return loadUser(ctx, r.lend.LenderId, r.siblingUsers())
+	}
+	return nil, nil
+}
+
+func (r *lendResolver) Expenses(ctx context.Context, args struct{ First int32 }) ([]*expenseResolver, error) {
+	if args.First < 1 || args.First > maxSharedExpenses {
+		return nil, InvalidField("first", "range", fmt.Sprintf("1-%d", maxSharedExpenses), fmt.Sprintf("first should be between 1 and %d", maxSharedExpenses))
+	}
+	if err := Authorize(ctx, ActionBalanceRead, Resource{Participants: []uuid.UUID{r.lend.LenderId, r.lend.BorrowerId}}); err != nil {
+		return nil, err
+	}
+	limit := int(args.First)
+	loader := loadersFromContext(ctx).sharedExpenses
+	for _, lend := range r.siblings {
+		loader.Queue(sharedExpensesKey{lend.LenderId, lend.BorrowerId, limit})
+	}
+	expenses, err := loader.Load(ctx, sharedExpensesKey{r.lend.LenderId, r.lend.BorrowerId, limit})
+	if err != nil {
+		return nil, err
+	}
+	resolvers := make([]*expenseResolver, len(expenses))
+	for i, expense := range expenses {
+		resolvers[i] = &expenseResolver{expense: expense}
+	}
+	return resolvers, nil
+}
+
+type expenseResolver struct {
+	expense *Expense
+}
+
+func (r *expenseResolver) ExId() graphql.ID {
+	return graphql.ID(r.expense.ExId.String())
+}
+
+func (r *expenseResolver) Category() string {
+	return r.expense.Category
+}
+
+func (r *expenseResolver) Amount() float64 {
+	return r.expense.Amount
+}
+
+func (r *expenseResolver) Description() string {
+	return r.expense.Description
+}
+
+func (r *expenseResolver) CreatedAt() graphql.Time {
+	return graphql.Time{Time: r.expense.CreatedAt}
+}
+
+func (r *expenseResolver) Lender(ctx context.Context) (*userResolver, error) {
+	return loadUser(ctx, r.expense.LenderId, nil)
+}
+
+func (r *expenseResolver) Borrowers() []*expenseBorrowerResolver {
+	resolvers := make([]*expenseBorrowerResolver, len(r.expense.ExpenseBorrowers))
+	for i, borrower := range r.expense.ExpenseBorrowers {
+		resolvers[i] = &expenseBorrowerResolver{borrower: borrower}
+	}
+	return resolvers
+}
+
+type expenseBorrowerResolver struct {
+	borrower *ExpenseBorrower
+}
+
+func (r *expenseBorrowerResolver) Borrower(ctx context.Context) (*userResolver, error) {
+	return loadUser(ctx, r.borrower.BorrowerId, nil)
+}
+
+func (r *expenseBorrowerResolver) Amount() float64 {
+	return r.borrower.Amount
+}
+
+func (r *expenseBorrowerResolver) IsPaid() bool {
+	return r.borrower.IsPaid
+}
+
+type settlementResolver struct {
+	settlement *Settlement
+}
+
+func (r *settlementResolver) SId() graphql.ID {
+	return graphql.ID(r.settlement.SId.String())
+}
+
+func (r *settlementResolver) Payer(ctx context.Context) (*userResolver, error) {
+	return loadUser(ctx, r.settlement.PayerId, nil)
+}
+
+func (r *settlementResolver) Payee(ctx context.Context) (*userResolver, error) {
+	return loadUser(ctx, r.settlement.PayeeId, nil)
+}
+
+func (r *settlementResolver) Amount() float64 {
+	return r.settlement.Amount
+}
+
+func (r *settlementResolver) Currency() *string {
+	if r.settlement.Currency == "" {
+		return nil
+	}
+	return &r.settlement.Currency
+}
+
+func (r *settlementResolver) Rate() float64 {
+	return r.settlement.Rate
+}
+
+func (r *settlementResolver) SettledAmount() float64 {
+	return r.settlement.SettledAmount
+}
+
+func (r *settlementResolver) CreatedAt() graphql.Time {
+	return graphql.Time{Time: r.settlement.CreatedAt}
+}
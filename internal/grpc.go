@@ -0,0 +1,631 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"splitwise-api/internal/pb"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//go:generate protoc -I ../proto --go_out=. --go_opt=module=splitwise-api/internal --go-grpc_out=. --go-grpc_opt=module=splitwise-api/internal splitwise/v1/splitwise.proto
+
+// Methods that can be called without authentication, the gRPC counterpart of PublicRoutes
+var PublicMethods = map[string]bool{
+	pb.UserService_CreateUser_FullMethodName: true,
+}
+
+// Methods that write, the gRPC counterpart of isWrite
+var WriteMethods = map[string]bool{
+	pb.UserService_CreateUser_FullMethodName:       true,
+	pb.UserService_UpdateUser_FullMethodName:       true,
+	pb.UserService_DeleteUser_FullMethodName:       true,
+	pb.ExpenseService_CreateExpense_FullMethodName: true,
+	pb.BalanceService_RecordPayment_FullMethodName: true,
+	pb.BalanceService_SettleAll_FullMethodName:     true,
+}
+
+// Metadata of the idempotency keys and of the replayed responses, the gRPC
+// counterparts of IdempotencyKeyHeader and IdempotentReplayedHeader
+const (
+	grpcIdempotencyKey     = "idempotency-key"
+	grpcIdempotentReplayed = "idempotent-replayed"
+	// Content type of the stored responses, followed by the name of their message
+	grpcProtobufContentType = "application/protobuf; proto="
+)
+
+// Domain of the ErrorInfo details of the gRPC errors
+const grpcErrorDomain = "splitwise-api"
+
+// gRPC codes of the HTTP statuses of ErrorStatus
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusConflict:              codes.FailedPrecondition,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	http.StatusUnprocessableEntity:   codes.InvalidArgument,
+	http.StatusTooManyRequests:       codes.ResourceExhausted,
+}
+
+// gRPC server of the users, expenses and balances. The services call the
+// handlers of the REST routes so both transports share the validation, the
+// authorization and the services.
+// @param auth *AuthHandler: Authenticates the calls
+// @param users *UserHandler: Handler of the user service
+// @param expenses *ExpenseHandler: Handler of the expense service
+// @param lenders *LenderHandler: Handler of the balance service
+// @param rateLimiter *RateLimiter: Limits the call rate, shared with the routes
+// @param idempotency *Idempotency: Makes the writes with an idempotency-key idempotent
+// @return *grpc.Server: The server, not serving yet
+func NewGRPCServer(auth *AuthHandler, users *UserHandler, expenses *ExpenseHandler, lenders *LenderHandler, rateLimiter *RateLimiter, idempotency *Idempotency) *grpc.Server {
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		requestIdInterceptor,
+		accessLogInterceptor,
+		recoveryInterceptor,
+		errorInterceptor,
+		ipRateLimitInterceptor(rateLimiter),
+		authInterceptor(auth.service),
+		rateLimitInterceptor(rateLimiter),
+		idempotencyInterceptor(idempotency),
+	))
+	pb.RegisterUserServiceServer(srv, &userServer{handler: users})
+	pb.RegisterExpenseServiceServer(srv, &expenseServer{handler: expenses})
+	pb.RegisterBalanceServiceServer(srv, &balanceServer{handler: lenders})
+	return srv
+}
+
+// gRPC status of an error, the counterpart of NewErrorResp. The error code is
+// sent as the reason of an ErrorInfo detail and the invalid fields as a
+// BadRequest detail.
+func GRPCStatus(err error) *status.Status {
+	statusCode, code, details := ErrorStatus(err)
+	grpcCode, ok := grpcCodes[statusCode]
+	errMsg := err.Error()
+	if !ok {
+		grpcCode, errMsg = codes.Internal, "error: internal server error"
+	}
+	st := status.New(grpcCode, errMsg)
+	info := &errdetails.ErrorInfo{Reason: string(code), Domain: grpcErrorDomain}
+	if fields, ok := details.([]FieldError); ok {
+		badRequest := &errdetails.BadRequest{}
+		for _, field := range fields {
+			badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: field.Field, Description: field.Message})
+		}
+		if withDetails, err := st.WithDetails(info, badRequest); err == nil {
+			return withDetails
+		}
+	} else if withDetails, err := st.WithDetails(info); err == nil {
+		return withDetails
+	}
+	return st
+}
+
+// Tag every call with an id, taken from the x-request-id metadata when the client sends one
+func requestIdInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var requestId string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(RequestIdHeader); len(values) > 0 {
+			requestId = values[0]
+		}
+	}
+	if requestId == "" || len(requestId) > 128 {
+		requestId = GenerateUUIdV6().String()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(RequestIdHeader, requestId))
+	return handler(ContextWithRequestId(ctx, requestId), req)
+}
+
+// Log every call with its method, code and latency
+func accessLogInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	remoteAddr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+	Log.Info("rpc",
+		zap.String("requestId", RequestIdFromContext(ctx)),
+		zap.String("method", info.FullMethod),
+		zap.String("code", status.Code(err).String()),
+		zap.Duration("latency", time.Since(start)),
+		zap.String("remoteAddr", remoteAddr),
+	)
+	return resp, err
+}
+
+// Turn panics of the handlers into an internal error
+func recoveryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		Log.Error(fmt.Sprintf("panic: %v", recovered),
+			zap.String("requestId", RequestIdFromContext(ctx)),
+			zap.ByteString("stack", debug.Stack()),
+		)
+		resp, err = nil, GRPCStatus(fmt.Errorf("panic: %v", recovered)).Err()
+	}()
+	return handler(ctx, req)
+}
+
+// Log the errors of the handlers and map them to their gRPC status
+func errorInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err == nil {
+		return resp, nil
+	}
+	Log.Error(fmt.Sprintf("%s error: %s", info.FullMethod, err.Error()))
+	return nil, GRPCStatus(err).Err()
+}
+
+// Inject the authenticated caller into the context like AuthService.Middleware,
+// the token is read from the authorization metadata
+func authInterceptor(as *AuthService) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var token string
+		found := false
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get("authorization"); len(values) > 0 {
+				token, found = parseBearer(values[0])
+			}
+		}
+		if !found {
+			if PublicMethods[info.FullMethod] {
+				return handler(ctx, req)
+			}
+			return nil, fmt.Errorf("%w: missing bearer token", ErrUnauthorized)
+		}
+		principal, err := as.Authenticate(&ctx, token)
+		if err != nil {
+			if PublicMethods[info.FullMethod] {
+				return handler(ctx, req)
+			}
+			if !errors.Is(err, ErrUnauthorized) {
+				Log.Error(fmt.Sprintf("authentication error: %s", err.Error()))
+				err = fmt.Errorf("%w: authentication failed", ErrUnauthorized)
+			}
+			return nil, err
+		}
+		return handler(ContextWithPrincipal(ctx, principal), req)
+	}
+}
+
+// Address of the peer of a call
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
+
+// Error of a call over its rate limit, with the retry-after metadata
+func rateLimited(ctx context.Context, result *rateLimitResult, caller string, method string) error {
+	Log.Warn(fmt.Sprintf("rate limit exceeded: %s %s", caller, method))
+	grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(max(1, seconds(result.retryAfter)))))
+	return fmt.Errorf("%w: rate limit exceeded, retry later", ErrRateLimited)
+}
+
+// Limit the call rate per peer address like RateLimiter.IPMiddleware, before
+// the authentication
+func ipRateLimitInterceptor(rl *RateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ip := peerIP(ctx)
+		if result := rl.checkIP(ip); result != nil && !result.allowed {
+			return nil, rateLimited(ctx, result, "ip:"+ip, info.FullMethod)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Limit the call rate per caller like RateLimiter.Middleware, after the authentication
+func rateLimitInterceptor(rl *RateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		result, caller := rl.checkCaller(ctx, peerIP(ctx), WriteMethods[info.FullMethod])
+		if result != nil && !result.allowed {
+			return nil, rateLimited(ctx, result, caller, info.FullMethod)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Make the writes sent with an idempotency-key metadata idempotent like
+// Idempotency.Middleware. Responses are stored in their protobuf encoding.
+// Errors are not stored, the writes failed without effect and can be retried.
+func idempotencyInterceptor(id *Idempotency) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var key string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(grpcIdempotencyKey); len(values) > 0 {
+				key = values[0]
+			}
+		}
+		caller := idempotencyCaller(ctx)
+		message, ok := req.(proto.Message)
+		if key == "" || caller == "" || !WriteMethods[info.FullMethod] || !ok {
+			return handler(ctx, req)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return nil, InvalidField(grpcIdempotencyKey, "max", fmt.Sprint(maxIdempotencyKeyLength), fmt.Sprintf("%s must be at most %d characters", grpcIdempotencyKey, maxIdempotencyKeyLength))
+		}
+		requestHash, err := grpcRequestHash(info.FullMethod, message)
+		if err != nil {
+			return nil, err
+		}
+		record := id.newRecord(caller, key, requestHash)
+		existing, err := id.claim(ctx, record)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			resp, err := grpcStoredResponse(existing)
+			if err != nil {
+				return nil, err
+			}
+			grpc.SetHeader(ctx, metadata.Pairs(grpcIdempotentReplayed, "true"))
+			return resp, nil
+		}
+
+		// The record is kept even if the client went away, so its retries are replayed
+		storeCtx := context.WithoutCancel(ctx)
+		completed := false
+		defer func() {
+			if !completed {
+				id.service.Release(&storeCtx, record)
+			}
+		}()
+		resp, err := handler(ctx, req)
+		respMessage, ok := resp.(proto.Message)
+		if err != nil || !ok {
+			return resp, err
+		}
+		record.Status = http.StatusOK
+		record.ContentType = grpcProtobufContentType + string(respMessage.ProtoReflect().Descriptor().FullName())
+		if record.Body, err = proto.Marshal(respMessage); err == nil {
+			completed = id.service.Complete(&storeCtx, record) == nil
+		}
+		return resp, nil
+	}
+}
+
+// Hash of the method and request of a call, the counterpart of idempotencyHash
+func grpcRequestHash(method string, req proto.Message) (string, error) {
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", method)
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Response of a completed record, decoded as the message named by its content type
+func grpcStoredResponse(record *IdempotencyRecord) (proto.Message, error) {
+	name, found := strings.CutPrefix(record.ContentType, grpcProtobufContentType)
+	if !found {
+		return nil, fmt.Errorf("%w: %s was used with a different request", ErrIdempotencyKeyReused, grpcIdempotencyKey)
+	}
+	messageType, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, err
+	}
+	resp := messageType.New().Interface()
+	if err := proto.Unmarshal(record.Body, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func parseTimestamp(field string, ts *timestamppb.Timestamp) (*time.Time, error) {
+	if ts == nil {
+		return nil, nil
+	}
+	if err := ts.CheckValid(); err != nil {
+		return nil, InvalidField(field, "type", "timestamp", fmt.Sprintf("%s should be a valid timestamp", field))
+	}
+	t := ts.AsTime()
+	return &t, nil
+}
+
+func optionalId(id *uuid.UUID) string {
+	if id == nil {
+		return ""
+	}
+	return id.String()
+}
+
+func optionalTimestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func userToProto(user *User) *pb.User {
+	return &pb.User{
+		Uid:           user.UId.String(),
+		Name:          user.Name,
+		Email:         user.Email,
+		PhoneNo:       user.PhoneNo,
+		CreatedAt:     timestamppb.New(user.CreatedAt),
+		IsPlaceholder: user.IsPlaceholder,
+		MergedInto:    optionalId(user.MergedInto),
+		DeletedAt:     optionalTimestamp(user.DeletedAt),
+		ErasedAt:      optionalTimestamp(user.ErasedAt),
+		IsAdmin:       user.IsAdmin,
+	}
+}
+
+func expenseToProto(expense *Expense) *pb.Expense {
+	borrowers := make([]*pb.ExpenseBorrower, len(expense.ExpenseBorrowers))
+	for i, borrower := range expense.ExpenseBorrowers {
+		borrowers[i] = &pb.ExpenseBorrower{BorrowerId: borrower.BorrowerId.String(), Amount: borrower.Amount, IsPaid: borrower.IsPaid}
+	}
+	return &pb.Expense{
+		ExId:        expense.ExId.String(),
+		Category:    expense.Category,
+		Amount:      expense.Amount,
+		Description: expense.Description,
+		CreatedAt:   timestamppb.New(expense.CreatedAt),
+		LenderId:    expense.LenderId.String(),
+		Borrowers:   borrowers,
+	}
+}
+
+func lendToProto(lend *Lend) *pb.Balance {
+	return &pb.Balance{
+		LId:        lend.LId.String(),
+		LenderId:   lend.LenderId.String(),
+		BorrowerId: lend.BorrowerId.String(),
+		Amount:     lend.Amount,
+		UpdatedAt:  timestamppb.New(lend.UpdatedAt),
+	}
+}
+
+type userServer struct {
+	pb.UnimplementedUserServiceServer
+	handler *UserHandler
+}
+
+func (s *userServer) CreateUser(ctx context.Context, in *pb.CreateUserRequest) (*pb.User, error) {
+	user, err := call(ctx, s.handler.CreateUser, &CreateUserRequest{Name: in.Name, Email: in.Email, PhoneNo: in.PhoneNo, Password: in.Password})
+	if err != nil {
+		return nil, err
+	}
+	return userToProto(user), nil
+}
+
+func (s *userServer) GetUser(ctx context.Context, in *pb.GetUserRequest) (*pb.User, error) {
+	uid, err := parseId("uid", in.Uid)
+	if err != nil {
+		return nil, err
+	}
+	user, err := call(ctx, s.handler.GetUser, &UserPath{UId: uid})
+	if err != nil {
+		return nil, err
+	}
+	return userToProto(user), nil
+}
+
+func (s *userServer) ListUsers(ctx context.Context, in *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	filter := &UserFilter{Name: in.Name, Email: in.Email, PhoneNo: in.PhoneNo, Page: int(in.Page), PageSize: int(in.PageSize)}
+	if in.SharedWith != "" {
+		sharedWith, err := parseId("sharedWith", in.SharedWith)
+		if err != nil {
+			return nil, err
+		}
+		filter.SharedWith = &sharedWith
+	}
+	// Same defaults as the query parameters
+	if filter.Page == 0 {
+		filter.Page = 1
+	}
+	if filter.PageSize == 0 {
+		filter.PageSize = 20
+	}
+	page, err := call(ctx, s.handler.ListUsers, filter)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.ListUsersResponse{Page: int32(page.Page), PageSize: int32(page.PageSize), Total: page.Total}
+	for i := range page.Items {
+		resp.Items = append(resp.Items, userToProto(&page.Items[i]))
+	}
+	return resp, nil
+}
+
+func (s *userServer) UpdateUser(ctx context.Context, in *pb.UpdateUserRequest) (*pb.User, error) {
+	uid, err := parseId("uid", in.Uid)
+	if err != nil {
+		return nil, err
+	}
+	user, err := call(ctx, s.handler.UpdateUser, &UpdateUserRequest{UserPath: UserPath{UId: uid}, Name: in.Name, Email: in.Email, PhoneNo: in.PhoneNo})
+	if err != nil {
+		return nil, err
+	}
+	return userToProto(user), nil
+}
+
+func (s *userServer) DeleteUser(ctx context.Context, in *pb.DeleteUserRequest) (*emptypb.Empty, error) {
+	uid, err := parseId("uid", in.Uid)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := call(ctx, s.handler.DeleteUser, &UserPath{UId: uid}); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+type expenseServer struct {
+	pb.UnimplementedExpenseServiceServer
+	handler *ExpenseHandler
+}
+
+func (s *expenseServer) CreateExpense(ctx context.Context, in *pb.CreateExpenseRequest) (*pb.Expense, error) {
+	lenderId, err := parseId("lenderId", in.LenderId)
+	if err != nil {
+		return nil, err
+	}
+	req := &ExpenseRequest{
+		Type:        in.Type,
+		LenderId:    lenderId,
+		Amount:      in.Amount,
+		Description: in.Description,
+		Percents:    in.Percents,
+		Values:      in.Values,
+	}
+	for i, user := range in.Users {
+		uid, err := parseId(fmt.Sprintf("users[%d].uId", i), user.Uid)
+		if err != nil {
+			return nil, err
+		}
+		req.Users = append(req.Users, UserRef{UId: uid, Name: user.Name, Email: user.Email, PhoneNo: user.PhoneNo})
+	}
+	expense, err := call(ctx, s.handler.AddExpense, req)
+	if err != nil {
+		return nil, err
+	}
+	return expenseToProto(expense), nil
+}
+
+func (s *expenseServer) GetExpense(ctx context.Context, in *pb.GetExpenseRequest) (*pb.Expense, error) {
+	exId, err := parseId("exId", in.ExId)
+	if err != nil {
+		return nil, err
+	}
+	expense, err := call(ctx, s.handler.GetExpense, &ExpensePath{ExId: exId})
+	if err != nil {
+		return nil, err
+	}
+	return expenseToProto(expense), nil
+}
+
+type balanceServer struct {
+	pb.UnimplementedBalanceServiceServer
+	handler *LenderHandler
+}
+
+func (s *balanceServer) GetBalance(ctx context.Context, in *pb.GetBalanceRequest) (*pb.Balance, error) {
+	ids, err := parseIds("userId1", in.UserId1, "userId2", in.UserId2)
+	if err != nil {
+		return nil, err
+	}
+	asOf, err := parseTimestamp("asOf", in.AsOf)
+	if err != nil {
+		return nil, err
+	}
+	lend, err := call(ctx, s.handler.GetBalance, &BalanceRequest{UserId1: ids[0], UserId2: ids[1], AsOf: asOf})
+	if err != nil {
+		return nil, err
+	}
+	return lendToProto(lend), nil
+}
+
+func (s *balanceServer) GetBalanceHistory(ctx context.Context, in *pb.GetBalanceHistoryRequest) (*pb.BalanceHistory, error) {
+	ids, err := parseIds("userId1", in.UserId1, "userId2", in.UserId2)
+	if err != nil {
+		return nil, err
+	}
+	from, err := parseTimestamp("from", in.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseTimestamp("to", in.To)
+	if err != nil {
+		return nil, err
+	}
+	history, err := call(ctx, s.handler.GetHistory, &HistoryRequest{UserId1: ids[0], UserId2: ids[1], From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.BalanceHistory{LId: history.LId.String(), LenderId: history.LenderId.String(), BorrowerId: history.BorrowerId.String()}
+	for _, point := range history.Points {
+		resp.Points = append(resp.Points, &pb.BalancePoint{
+			Timestamp: timestamppb.New(point.Timestamp),
+			Delta:     point.Delta,
+			Balance:   point.Balance,
+			Source:    point.Source,
+			SourceId:  optionalId(point.SourceId),
+		})
+	}
+	return resp, nil
+}
+
+func (s *balanceServer) ListBalances(ctx context.Context, in *pb.ListBalancesRequest) (*pb.ListBalancesResponse, error) {
+	userId, err := parseId("userId", in.UserId)
+	if err != nil {
+		return nil, err
+	}
+	lends, err := call(ctx, s.handler.GetLendSummary, &LendSummaryPath{UserId: userId})
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.ListBalancesResponse{}
+	for _, lend := range lends {
+		resp.Balances = append(resp.Balances, lendToProto(lend))
+	}
+	return resp, nil
+}
+
+func (s *balanceServer) RecordPayment(ctx context.Context, in *pb.RecordPaymentRequest) (*emptypb.Empty, error) {
+	ids, err := parseIds("lenderId", in.LenderId, "borrowerId", in.BorrowerId)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := call(ctx, s.handler.UpdatePayment, &PaymentRequest{LenderId: ids[0], BorrowerId: ids[1], Amount: in.Amount}); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *balanceServer) SettleAll(ctx context.Context, in *pb.SettleAllRequest) (*pb.Settlement, error) {
+	ids, err := parseIds("userId1", in.UserId1, "userId2", in.UserId2)
+	if err != nil {
+		return nil, err
+	}
+	settlement, err := call(ctx, s.handler.SettleAll, &SettleAllRequest{UserId1: ids[0], UserId2: ids[1], Currency: in.Currency, Rate: in.Rate})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Settlement{
+		SId:           settlement.SId.String(),
+		LId:           settlement.LId.String(),
+		PayerId:       settlement.PayerId.String(),
+		PayeeId:       settlement.PayeeId.String(),
+		Amount:        settlement.Amount,
+		Currency:      settlement.Currency,
+		Rate:          settlement.Rate,
+		SettledAmount: settlement.SettledAmount,
+		CreatedAt:     timestamppb.New(settlement.CreatedAt),
+	}, nil
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"splitwise-api/internal/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRateLimitInterceptorLimitsWrites(t *testing.T) {
+	rl := &RateLimiter{buckets: map[string]*tokenBucket{}, write: RateLimit{Requests: 1, Window: time.Minute}}
+	interceptor := rateLimitInterceptor(rl)
+	ctx := peer.NewContext(userContext(NewUser("Ann", "ann@example.com", "")), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 1234}})
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return &pb.Settlement{}, nil }
+	call := func(method string) error {
+		_, err := interceptor(ctx, &pb.SettleAllRequest{}, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+
+	if err := call(pb.BalanceService_SettleAll_FullMethodName); err != nil {
+		t.Fatalf("first write error = %v", err)
+	}
+	if err := call(pb.BalanceService_RecordPayment_FullMethodName); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("second write error = %v, want %v", err, ErrRateLimited)
+	}
+	if err := call(pb.BalanceService_GetBalance_FullMethodName); err != nil {
+		t.Errorf("read error = %v, reads do not take from the write budget", err)
+	}
+}
+
+func TestIdempotencyInterceptorStoresResponse(t *testing.T) {
+	fake, idempotency := newTestIdempotency(t)
+	ctx := metadata.NewIncomingContext(userContext(NewUser("Ann", "ann@example.com", "")), metadata.Pairs(grpcIdempotencyKey, "key-1"))
+	info := &grpc.UnaryServerInfo{FullMethod: pb.BalanceService_SettleAll_FullMethodName}
+	calls := 0
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls++
+		return &pb.Settlement{SId: "s-1", Amount: 12.5}, nil
+	}
+
+	if _, err := idempotencyInterceptor(idempotency)(ctx, &pb.SettleAllRequest{UserId1: "a", UserId2: "b"}, info, handler); err != nil {
+		t.Fatalf("call error = %v", err)
+	}
+	if calls != 1 || len(fake.Find(`UPDATE "idempotency_records"`)) != 1 {
+		t.Errorf("calls = %d, stored responses = %d, want the response stored", calls, len(fake.Find(`UPDATE "idempotency_records"`)))
+	}
+	// Calls without a key are not stored
+	if _, err := idempotencyInterceptor(idempotency)(userContext(NewUser("Ann", "", "")), &pb.SettleAllRequest{}, info, handler); err != nil {
+		t.Fatalf("call error = %v", err)
+	}
+	if len(fake.Find(`INSERT INTO "idempotency_records"`)) != 1 {
+		t.Error("call without an idempotency key claimed a key")
+	}
+}
+
+func TestIdempotencyInterceptorReplaysResponse(t *testing.T) {
+	fake, idempotency := newTestIdempotency(t)
+	principalCtx := userContext(NewUser("Ann", "ann@example.com", ""))
+	ctx := metadata.NewIncomingContext(principalCtx, metadata.Pairs(grpcIdempotencyKey, "key-1"))
+	req := &pb.SettleAllRequest{UserId1: "a", UserId2: "b"}
+	stored := &pb.Settlement{SId: "s-1", Amount: 12.5}
+
+	requestHash, err := grpcRequestHash(pb.BalanceService_SettleAll_FullMethodName, req)
+	if err != nil {
+		t.Fatalf("request hash: %v", err)
+	}
+	body, _ := proto.Marshal(stored)
+	keyring, _ := PIIKeyring()
+	encrypted, err := keyring.Encrypt(idempotencyBodyColumn, string(body))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	now := time.Now().UTC()
+	fake.AddRows(t, &IdempotencyRecord{
+		Caller:      idempotencyCaller(principalCtx),
+		Key:         "key-1",
+		RequestHash: requestHash,
+		Status:      http.StatusOK,
+		ContentType: grpcProtobufContentType + string(stored.ProtoReflect().Descriptor().FullName()),
+		Body:        []byte(encrypted),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(time.Hour),
+	})
+	fake.skipUpserts = true
+
+	calls := 0
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls++
+		return &pb.Settlement{SId: "s-2"}, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: pb.BalanceService_SettleAll_FullMethodName}
+	resp, err := idempotencyInterceptor(idempotency)(ctx, req, info, handler)
+	if err != nil {
+		t.Fatalf("replay error = %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("handler called %d times, want the response replayed", calls)
+	}
+	if settlement, ok := resp.(*pb.Settlement); !ok || !proto.Equal(settlement, stored) {
+		t.Errorf("replayed response = %v, want %v", resp, stored)
+	}
+
+	// The key cannot be reused with another request
+	_, err = idempotencyInterceptor(idempotency)(ctx, &pb.SettleAllRequest{UserId1: "a", UserId2: "c"}, info, handler)
+	if !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Errorf("reused key error = %v, want %v", err, ErrIdempotencyKeyReused)
+	}
+}
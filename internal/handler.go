@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Request of the endpoints without parameters or body
+type Empty struct{}
+
+// JSON endpoint of a typed handler, see Handle
+type Endpoint struct {
+	Operation string
+	Request   reflect.Type
+	Response  reflect.Type
+	Status    int
+	message   *string
+	header    http.Header
+	handle    func(ctx context.Context, r *http.Request) (interface{}, error)
+}
+
+type EndpointOption func(*Endpoint)
+
+// Status of the successful responses, 200 by default
+func WithStatus(status int) EndpointOption {
+	return func(e *Endpoint) {
+		e.Status = status
+	}
+}
+
+// Message of the successful responses
+func WithMessage(message string) EndpointOption {
+	return func(e *Endpoint) {
+		e.message = &message
+	}
+}
+
+// Header set on the successful responses
+func WithHeader(key string, value string) EndpointOption {
+	return func(e *Endpoint) {
+		e.header.Set(key, value)
+	}
+}
+
+// Endpoint of a handler taking a typed request and returning the data of the
+// response envelope. The request is bound and validated by Bind, errors are
+// mapped to their status by ErrorStatus.
+// @param operation string: Name of the operation in the logs
+// @param fn func(context.Context, *Req) (Resp, error): The handler
+// @param opts ...EndpointOption: Status, message and headers of the successful responses
+// @return *Endpoint: The endpoint
+func Handle[Req any, Resp any](operation string, fn func(ctx context.Context, req *Req) (Resp, error), opts ...EndpointOption) *Endpoint {
+	endpoint := &Endpoint{
+		Operation: operation,
+		Request:   reflect.TypeOf((*Req)(nil)).Elem(),
+		Response:  reflect.TypeOf((*Resp)(nil)).Elem(),
+		Status:    http.StatusOK,
+		header:    http.Header{},
+	}
+	endpoint.handle = func(ctx context.Context, r *http.Request) (interface{}, error) {
+		req := new(Req)
+		if err := Bind(r, req); err != nil {
+			return nil, err
+		}
+		return fn(ctx, req)
+	}
+	for _, opt := range opts {
+		opt(endpoint)
+	}
+	return endpoint
+}
+
+func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, err := e.handle(r.Context(), r)
+	if err != nil {
+		WriteError(w, e.Operation, err)
+		return
+	}
+	for key, values := range e.header {
+		w.Header()[key] = values
+	}
+	WriteJSON(w, e.Status, SuccessResp(&e.Status, e.message, data))
+}
+
+// Write a response envelope
+func WriteJSON(w http.ResponseWriter, statusCode int, resp *Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		Log.Error(fmt.Sprintf("encode response error: %s", err.Error()))
+	}
+}
+
+// Bind a request from the JSON body and the path and query parameters, then
+// validate it. The body is decoded strictly: unknown fields and trailing data
+// are rejected. Fields tagged path or query are set from the parameter of that
+// name, missing query parameters take the value of the default tag. Requests
+// with a Validate method are validated by it, by their validate tags otherwise.
+// @param r *http.Request: The request
+// @param req interface{}: Pointer to the request struct
+// @return error: The validation error if any
+func Bind(r *http.Request, req interface{}) error {
+	if err := decodeBody(r, req); err != nil {
+		return err
+	}
+	if err := bindParams(reflect.ValueOf(req).Elem(), mux.Vars(r), r.URL.Query()); err != nil {
+		return err
+	}
+	return ValidateRequest(req)
+}
+
+// Validate a request by its Validate method, by its validate tags otherwise
+func ValidateRequest(req interface{}) error {
+	if v, ok := req.(interface{ Validate() error }); ok {
+		return NewValidationError(v.Validate())
+	}
+	return NewValidationError(validator.New().Struct(req))
+}
+
+// Validate a request like Bind, then call the handler. Used by the transports
+// that do not go through Bind.
+func call[Req any, Resp any](ctx context.Context, fn func(context.Context, *Req) (Resp, error), req *Req) (Resp, error) {
+	if err := ValidateRequest(req); err != nil {
+		var zero Resp
+		return zero, err
+	}
+	return fn(ctx, req)
+}
+
+// Parse an id of a request, empty ids are left to the validation
+func parseId(field string, value string) (uuid.UUID, error) {
+	if value == "" {
+		return uuid.Nil, nil
+	}
+	id, err := uuid.Parse(value)
+	if err != nil {
+		return uuid.Nil, InvalidField(field, "type", "uuid", fmt.Sprintf("%s should be a valid uuid", field))
+	}
+	return id, nil
+}
+
+// Parse the ids of a request, in the order of the fields
+func parseIds(fields ...string) ([]uuid.UUID, error) {
+	ids := make([]uuid.UUID, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		id, err := parseId(fields[i], fields[i+1])
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func decodeBody(r *http.Request, req interface{}) error {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(req); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return NewValidationError(fmt.Errorf("invalid JSON body: %w", err))
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return Invalidf("request body should contain a single JSON value")
+	}
+	return nil
+}
+
+// Set the fields tagged path or query, embedded structs included
+func bindParams(v reflect.Value, vars map[string]string, query url.Values) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if err := bindParams(v.Field(i), vars, query); err != nil {
+				return err
+			}
+			continue
+		}
+		var name, value string
+		if name = field.Tag.Get("path"); name != "" {
+			value = vars[name]
+		} else if name = field.Tag.Get("query"); name != "" {
+			value = query.Get(name)
+			if value == "" {
+				value = field.Tag.Get("default")
+			}
+		}
+		if value == "" {
+			continue
+		}
+		if err := setParam(v.Field(i), name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setParam(v reflect.Value, name string, value string) error {
+	invalid := func(kind string) error {
+		return InvalidField(name, "type", kind, fmt.Sprintf("%s should be a valid %s", name, kind))
+	}
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(value)
+	case int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return invalid("integer")
+		}
+		v.SetInt(int64(parsed))
+	case float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return invalid("number")
+		}
+		v.SetFloat(parsed)
+	case bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return invalid("boolean")
+		}
+		v.SetBool(parsed)
+	case uuid.UUID:
+		parsed, err := uuid.Parse(value)
+		if err != nil {
+			return invalid("uuid")
+		}
+		v.Set(reflect.ValueOf(parsed))
+	case *uuid.UUID:
+		parsed, err := ParseUUIDString(value)
+		if err != nil {
+			return invalid("uuid")
+		}
+		v.Set(reflect.ValueOf(parsed))
+	case *time.Time:
+		parsed, err := ParseTimeString(value)
+		if err != nil {
+			return invalid("RFC3339 time or YYYY-MM-DD date")
+		}
+		v.Set(reflect.ValueOf(parsed))
+	default:
+		return fmt.Errorf("cannot bind parameter %s of type %s", name, v.Type())
+	}
+	return nil
+}
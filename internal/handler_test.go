@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type bindTestPath struct {
+	Id uuid.UUID `path:"id" validate:"required"`
+}
+
+type bindTestRequest struct {
+	bindTestPath
+	Limit  int        `query:"limit" default:"20" validate:"min=1,max=100"`
+	Paid   bool       `query:"paid"`
+	Since  *time.Time `query:"since"`
+	Name   string     `json:"name" validate:"required"`
+	Amount float64    `json:"amount"`
+}
+
+type bindTestValidated struct {
+	Name string `json:"name" validate:"required"`
+}
+
+func (r *bindTestValidated) Validate() error {
+	if r.Name == "nobody" {
+		return InvalidField("name", "ne", "nobody", "name should not be nobody")
+	}
+	return nil
+}
+
+func bindTestHttpRequest(target string, body string, id string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	if body == "" {
+		r = httptest.NewRequest(http.MethodPost, target, nil)
+	}
+	return mux.SetURLVars(r, map[string]string{"id": id})
+}
+
+func TestBind(t *testing.T) {
+	id := uuid.New()
+	r := bindTestHttpRequest("/items/"+id.String()+"?paid=true&since=2024-05-01", `{"name":"lunch","amount":12.5}`, id.String())
+	var req bindTestRequest
+	if err := Bind(r, &req); err != nil {
+		t.Fatalf("bind error = %v", err)
+	}
+	if req.Id != id || req.Name != "lunch" || req.Amount != 12.5 || !req.Paid {
+		t.Errorf("request = %+v", req)
+	}
+	if req.Limit != 20 {
+		t.Errorf("limit = %d, want the default 20", req.Limit)
+	}
+	if req.Since == nil || !req.Since.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("since = %v, want 2024-05-01", req.Since)
+	}
+}
+
+func TestBindErrors(t *testing.T) {
+	id := uuid.New().String()
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		id     string
+		status int
+		field  string
+	}{
+		{"unknown field", "/items", `{"name":"lunch","tip":1}`, id, http.StatusBadRequest, ""},
+		{"trailing data", "/items", `{"name":"lunch"} {"name":"dinner"}`, id, http.StatusBadRequest, ""},
+		{"trailing garbage", "/items", `{"name":"lunch"}]`, id, http.StatusBadRequest, ""},
+		{"malformed body", "/items", `{"name":`, id, http.StatusBadRequest, ""},
+		{"wrong body type", "/items", `{"name":"lunch","amount":"12"}`, id, http.StatusBadRequest, ""},
+		{"bad path uuid", "/items", `{"name":"lunch"}`, "42", http.StatusBadRequest, "id"},
+		{"bad query integer", "/items?limit=ten", `{"name":"lunch"}`, id, http.StatusBadRequest, "limit"},
+		{"bad query boolean", "/items?paid=maybe", `{"name":"lunch"}`, id, http.StatusBadRequest, "paid"},
+		{"bad query time", "/items?since=yesterday", `{"name":"lunch"}`, id, http.StatusBadRequest, "since"},
+		{"query out of range", "/items?limit=500", `{"name":"lunch"}`, id, http.StatusBadRequest, "limit"},
+		{"missing required field", "/items", "", id, http.StatusBadRequest, "name"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var req bindTestRequest
+			err := Bind(bindTestHttpRequest(test.target, test.body, test.id), &req)
+			status, code, details := ErrorStatus(err)
+			if status != test.status || code != CodeValidation {
+				t.Fatalf("bind error = %v, status %d %s, want %d", err, status, code, test.status)
+			}
+			if test.field == "" {
+				return
+			}
+			fields, _ := details.([]FieldError)
+			if len(fields) != 1 || fields[0].Field != test.field {
+				t.Errorf("failed fields = %+v, want %s", fields, test.field)
+			}
+		})
+	}
+}
+
+func TestBindBodyTooLarge(t *testing.T) {
+	r := bindTestHttpRequest("/items", `{"name":"`+strings.Repeat("a", 100)+`"}`, uuid.New().String())
+	r.Body = http.MaxBytesReader(httptest.NewRecorder(), r.Body, 16)
+	var req bindTestRequest
+	if status, code, _ := ErrorStatus(Bind(r, &req)); status != http.StatusRequestEntityTooLarge || code != CodePayloadTooLarge {
+		t.Errorf("status = %d %s, want %d", status, code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestBindValidateMethod(t *testing.T) {
+	var req bindTestValidated
+	err := Bind(bindTestHttpRequest("/items", `{"name":"nobody"}`, ""), &req)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Fields) != 1 || validationErr.Fields[0].Rule != "ne" {
+		t.Errorf("bind error = %v, want the error of the Validate method", err)
+	}
+	// The validate tags are left to the Validate method
+	if err := Bind(bindTestHttpRequest("/items", "", ""), &bindTestValidated{}); err != nil {
+		t.Errorf("bind error = %v, want none", err)
+	}
+}
+
+func TestSetParamUnsupportedType(t *testing.T) {
+	var req struct {
+		Ids []string `query:"ids"`
+	}
+	r := httptest.NewRequest(http.MethodGet, "/items?ids=a", nil)
+	if status, _, _ := ErrorStatus(Bind(r, &req)); status != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d for a request that cannot be bound", status, http.StatusInternalServerError)
+	}
+}
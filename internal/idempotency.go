@@ -0,0 +1,339 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// Header set on the responses replayed from a previous request
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	idempotencyTable        = "idempotency_records"
+	idempotencyBodyColumn   = idempotencyTable + ".body"
+	maxIdempotencyKeyLength = 255
+	// Time after which a request still in progress is considered abandoned, it
+	// outlives the write timeout of the server
+	idempotencyLease = 2 * time.Minute
+	// Interval at which a duplicate checks whether the first request finished
+	idempotencyPollInterval = 100 * time.Millisecond
+)
+
+type IdempotencyService struct {
+	dao IDao[IdempotencyRecord]
+
+	mu        sync.Mutex
+	lastPurge time.Time
+}
+
+func IdempotencyServiceInit() (*IdempotencyService, error) {
+	Log.Info("idempotency service init...")
+	dao, err := DaoInit[IdempotencyRecord](nil)
+	if err != nil {
+		Log.Error(fmt.Sprintf("idempotency service init error: %s", err.Error()))
+		return nil, err
+	}
+	return &IdempotencyService{dao: dao}, nil
+}
+
+// Claim the key of a record for its request. Expired records and requests in
+// progress past their lease are taken over.
+// @param ctx *context.Context: Context
+// @param record *IdempotencyRecord: The record of the request, in progress
+// @return *IdempotencyRecord: The record holding the key with its decrypted response, nil when it was claimed
+// @return error: The error if any
+func (is *IdempotencyService) Claim(ctx *context.Context, record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	is.purge(ctx, record.CreatedAt)
+	db := is.dao.Client(ctx).DbClient(ctx)
+	resp := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "caller"}, {Name: "idempotency_key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"request_hash", "status", "content_type", "cache_control", "body", "created_at", "expires_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{clause.Expr{
+			SQL:  idempotencyTable + ".expires_at < ? OR (" + idempotencyTable + ".status = 0 AND " + idempotencyTable + ".created_at < ?)",
+			Vars: []interface{}{record.CreatedAt, record.CreatedAt.Add(-idempotencyLease)},
+		}}},
+	}).Create(record)
+	if resp.Error != nil {
+		Log.Error(fmt.Sprintf("claim idempotency key error: %s", resp.Error.Error()))
+		return nil, resp.Error
+	}
+	if resp.RowsAffected > 0 {
+		return nil, nil
+	}
+	var existing IdempotencyRecord
+	if resp := db.Where("caller = ? AND idempotency_key = ?", record.Caller, record.Key).Take(&existing); resp.Error != nil {
+		Log.Error(fmt.Sprintf("read idempotency key error: %s", resp.Error.Error()))
+		return nil, resp.Error
+	}
+	keyring, err := PIIKeyring()
+	if err != nil {
+		return nil, err
+	}
+	body, err := keyring.Decrypt(idempotencyBodyColumn, string(existing.Body))
+	if err != nil {
+		Log.Error(fmt.Sprintf("read idempotency key error: %s", err.Error()))
+		return nil, err
+	}
+	existing.Body = []byte(body)
+	return &existing, nil
+}
+
+// Store the response of a claimed record, its body is encrypted
+// @param ctx *context.Context: Context
+// @param record *IdempotencyRecord: The record with its response
+// @return error: The error if any
+func (is *IdempotencyService) Complete(ctx *context.Context, record *IdempotencyRecord) error {
+	keyring, err := PIIKeyring()
+	if err != nil {
+		return err
+	}
+	body, err := keyring.Encrypt(idempotencyBodyColumn, string(record.Body))
+	if err != nil {
+		Log.Error(fmt.Sprintf("complete idempotency key error: %s", err.Error()))
+		return err
+	}
+	resp := is.claimed(ctx, record).Updates(map[string]interface{}{
+		"status":        record.Status,
+		"content_type":  record.ContentType,
+		"cache_control": record.CacheControl,
+		"body":          []byte(body),
+	})
+	if resp.Error != nil {
+		Log.Error(fmt.Sprintf("complete idempotency key error: %s", resp.Error.Error()))
+	}
+	return resp.Error
+}
+
+// Release a claimed record whose request failed, so it can be retried
+// @param ctx *context.Context: Context
+// @param record *IdempotencyRecord: The record in progress
+// @return error: The error if any
+func (is *IdempotencyService) Release(ctx *context.Context, record *IdempotencyRecord) error {
+	resp := is.claimed(ctx, record).Delete(&IdempotencyRecord{})
+	if resp.Error != nil {
+		Log.Error(fmt.Sprintf("release idempotency key error: %s", resp.Error.Error()))
+	}
+	return resp.Error
+}
+
+// Query of a record still in progress, it is left alone once taken over
+func (is *IdempotencyService) claimed(ctx *context.Context, record *IdempotencyRecord) *gorm.DB {
+	return is.dao.Client(ctx).DbClient(ctx).Model(&IdempotencyRecord{}).
+		Where("caller = ? AND idempotency_key = ? AND request_hash = ? AND created_at = ? AND status = 0", record.Caller, record.Key, record.RequestHash, record.CreatedAt)
+}
+
+// Delete the expired records, at most once a minute
+func (is *IdempotencyService) purge(ctx *context.Context, now time.Time) {
+	is.mu.Lock()
+	if now.Sub(is.lastPurge) < time.Minute {
+		is.mu.Unlock()
+		return
+	}
+	is.lastPurge = now
+	is.mu.Unlock()
+	resp := is.dao.Client(ctx).DbClient(ctx).Where("expires_at < ?", now).Delete(&IdempotencyRecord{})
+	if resp.Error != nil {
+		Log.Error(fmt.Sprintf("purge idempotency keys error: %s", resp.Error.Error()))
+	}
+}
+
+// Idempotency of the writes sent with an Idempotency-Key header. The first
+// response of a key is stored and replayed to the retries of the caller, a
+// duplicate of a request in progress waits for it and gets a 409 past the
+// wait. The key cannot be reused with a different request. Responses are
+// stored encrypted, they hold API keys and contact details, and replayed with
+// their Cache-Control.
+type Idempotency struct {
+	service *IdempotencyService
+	ttl     time.Duration
+	wait    time.Duration
+}
+
+// Idempotency configured by the environment, with the defaults in brackets:
+// IDEMPOTENCY_TTL (24h) for how long responses are replayed and
+// IDEMPOTENCY_WAIT (5s) for how long duplicates wait for the first request
+func IdempotencyFromEnv() (*Idempotency, error) {
+	ttl, err := durationEnv("IDEMPOTENCY_TTL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	wait, err := durationEnv("IDEMPOTENCY_WAIT", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	service, err := IdempotencyServiceInit()
+	if err != nil {
+		return nil, err
+	}
+	return &Idempotency{service: service, ttl: ttl, wait: wait}, nil
+}
+
+// Caller owning the keys of a request, empty for anonymous callers whose
+// responses could be replayed to others
+func idempotencyCaller(ctx context.Context) string {
+	principal := PrincipalFromContext(ctx)
+	switch {
+	case principal != nil && principal.User != nil:
+		return "user:" + principal.User.UId.String()
+	case principal != nil && principal.ApiKey != nil:
+		return "key:" + principal.ApiKey.KId.String()
+	}
+	return ""
+}
+
+// Hash of the method, route and body of a request. The versioned and legacy
+// routes of an operation share their hash.
+func idempotencyHash(r *http.Request, body []byte) string {
+	_, path := SplitVersion(r.URL.Path)
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s?%s\n", r.Method, path, r.URL.RawQuery)
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Response writer keeping a copy of the response
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (ir *idempotencyRecorder) WriteHeader(status int) {
+	if ir.status == 0 {
+		ir.status = status
+	}
+	ir.ResponseWriter.WriteHeader(status)
+}
+
+func (ir *idempotencyRecorder) Write(b []byte) (int, error) {
+	if ir.status == 0 {
+		ir.status = http.StatusOK
+	}
+	ir.body.Write(b)
+	return ir.ResponseWriter.Write(b)
+}
+
+// Returned to a duplicate of a request still in progress past the wait
+var errIdempotencyInProgress = fmt.Errorf("%w: a request with this %s is in progress", ErrConflict, IdempotencyKeyHeader)
+
+// Record of a request, in progress
+func (id *Idempotency) newRecord(caller string, key string, requestHash string) *IdempotencyRecord {
+	// Timestamps are compared with their stored value, rounded by postgres
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	return &IdempotencyRecord{Caller: caller, Key: key, RequestHash: requestHash, CreatedAt: now, ExpiresAt: now.Add(id.ttl)}
+}
+
+// Claim the key of a record, waiting for a duplicate in progress to finish
+// @param ctx context.Context: Context of the request
+// @param record *IdempotencyRecord: The record of the request, in progress
+// @return *IdempotencyRecord: The completed record to replay, nil when the key was claimed
+// @return error: ErrIdempotencyKeyReused for a different request, ErrConflict past the wait
+func (id *Idempotency) claim(ctx context.Context, record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	deadline := record.CreatedAt.Add(id.wait)
+	for {
+		existing, err := id.service.Claim(&ctx, record)
+		if err != nil || existing == nil {
+			return nil, err
+		}
+		if existing.RequestHash != record.RequestHash {
+			return nil, fmt.Errorf("%w: %s was used with a different request", ErrIdempotencyKeyReused, IdempotencyKeyHeader)
+		}
+		if existing.Status != 0 {
+			return existing, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, errIdempotencyInProgress
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(idempotencyPollInterval):
+		}
+		record.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+		record.ExpiresAt = record.CreatedAt.Add(id.ttl)
+	}
+}
+
+// Middleware making the writes with an Idempotency-Key idempotent, it should
+// run after the authentication middleware as keys are scoped to their caller
+func (id *Idempotency) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		caller := idempotencyCaller(r.Context())
+		if key == "" || caller == "" || !isWrite(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			WriteError(w, "idempotency", InvalidField(IdempotencyKeyHeader, "max", fmt.Sprint(maxIdempotencyKeyLength), fmt.Sprintf("%s must be at most %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLength)))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			WriteError(w, "idempotency", err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := r.Context()
+		record := id.newRecord(caller, key, idempotencyHash(r, body))
+		existing, err := id.claim(ctx, record)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errIdempotencyInProgress) {
+			w.Header().Set("Retry-After", "1")
+		}
+		if err != nil {
+			WriteError(w, "idempotency", err)
+			return
+		}
+		if existing != nil {
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			if existing.ContentType != "" {
+				w.Header().Set("Content-Type", existing.ContentType)
+			}
+			if existing.CacheControl != "" {
+				w.Header().Set("Cache-Control", existing.CacheControl)
+			}
+			w.WriteHeader(existing.Status)
+			w.Write(existing.Body)
+			return
+		}
+
+		// The record is kept even if the client went away, so its retries are replayed
+		storeCtx := context.WithoutCancel(ctx)
+		recorder := &idempotencyRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if !completed {
+				id.service.Release(&storeCtx, record)
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+		// Server errors are not stored, the request can be retried
+		if recorder.status >= http.StatusInternalServerError {
+			return
+		}
+		record.Status = recorder.status
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		record.ContentType = recorder.Header().Get("Content-Type")
+		record.CacheControl = recorder.Header().Get("Cache-Control")
+		record.Body = recorder.body.Bytes()
+		completed = id.service.Complete(&storeCtx, record) == nil
+	})
+}
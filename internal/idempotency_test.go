@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const idempotencyTestSecret = `{"key":"sk_live_secret"}`
+
+func newTestIdempotency(t *testing.T) (*fakeDB, *Idempotency) {
+	fake, client := newFakeDB(t)
+	service := &IdempotencyService{dao: &Dao[IdempotencyRecord]{dbClient: client}}
+	return fake, &Idempotency{service: service, ttl: time.Hour, wait: time.Second}
+}
+
+func idempotentRequest(user *User) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/v1/admin/api-keys", strings.NewReader(`{"name":"ci"}`))
+	r.Header.Set(IdempotencyKeyHeader, "key-1")
+	return r.WithContext(userContext(user))
+}
+
+// Handler answering with a secret that should not be stored or cached
+func secretHandler(calls *int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, idempotencyTestSecret)
+	})
+}
+
+func TestIdempotencyStoresEncryptedResponse(t *testing.T) {
+	fake, idempotency := newTestIdempotency(t)
+	calls := 0
+	w := httptest.NewRecorder()
+	idempotency.Middleware(secretHandler(&calls)).ServeHTTP(w, idempotentRequest(NewUser("Ann", "ann@example.com", "")))
+	if w.Code != http.StatusCreated || w.Body.String() != idempotencyTestSecret {
+		t.Fatalf("response = %d %q", w.Code, w.Body.String())
+	}
+	updates := fake.Find(`UPDATE "idempotency_records"`)
+	if len(updates) != 1 {
+		t.Fatalf("idempotency record updates = %d, want 1", len(updates))
+	}
+	var cacheControl bool
+	for _, arg := range updates[0].Args {
+		switch value := arg.(type) {
+		case []byte:
+			if bytes.Contains(value, []byte("sk_live_secret")) || !bytes.HasPrefix(value, []byte(encryptedPrefix)) {
+				t.Errorf("stored body = %q, want it encrypted", value)
+			}
+		case string:
+			if strings.Contains(value, "sk_live_secret") {
+				t.Errorf("stored %q, want the body encrypted", value)
+			}
+			cacheControl = cacheControl || value == "no-store"
+		}
+	}
+	if !cacheControl {
+		t.Errorf("stored args = %v, want the Cache-Control of the response", updates[0].Args)
+	}
+}
+
+func TestIdempotencyReplaysDecryptedResponse(t *testing.T) {
+	fake, idempotency := newTestIdempotency(t)
+	user := NewUser("Ann", "ann@example.com", "")
+	r := idempotentRequest(user)
+	keyring, err := PIIKeyring()
+	if err != nil {
+		t.Fatalf("pii keyring: %v", err)
+	}
+	body, err := keyring.Encrypt(idempotencyBodyColumn, idempotencyTestSecret)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	now := time.Now().UTC()
+	fake.AddRows(t, &IdempotencyRecord{
+		Caller:       idempotencyCaller(r.Context()),
+		Key:          "key-1",
+		RequestHash:  idempotencyHash(r, []byte(`{"name":"ci"}`)),
+		Status:       http.StatusCreated,
+		ContentType:  "application/json",
+		CacheControl: "no-store",
+		Body:         []byte(body),
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(time.Hour),
+	})
+	fake.skipUpserts = true
+
+	calls := 0
+	w := httptest.NewRecorder()
+	idempotency.Middleware(secretHandler(&calls)).ServeHTTP(w, r)
+	if calls != 0 {
+		t.Errorf("handler called %d times, want the response replayed", calls)
+	}
+	if w.Code != http.StatusCreated || w.Body.String() != idempotencyTestSecret {
+		t.Errorf("replayed response = %d %q, want %q", w.Code, w.Body.String(), idempotencyTestSecret)
+	}
+	if w.Header().Get(IdempotentReplayedHeader) != "true" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("replayed headers = %v, want the Cache-Control of the response", w.Header())
+	}
+}
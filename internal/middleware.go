@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const RequestIdHeader = "X-Request-ID"
+
+const requestIdContextKey contextKey = "requestId"
+
+// Default limit of request bodies, overridden by MAX_BODY_BYTES
+const defaultMaxBodyBytes = 1 << 20
+
+func ContextWithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdContextKey, requestId)
+}
+
+// Id of the request, empty outside of requests
+func RequestIdFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requestId, _ := ctx.Value(requestIdContextKey).(string)
+	return requestId
+}
+
+// Middleware tagging every request with an id, taken from the X-Request-ID
+// header when the client sends one
+func RequestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(RequestIdHeader)
+		if requestId == "" || len(requestId) > 128 {
+			requestId = GenerateUUIdV6().String()
+		}
+		w.Header().Set(RequestIdHeader, requestId)
+		next.ServeHTTP(w, r.WithContext(ContextWithRequestId(r.Context(), requestId)))
+	})
+}
+
+// Response writer recording the status and size of the response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func recordResponse(w http.ResponseWriter) *responseRecorder {
+	if recorder, ok := w.(*responseRecorder); ok {
+		return recorder
+	}
+	return &responseRecorder{ResponseWriter: w}
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += n
+	return n, err
+}
+
+// Middleware logging every request with its route template, status, latency and size
+func AccessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := recordResponse(w)
+		next.ServeHTTP(recorder, r)
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		Log.Info("request",
+			zap.String("requestId", RequestIdFromContext(r.Context())),
+			zap.String("method", r.Method),
+			zap.String("route", route),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", recorder.status),
+			zap.Duration("latency", time.Since(start)),
+			zap.Int("bytes", recorder.bytes),
+			zap.String("remoteAddr", r.RemoteAddr),
+		)
+	})
+}
+
+// Middleware turning panics of the handlers into a 500 response
+func RecoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := recordResponse(w)
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// Aborted responses are handled by the server
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			Log.Error(fmt.Sprintf("panic: %v", recovered),
+				zap.String("requestId", RequestIdFromContext(r.Context())),
+				zap.ByteString("stack", debug.Stack()),
+			)
+			// The response cannot be replaced once it started
+			if recorder.status != 0 {
+				return
+			}
+			statusCode, resp := NewErrorResp(fmt.Errorf("panic: %v", recovered))
+			recorder.Header().Set("Content-Type", "application/json")
+			recorder.WriteHeader(statusCode)
+			json.NewEncoder(recorder).Encode(resp)
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// Middleware limiting the size of request bodies to MAX_BODY_BYTES
+func BodyLimitMiddleware() (func(http.Handler) http.Handler, error) {
+	limit := int64(defaultMaxBodyBytes)
+	if value := os.Getenv("MAX_BODY_BYTES"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			Log.Error("invalid env: MAX_BODY_BYTES")
+			return nil, fmt.Errorf("MAX_BODY_BYTES should be a positive number of bytes: %s", value)
+		}
+		limit = parsed
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				statusCode, resp := NewErrorResp(&http.MaxBytesError{Limit: limit})
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(statusCode)
+				json.NewEncoder(w).Encode(resp)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
@@ -1,22 +1,74 @@
 package internal
 
 import (
-	"fmt"
+	"encoding/json"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 // User Model
 type User struct {
-	UId       uuid.UUID `json:"uId,omitempty" gorm:"primaryKey;type:uuid"`
-	Name      string    `json:"name,omitempty"`
-	Email     string    `json:"email,omitempty"`
-	PhoneNo   string    `json:"phoneNo,omitempty"`
-	CreatedAt time.Time `json:"createdAt,omitempty"`
+	UId  uuid.UUID `json:"uId,omitempty" gorm:"primaryKey;type:uuid"`
+	Name string    `json:"name,omitempty"`
+	// Contact details are encrypted at rest and looked up by their blind index
+	Email        string `json:"email,omitempty" gorm:"serializer:encrypted"`
+	PhoneNo      string `json:"phoneNo,omitempty" gorm:"serializer:encrypted"`
+	EmailIndex   string `json:"-" gorm:"uniqueIndex:idx_users_email_index,where:email_index <> ''"`
+	PhoneNoIndex string `json:"-" gorm:"uniqueIndex:idx_users_phone_no_index,where:phone_no_index <> ''"`
+	// Time the contact details were verified, cleared when they change
+	EmailVerifiedAt   *time.Time `json:"emailVerifiedAt,omitempty"`
+	PhoneNoVerifiedAt *time.Time `json:"phoneNoVerifiedAt,omitempty"`
+	CreatedAt         time.Time  `json:"createdAt,omitempty"`
+	// Placeholder users are created for people invited to an expense before signing up
+	IsPlaceholder bool       `json:"isPlaceholder,omitempty" gorm:"default:false"`
+	MergedInto    *uuid.UUID `json:"mergedInto,omitempty" gorm:"type:uuid"`
+	// Deleted users are anonymised and kept so their expenses stay readable
+	DeletedAt *time.Time `json:"deletedAt,omitempty" gorm:"index"`
+	ErasedAt  *time.Time `json:"erasedAt,omitempty"`
+	// Bcrypt hash of the password, empty for users who cannot log in
+	PasswordHash string `json:"-"`
+	IsAdmin      bool   `json:"isAdmin,omitempty" gorm:"default:false"`
+	// Identity provider account linked to the user
+	OidcIssuer  string `json:"-" gorm:"uniqueIndex:idx_users_oidc,where:oidc_subject <> ''"`
+	OidcSubject string `json:"-" gorm:"uniqueIndex:idx_users_oidc,where:oidc_subject <> ''"`
 }
 
+// Keep the blind indexes in sync with the contact details. Updates restricted
+// with Select should also select the index columns.
+func (u *User) BeforeSave(tx *gorm.DB) error {
+	var err error
+	if u.EmailIndex, err = BlindIndex("email", u.Email); err != nil {
+		return err
+	}
+	u.PhoneNoIndex, err = BlindIndex("phone_no", u.PhoneNo)
+	return err
+}
+
+// Whether the user can log in, deleted, erased and merged users cannot
+func (u *User) IsActive() bool {
+	return u.DeletedAt == nil && u.ErasedAt == nil && u.MergedInto == nil
+}
+
+// Whether the user verified the email or phone number of another user, e.g. the
+// placeholder of an invitee
+func (u *User) HasVerifiedContactOf(other *User) bool {
+	if u.EmailVerifiedAt != nil && u.Email != "" && NormalizeEmail(u.Email) == NormalizeEmail(other.Email) {
+		return true
+	}
+	return u.PhoneNoVerifiedAt != nil && u.PhoneNo != "" && NormalizePhoneNo(u.PhoneNo) == NormalizePhoneNo(other.PhoneNo)
+}
+
+// Names shown for deleted users and users whose personal data was erased
+const (
+	DeletedUserName = "Deleted user"
+	ErasedUserName  = "Erased user"
+)
+
 func NewUser(name string, email string, phoneNo string) *User {
 	return &User{
 		UId:       GenerateUUIdV6(),
@@ -27,6 +79,358 @@ func NewUser(name string, email string, phoneNo string) *User {
 	}
 }
 
+type CreateUserRequest struct {
+	Name     string `json:"name" validate:"required,max=100"`
+	Email    string `json:"email,omitempty" validate:"required_without=PhoneNo,omitempty,email"`
+	PhoneNo  string `json:"phoneNo,omitempty" validate:"required_without=Email,omitempty,e164"`
+	Password string `json:"password,omitempty" validate:"omitempty,min=8,max=72"`
+}
+
+// Normalize and validate the request
+func (r *CreateUserRequest) Validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	r.Email = NormalizeEmail(r.Email)
+	r.PhoneNo = NormalizePhoneNo(r.PhoneNo)
+	return validator.New().Struct(r)
+}
+
+// Path parameters of the routes of a user
+type UserPath struct {
+	UId uuid.UUID `json:"-" path:"uid"`
+}
+
+// Fields to update on a user, nil fields are left unchanged
+type UpdateUserRequest struct {
+	UserPath
+	Name    *string `json:"name,omitempty" validate:"omitempty,min=1,max=100"`
+	Email   *string `json:"email,omitempty" validate:"omitempty,email"`
+	PhoneNo *string `json:"phoneNo,omitempty" validate:"omitempty,e164"`
+}
+
+// Normalize and validate the request
+func (r *UpdateUserRequest) Validate() error {
+	if r.Name != nil {
+		name := strings.TrimSpace(*r.Name)
+		r.Name = &name
+	}
+	if r.Email != nil {
+		email := NormalizeEmail(*r.Email)
+		r.Email = &email
+	}
+	if r.PhoneNo != nil {
+		phoneNo := NormalizePhoneNo(*r.PhoneNo)
+		r.PhoneNo = &phoneNo
+	}
+	if r.Name == nil && r.Email == nil && r.PhoneNo == nil {
+		return Invalidf("nothing to update")
+	}
+	return validator.New().Struct(r)
+}
+
+// Filters to search users, empty fields are ignored
+type UserFilter struct {
+	Name       string     `json:"-" query:"name"`
+	Email      string     `json:"-" query:"email"`
+	PhoneNo    string     `json:"-" query:"phoneNo"`
+	SharedWith *uuid.UUID `json:"-" query:"sharedWith"`
+	Page       int        `json:"-" query:"page" default:"1" validate:"min=1"`
+	PageSize   int        `json:"-" query:"pageSize" default:"20" validate:"min=1,max=100"`
+}
+
+type DashboardRequest struct {
+	UserPath
+	Limit int `json:"-" query:"limit" default:"10" validate:"min=1"`
+}
+
+func NewPlaceholderUser(name string, email string, phoneNo string) *User {
+	if name == "" {
+		name = email
+	}
+	if name == "" {
+		name = phoneNo
+	}
+	user := NewUser(name, email, phoneNo)
+	user.IsPlaceholder = true
+	return user
+}
+
+type NotificationSettings struct {
+	OnExpense    bool   `json:"onExpense"`
+	OnPayment    bool   `json:"onPayment"`
+	OnSettlement bool   `json:"onSettlement"`
+	Digest       string `json:"digest"`
+}
+
+// UserPreferences Model
+type UserPreferences struct {
+	UId              uuid.UUID            `json:"uId" gorm:"primaryKey;type:uuid"`
+	DefaultCurrency  string               `json:"defaultCurrency"`
+	Locale           string               `json:"locale"`
+	TimeZone         string               `json:"timeZone"`
+	DefaultSplitType string               `json:"defaultSplitType"`
+	Notifications    NotificationSettings `json:"notifications" gorm:"embedded;embeddedPrefix:notify_"`
+	UpdatedAt        time.Time            `json:"updatedAt"`
+}
+
+// Preferences of a user who has not set any
+func NewUserPreferences(uid uuid.UUID) *UserPreferences {
+	return &UserPreferences{
+		UId:              uid,
+		DefaultCurrency:  "USD",
+		Locale:           "en-US",
+		TimeZone:         "UTC",
+		DefaultSplitType: "equal",
+		Notifications: NotificationSettings{
+			OnExpense:    true,
+			OnPayment:    true,
+			OnSettlement: true,
+			Digest:       "none",
+		},
+		UpdatedAt: time.Now().UTC(),
+	}
+}
+
+// Location of the preferred time zone, UTC when unknown
+func (p *UserPreferences) Location() *time.Location {
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Preferences to update, nil fields are left unchanged
+type UpdatePreferencesRequest struct {
+	UserPath
+	DefaultCurrency  *string `json:"defaultCurrency,omitempty" validate:"omitempty,iso4217"`
+	Locale           *string `json:"locale,omitempty" validate:"omitempty,bcp47_language_tag"`
+	TimeZone         *string `json:"timeZone,omitempty" validate:"omitempty,timezone"`
+	DefaultSplitType *string `json:"defaultSplitType,omitempty" validate:"omitempty,oneof=equal exact percent"`
+	Notifications    *struct {
+		OnExpense    *bool   `json:"onExpense,omitempty"`
+		OnPayment    *bool   `json:"onPayment,omitempty"`
+		OnSettlement *bool   `json:"onSettlement,omitempty"`
+		Digest       *string `json:"digest,omitempty" validate:"omitempty,oneof=none daily weekly"`
+	} `json:"notifications,omitempty"`
+}
+
+// Normalize and validate the request
+func (r *UpdatePreferencesRequest) Validate() error {
+	if r.DefaultCurrency != nil {
+		currency := strings.ToUpper(strings.TrimSpace(*r.DefaultCurrency))
+		r.DefaultCurrency = &currency
+	}
+	return validator.New().Struct(r)
+}
+
+// Apply the request to the preferences
+func (r *UpdatePreferencesRequest) Apply(p *UserPreferences) {
+	if r.DefaultCurrency != nil {
+		p.DefaultCurrency = *r.DefaultCurrency
+	}
+	if r.Locale != nil {
+		p.Locale = *r.Locale
+	}
+	if r.TimeZone != nil {
+		p.TimeZone = *r.TimeZone
+	}
+	if r.DefaultSplitType != nil {
+		p.DefaultSplitType = *r.DefaultSplitType
+	}
+	if n := r.Notifications; n != nil {
+		if n.OnExpense != nil {
+			p.Notifications.OnExpense = *n.OnExpense
+		}
+		if n.OnPayment != nil {
+			p.Notifications.OnPayment = *n.OnPayment
+		}
+		if n.OnSettlement != nil {
+			p.Notifications.OnSettlement = *n.OnSettlement
+		}
+		if n.Digest != nil {
+			p.Notifications.Digest = *n.Digest
+		}
+	}
+	p.UpdatedAt = time.Now().UTC()
+}
+
+// Reference to a user in an expense request, either by id or, for people
+// who have not signed up yet, by email or phone number
+type UserRef struct {
+	UId     uuid.UUID `json:"uId,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Email   string    `json:"email,omitempty" validate:"omitempty,email"`
+	PhoneNo string    `json:"phoneNo,omitempty" validate:"omitempty,e164"`
+}
+
+// Accepts a user id, an email or a phone number as a string, or an object
+func (ref *UserRef) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		type userRef UserRef
+		return json.Unmarshal(data, (*userRef)(ref))
+	}
+	if uid, err := uuid.Parse(value); err == nil {
+		ref.UId = uid
+	} else if strings.Contains(value, "@") {
+		ref.Email = value
+	} else {
+		ref.PhoneNo = value
+	}
+	return nil
+}
+
+func (ref UserRef) MarshalJSON() ([]byte, error) {
+	if ref.UId != uuid.Nil {
+		return json.Marshal(ref.UId)
+	}
+	type userRef UserRef
+	return json.Marshal(userRef(ref))
+}
+
+// Normalize and validate the reference
+func (ref *UserRef) Validate() error {
+	if ref.UId != uuid.Nil {
+		return nil
+	}
+	ref.Email = NormalizeEmail(ref.Email)
+	ref.PhoneNo = NormalizePhoneNo(ref.PhoneNo)
+	if ref.Email == "" && ref.PhoneNo == "" {
+		return Invalidf("user should have an id, email or phone number")
+	}
+	return validator.New().Struct(ref)
+}
+
+type MergeUserRequest struct {
+	UserPath
+	PlaceholderId uuid.UUID `json:"placeholderId" validate:"required"`
+}
+
+func (r MergeUserRequest) Validate() error {
+	return validator.New().Struct(r)
+}
+
+// Session Model
+// A login of a user, identified in the access and refresh tokens issued for it.
+// RefreshJti is the id of the only refresh token of the session still valid.
+type Session struct {
+	SId        uuid.UUID  `json:"sId" gorm:"primaryKey;type:uuid"`
+	UId        uuid.UUID  `json:"uId" gorm:"type:uuid;index"`
+	RefreshJti uuid.UUID  `json:"-" gorm:"type:uuid"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+func NewSession(uid uuid.UUID, ttl time.Duration) *Session {
+	now := time.Now().UTC()
+	return &Session{
+		SId:        GenerateUUIdV6(),
+		UId:        uid,
+		RefreshJti: GenerateUUIdV6(),
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(ttl),
+	}
+}
+
+type LoginRequest struct {
+	Email    string `json:"email,omitempty" validate:"required_without=PhoneNo,omitempty,email"`
+	PhoneNo  string `json:"phoneNo,omitempty" validate:"required_without=Email,omitempty,e164"`
+	Password string `json:"password" validate:"required"`
+}
+
+// Normalize and validate the request
+func (r *LoginRequest) Validate() error {
+	r.Email = NormalizeEmail(r.Email)
+	r.PhoneNo = NormalizePhoneNo(r.PhoneNo)
+	return validator.New().Struct(r)
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken" validate:"required"`
+}
+
+func (r RefreshRequest) Validate() error {
+	return validator.New().Struct(r)
+}
+
+// Query parameters of the redirect back from the identity provider
+type OIDCCallbackRequest struct {
+	Code             string `json:"-" query:"code"`
+	State            string `json:"-" query:"state"`
+	Error            string `json:"-" query:"error"`
+	ErrorDescription string `json:"-" query:"error_description"`
+}
+
+type LogoutRequest struct {
+	// Revoke every session of the user instead of the current one
+	All bool `json:"all,omitempty"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword,omitempty"`
+	NewPassword     string `json:"newPassword" validate:"required,min=8,max=72"`
+}
+
+func (r ChangePasswordRequest) Validate() error {
+	return validator.New().Struct(r)
+}
+
+type TokenPair struct {
+	AccessToken  string    `json:"accessToken"`
+	RefreshToken string    `json:"refreshToken"`
+	TokenType    string    `json:"tokenType"`
+	ExpiresIn    int       `json:"expiresIn"`
+	SessionId    uuid.UUID `json:"sessionId"`
+}
+
+// ApiKey Model
+// Only a SHA-256 hash of the secret is stored, keys are looked up by their
+// prefix which is also shown to identify them.
+type ApiKey struct {
+	KId        uuid.UUID  `json:"kId" gorm:"primaryKey;type:uuid"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix" gorm:"uniqueIndex"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes" gorm:"serializer:json"`
+	CreatedBy  *uuid.UUID `json:"createdBy,omitempty" gorm:"type:uuid"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RotatedAt  *time.Time `json:"rotatedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+func (k *ApiKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+type ApiKeyPath struct {
+	KId uuid.UUID `json:"-" path:"kId"`
+}
+
+type ApiKeyRequest struct {
+	Name      string     `json:"name" validate:"required,max=100"`
+	Scopes    []string   `json:"scopes" validate:"required,min=1,dive,oneof=expenses:read expenses:write balances:read balances:write users:read users:write admin"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+func (r ApiKeyRequest) Validate() error {
+	if err := validator.New().Struct(r); err != nil {
+		return err
+	}
+	if r.ExpiresAt != nil && r.ExpiresAt.Before(time.Now()) {
+		return InvalidField("expiresAt", "gt", "now", "expiresAt should be in the future")
+	}
+	return nil
+}
+
+// API key with its secret, only returned when the key is created or rotated
+type ApiKeySecret struct {
+	*ApiKey
+	Key string `json:"key"`
+}
+
 // Lend Model
 type Lend struct {
 	LId        uuid.UUID `json:"lId,omitempty" gorm:"primaryKey;type:uuid"`
@@ -48,41 +452,47 @@ func NewLender(lenderId uuid.UUID, borrowerId uuid.UUID, amount float64) *Lend {
 	}
 }
 
+// Type defaults to the lender's preferred split type when omitted
 type ExpenseRequest struct {
-	Type        string      `json:"type,omitempty" validate:"required"`
-	LenderId    uuid.UUID   `json:"lenderId,omitempty" validate:"required"`
-	Amount      float64     `json:"amount,omitempty" validate:"required,gt=0"`
-	Description string      `json:"description,omitempty"`
-	Users       []uuid.UUID `json:"users,omitempty" validate:"required"`
-	Percents    []float64   `json:"percents,omitempty" validate:"required_if=Type percent"`
-	Values      []float64   `json:"values,omitempty" validate:"required_if=Type exact"`
+	Type        string    `json:"type,omitempty" validate:"omitempty,oneof=equal exact percent"`
+	LenderId    uuid.UUID `json:"lenderId,omitempty" validate:"required"`
+	Amount      float64   `json:"amount,omitempty" validate:"required,gt=0"`
+	Description string    `json:"description,omitempty"`
+	Users       []UserRef `json:"users,omitempty" validate:"required"`
+	Percents    []float64 `json:"percents,omitempty" validate:"required_if=Type percent"`
+	Values      []float64 `json:"values,omitempty" validate:"required_if=Type exact"`
 }
 
 func Validate(expenseRequest ExpenseRequest) error {
 	if validationErr := validator.New().Struct(expenseRequest); validationErr != nil {
 		return validationErr
 	}
+	for i := range expenseRequest.Users {
+		if err := expenseRequest.Users[i].Validate(); err != nil {
+			return err
+		}
+	}
 	expenseType := expenseRequest.Type
 	if expenseType != "equal" && expenseType != "exact" && expenseType != "percent" {
-		return fmt.Errorf("invalid expense type")
+		return InvalidField("type", "oneof", "equal exact percent", "invalid expense type")
 	}
 	if len(expenseRequest.Users) < 2 && expenseType == "equal" {
-		return fmt.Errorf("at least 2 users are required to split equally")
+		return InvalidField("users", "min", "2", "at least 2 users are required to split equally")
 	} else if len(expenseRequest.Users) < 1 && expenseType == "exact" {
-		return fmt.Errorf("at least 1 user is required to split exactly")
+		return InvalidField("users", "min", "1", "at least 1 user is required to split exactly")
 	} else if len(expenseRequest.Users) < 1 && expenseType == "percent" {
-		return fmt.Errorf("at least 1 user are required to split by percent")
+		return InvalidField("users", "min", "1", "at least 1 user is required to split by percent")
 	}
 	if expenseType == "percent" {
 		sum := 0.0
 		for _, val := range expenseRequest.Percents {
 			if val < 0 || val > 100 {
-				return fmt.Errorf("invalid percent value")
+				return InvalidField("percents", "range", "0-100", "invalid percent value")
 			}
 			sum += val
 		}
 		if sum != 100.0 {
-			return fmt.Errorf("validationError: summation of percents should be 100")
+			return InvalidField("percents", "sum", "100", "summation of percents should be 100")
 		}
 	}
 	if expenseType == "exact" {
@@ -91,12 +501,21 @@ func Validate(expenseRequest ExpenseRequest) error {
 			sum += val
 		}
 		if sum != expenseRequest.Amount {
-			return fmt.Errorf("validationError: summation of values should be equal to amount lended")
+			return InvalidField("values", "sum", "amount", "summation of values should be equal to amount lended")
 		}
 	}
 	return nil
 }
 
+// Ids of the users in the request, placeholders must be resolved first
+func (r ExpenseRequest) UserIds() []uuid.UUID {
+	userIds := make([]uuid.UUID, len(r.Users))
+	for i, ref := range r.Users {
+		userIds[i] = ref.UId
+	}
+	return userIds
+}
+
 type ExpenseBorrower struct {
 	ExpenseId  uuid.UUID `json:"expenseId,omitempty" gorm:"primaryKey;type:uuid"`
 	BorrowerId uuid.UUID `json:"borrowerId,omitempty" gorm:"primaryKey;type:uuid"`
@@ -141,12 +560,281 @@ func NewExpense(category string, amount float64, description string, lenderId uu
 	}
 }
 
+// Users taking part in the expense
+func (e *Expense) Participants() []uuid.UUID {
+	participants := []uuid.UUID{e.LenderId}
+	for _, expenseBorrower := range e.ExpenseBorrowers {
+		participants = append(participants, expenseBorrower.BorrowerId)
+	}
+	return participants
+}
+
+// Sources of balance changes recorded in the ledger
+const (
+	LedgerSourceOpening        = "opening"
+	LedgerSourceExpense        = "expense"
+	LedgerSourcePayment        = "payment"
+	LedgerSourceSettlement     = "settlement"
+	LedgerSourceReconciliation = "reconciliation"
+	LedgerSourceMerge          = "merge"
+)
+
+// LedgerEntry Model
+// Append-only record of a change to the balance between two users.
+// A positive amount increases what BorrowerId owes LenderId.
+type LedgerEntry struct {
+	EId        uuid.UUID  `json:"eId,omitempty" gorm:"primaryKey;type:uuid"`
+	LId        uuid.UUID  `json:"lId,omitempty" gorm:"type:uuid;index:idx_ledger_lid_created,priority:1"`
+	LenderId   uuid.UUID  `json:"lenderId,omitempty" gorm:"type:uuid"`
+	Lender     User       `json:"-" gorm:"foreignKey:LenderId"`
+	BorrowerId uuid.UUID  `json:"borrowerId,omitempty" gorm:"type:uuid"`
+	Borrower   User       `json:"-" gorm:"foreignKey:BorrowerId"`
+	Amount     float64    `json:"amount"`
+	Source     string     `json:"source,omitempty"`
+	SourceId   *uuid.UUID `json:"sourceId,omitempty" gorm:"type:uuid"`
+	CreatedAt  time.Time  `json:"createdAt,omitempty" gorm:"index:idx_ledger_lid_created,priority:2"`
+}
+
+func NewLedgerEntry(source string, sourceId *uuid.UUID, lenderId uuid.UUID, borrowerId uuid.UUID, amount float64) *LedgerEntry {
+	return &LedgerEntry{
+		EId:        GenerateUUIdV6(),
+		LId:        GenerateUUIDFromUUIDs(lenderId, borrowerId),
+		LenderId:   lenderId,
+		BorrowerId: borrowerId,
+		Amount:     amount,
+		Source:     source,
+		SourceId:   sourceId,
+		CreatedAt:  time.Now().UTC(),
+	}
+}
+
+// Lend row the entry is applied to
+func (e *LedgerEntry) Lend() *Lend {
+	lend := NewLender(e.LenderId, e.BorrowerId, e.Amount)
+	lend.UpdatedAt = e.CreatedAt
+	return lend
+}
+
+// Point in the balance history between two users
+type BalancePoint struct {
+	Timestamp time.Time  `json:"timestamp"`
+	Delta     float64    `json:"delta"`
+	Balance   float64    `json:"balance"`
+	Source    string     `json:"source,omitempty"`
+	SourceId  *uuid.UUID `json:"sourceId,omitempty"`
+}
+
+// Balance history between two users from the perspective of LenderId
+type BalanceHistory struct {
+	LId        uuid.UUID       `json:"lId"`
+	LenderId   uuid.UUID       `json:"lenderId"`
+	BorrowerId uuid.UUID       `json:"borrowerId"`
+	Points     []*BalancePoint `json:"points"`
+}
+
+// Difference between the recorded lend and the balance derived from expenses
+type LendDiscrepancy struct {
+	LId        uuid.UUID `json:"lId"`
+	LenderId   uuid.UUID `json:"lenderId"`
+	BorrowerId uuid.UUID `json:"borrowerId"`
+	Recorded   float64   `json:"recorded"`
+	Expected   float64   `json:"expected"`
+	Difference float64   `json:"difference"`
+}
+
+type ReconciliationReport struct {
+	CheckedAt     time.Time          `json:"checkedAt"`
+	Checked       int                `json:"checked"`
+	Repaired      bool               `json:"repaired"`
+	Discrepancies []*LendDiscrepancy `json:"discrepancies"`
+}
+
+// Balance with a friend from the perspective of the dashboard owner.
+// A positive balance means the friend owes the user.
+type FriendBalance struct {
+	UserId    uuid.UUID `json:"userId"`
+	Name      string    `json:"name"`
+	Balance   float64   `json:"balance"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Ledger entry from the perspective of the dashboard owner
+type Activity struct {
+	Timestamp  time.Time  `json:"timestamp"`
+	Source     string     `json:"source"`
+	SourceId   *uuid.UUID `json:"sourceId,omitempty"`
+	FriendId   uuid.UUID  `json:"friendId"`
+	FriendName string     `json:"friendName"`
+	Amount     float64    `json:"amount"`
+}
+
+type Dashboard struct {
+	UserId         uuid.UUID        `json:"userId"`
+	Name           string           `json:"name"`
+	YouOwe         float64          `json:"youOwe"`
+	YouAreOwed     float64          `json:"youAreOwed"`
+	Net            float64          `json:"net"`
+	Friends        []*FriendBalance `json:"friends"`
+	RecentActivity []*Activity      `json:"recentActivity"`
+}
+
+// Settlement Model
+type Settlement struct {
+	SId           uuid.UUID `json:"sId,omitempty" gorm:"primaryKey;type:uuid"`
+	LId           uuid.UUID `json:"lId,omitempty" gorm:"type:uuid;index"`
+	PayerId       uuid.UUID `json:"payerId,omitempty" gorm:"type:uuid"`
+	Payer         User      `json:"-" gorm:"foreignKey:PayerId"`
+	PayeeId       uuid.UUID `json:"payeeId,omitempty" gorm:"type:uuid"`
+	Payee         User      `json:"-" gorm:"foreignKey:PayeeId"`
+	Amount        float64   `json:"amount"`
+	Currency      string    `json:"currency,omitempty"`
+	Rate          float64   `json:"rate,omitempty"`
+	SettledAmount float64   `json:"settledAmount"`
+	CreatedAt     time.Time `json:"createdAt,omitempty"`
+}
+
+func NewSettlement(payerId uuid.UUID, payeeId uuid.UUID, amount float64, currency string, rate float64) *Settlement {
+	if rate == 0 {
+		rate = 1
+	}
+	return &Settlement{
+		SId:           GenerateUUIdV6(),
+		LId:           GenerateUUIDFromUUIDs(payerId, payeeId),
+		PayerId:       payerId,
+		PayeeId:       payeeId,
+		Amount:        amount,
+		Currency:      currency,
+		Rate:          rate,
+		SettledAmount: amount * rate,
+		CreatedAt:     time.Now().UTC(),
+	}
+}
+
+type ExpensePath struct {
+	ExId uuid.UUID `json:"-" path:"exId"`
+}
+
+// Balance between two users, as of a point in time when AsOf is set
+type BalanceRequest struct {
+	UserId1 uuid.UUID  `json:"-" query:"userId1" validate:"required"`
+	UserId2 uuid.UUID  `json:"-" query:"userId2" validate:"required"`
+	AsOf    *time.Time `json:"-" query:"asOf"`
+}
+
+type HistoryRequest struct {
+	UserId1 uuid.UUID  `json:"-" query:"userId1" validate:"required"`
+	UserId2 uuid.UUID  `json:"-" query:"userId2" validate:"required"`
+	From    *time.Time `json:"-" query:"from"`
+	To      *time.Time `json:"-" query:"to"`
+}
+
+type LendSummaryPath struct {
+	UserId uuid.UUID `json:"-" path:"userId"`
+}
+
+// Payment of the whole balance a borrower owes to a lender
+type PaymentRequest struct {
+	LenderId   uuid.UUID `json:"-" query:"lenderId" validate:"required"`
+	BorrowerId uuid.UUID `json:"-" query:"borrowerId" validate:"required"`
+	Amount     float64   `json:"-" query:"amount" validate:"required"`
+}
+
+// Settle all outstanding obligations between two users.
+// Rate converts the balance into the currency the settlement is paid in.
+type SettleAllRequest struct {
+	UserId1  uuid.UUID `json:"userId1,omitempty" validate:"required"`
+	UserId2  uuid.UUID `json:"userId2,omitempty" validate:"required"`
+	Currency string    `json:"currency,omitempty" validate:"omitempty,len=3"`
+	Rate     float64   `json:"rate,omitempty" validate:"omitempty,gt=0"`
+}
+
+func (r SettleAllRequest) Validate() error {
+	if validationErr := validator.New().Struct(r); validationErr != nil {
+		return validationErr
+	}
+	if r.UserId1 == r.UserId2 {
+		return InvalidField("userId2", "nefield", "userId1", "cannot settle with self")
+	}
+	return nil
+}
+
+// Actor types of audit entries
+const (
+	AuditActorUser      = "user"
+	AuditActorApiKey    = "api_key"
+	AuditActorAnonymous = "anonymous"
+	AuditActorSystem    = "system"
+)
+
+// Audit actions
+const (
+	AuditActionCreate = "create"
+	AuditActionUpsert = "upsert"
+	AuditActionUpdate = "update"
+	AuditActionDelete = "delete"
+)
+
+// AuditEntry Model
+// Append-only record of a write to an entity. Before and After only hold the
+// changed columns of updates.
+type AuditEntry struct {
+	AId        uuid.UUID       `json:"aId" gorm:"primaryKey;type:uuid"`
+	ActorType  string          `json:"actorType"`
+	ActorId    *uuid.UUID      `json:"actorId,omitempty" gorm:"type:uuid;index"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entityType" gorm:"index:idx_audit_entity"`
+	EntityId   string          `json:"entityId" gorm:"index:idx_audit_entity"`
+	Before     json.RawMessage `json:"before,omitempty" gorm:"type:jsonb"`
+	After      json.RawMessage `json:"after,omitempty" gorm:"type:jsonb"`
+	RequestId  string          `json:"requestId,omitempty" gorm:"index"`
+	CreatedAt  time.Time       `json:"createdAt" gorm:"index"`
+}
+
+type AuditFilter struct {
+	ActorId    *uuid.UUID `json:"-" query:"actorId"`
+	Action     string     `json:"-" query:"action"`
+	EntityType string     `json:"-" query:"entityType"`
+	EntityId   string     `json:"-" query:"entityId"`
+	RequestId  string     `json:"-" query:"requestId"`
+	From       *time.Time `json:"-" query:"from"`
+	To         *time.Time `json:"-" query:"to"`
+	Page       int        `json:"-" query:"page" default:"1" validate:"min=1"`
+	PageSize   int        `json:"-" query:"pageSize" default:"20" validate:"min=1,max=100"`
+}
+
+// A page of results
+type Page[T any] struct {
+	Items    []T   `json:"items"`
+	Page     int   `json:"page"`
+	PageSize int   `json:"pageSize"`
+	Total    int64 `json:"total"`
+}
+
+// IdempotencyRecord Model
+// Response of a request sent with an Idempotency-Key, replayed to the retries
+// of the caller. Status is 0 while the first request is in progress. The body
+// is encrypted, responses hold API keys and contact details.
+type IdempotencyRecord struct {
+	Caller       string    `json:"caller" gorm:"primaryKey"`
+	Key          string    `json:"key" gorm:"primaryKey;column:idempotency_key"`
+	RequestHash  string    `json:"-"`
+	Status       int       `json:"status"`
+	ContentType  string    `json:"-"`
+	CacheControl string    `json:"-"`
+	Body         []byte    `json:"-"`
+	CreatedAt    time.Time `json:"createdAt"`
+	ExpiresAt    time.Time `json:"expiresAt" gorm:"index"`
+}
+
 // API Response Model
+// Code and Details are only set on errors, see ErrorStatus
 type Response struct {
 	Timestamp time.Time   `json:"timestamp"`
 	Status    int         `json:"status"`
 	Message   string      `json:"message"`
 	Data      interface{} `json:"data"`
+	Code      ErrorCode   `json:"code,omitempty"`
+	Details   interface{} `json:"details,omitempty"`
 }
 
 func SuccessResp(status *int, msg *string, data interface{}) *Response {
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+const (
+	mockIssuerKid  = "mock-issuer-key"
+	mockIssuerPath = "/oidc/mock"
+	mockCodeTTL    = time.Minute
+)
+
+type mockAuthCode struct {
+	clientId      string
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	email         string
+	name          string
+	expiresAt     time.Time
+}
+
+// OpenID provider for local development and offline testing. Every user is
+// signed in without a password, the email is taken from the login_hint query
+// parameter of the authorization request.
+type MockIssuer struct {
+	issuer   string
+	clientId string
+	key      *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]*mockAuthCode
+}
+
+func NewMockIssuer(issuer string, clientId string) (*MockIssuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	Log.Warn(fmt.Sprintf("mock oidc issuer enabled at %s, do not use in production", issuer))
+	return &MockIssuer{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		clientId: clientId,
+		key:      key,
+		codes:    map[string]*mockAuthCode{},
+	}, nil
+}
+
+// Add the mock issuer routes, the issuer URL should end with /oidc/mock
+func MockIssuerRouter(r *mux.Router, issuer *MockIssuer) {
+	mockRoute := r.PathPrefix(mockIssuerPath).Subrouter()
+	mockRoute.HandleFunc("/.well-known/openid-configuration", issuer.Discovery).Methods("GET")
+	mockRoute.HandleFunc("/jwks", issuer.Jwks).Methods("GET")
+	mockRoute.HandleFunc("/authorize", issuer.Authorize).Methods("GET")
+	mockRoute.HandleFunc("/token", issuer.Token).Methods("POST")
+}
+
+func (m *MockIssuer) Discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(oidcDiscovery{
+		Issuer:                m.issuer,
+		AuthorizationEndpoint: m.issuer + "/authorize",
+		TokenEndpoint:         m.issuer + "/token",
+		JwksURI:               m.issuer + "/jwks",
+	})
+}
+
+func (m *MockIssuer) Jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	publicKey := m.key.PublicKey
+	json.NewEncoder(w).Encode(jsonWebKeySet{Keys: []jsonWebKey{{
+		Kty: "RSA",
+		Kid: mockIssuerKid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+	}}})
+}
+
+// Approve the authorization request and redirect back with a code
+func (m *MockIssuer) Authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("redirect_uri") == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if query.Get("client_id") != m.clientId || query.Get("response_type") != "code" {
+		http.Error(w, "invalid client_id or response_type", http.StatusBadRequest)
+		return
+	}
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "S256 code_challenge is required", http.StatusBadRequest)
+		return
+	}
+	email := NormalizeEmail(query.Get("login_hint"))
+	if email == "" {
+		http.Error(w, "login_hint with the email to sign in as is required", http.StatusBadRequest)
+		return
+	}
+	code, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.mu.Lock()
+	m.codes[code] = &mockAuthCode{
+		clientId:      m.clientId,
+		redirectURI:   redirectURI.String(),
+		codeChallenge: query.Get("code_challenge"),
+		nonce:         query.Get("nonce"),
+		email:         email,
+		name:          query.Get("name"),
+		expiresAt:     time.Now().Add(mockCodeTTL),
+	}
+	m.mu.Unlock()
+	params := redirectURI.Query()
+	params.Set("code", code)
+	params.Set("state", query.Get("state"))
+	redirectURI.RawQuery = params.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// Exchange a code for an ID token, checking the PKCE verifier
+func (m *MockIssuer) Token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	tokenError := func(errCode string, description string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": errCode, "error_description": description})
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError("unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+	m.mu.Lock()
+	authCode, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+	if !ok || time.Now().After(authCode.expiresAt) {
+		tokenError("invalid_grant", "unknown or expired code")
+		return
+	}
+	if r.PostForm.Get("client_id") != authCode.clientId || r.PostForm.Get("redirect_uri") != authCode.redirectURI {
+		tokenError("invalid_grant", "client_id or redirect_uri mismatch")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(pkceChallenge(r.PostForm.Get("code_verifier"))), []byte(authCode.codeChallenge)) != 1 {
+		tokenError("invalid_grant", "code_verifier does not match the code_challenge")
+		return
+	}
+	now := time.Now()
+	emailVerified := true
+	claims := idTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.issuer,
+			Subject:   "mock|" + authCode.email,
+			Audience:  jwt.ClaimStrings{authCode.clientId},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+		Nonce:         authCode.nonce,
+		Email:         authCode.email,
+		EmailVerified: &emailVerified,
+		Name:          authCode.name,
+	}
+	var accessToken string
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = mockIssuerKid
+	idToken, err := token.SignedString(m.key)
+	if err == nil {
+		accessToken, err = randomToken()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "server_error", "error_description": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+func TestVerifyIdTokenEmailVerified(t *testing.T) {
+	router := mux.NewRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+	issuer, err := NewMockIssuer(server.URL+mockIssuerPath, "client")
+	if err != nil {
+		t.Fatalf("mock issuer error = %v", err)
+	}
+	MockIssuerRouter(router, issuer)
+	provider := NewOIDCProvider(issuer.issuer, "client", "", server.URL+"/callback")
+
+	verified, unverified := true, false
+	tests := []struct {
+		name          string
+		emailVerified *bool
+		want          bool
+	}{
+		{"verified", &verified, true},
+		{"not verified", &unverified, false},
+		{"missing claim", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Now()
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, idTokenClaims{
+				RegisteredClaims: jwt.RegisteredClaims{
+					Issuer:    issuer.issuer,
+					Subject:   "mock|ann@example.com",
+					Audience:  jwt.ClaimStrings{"client"},
+					IssuedAt:  jwt.NewNumericDate(now),
+					ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+				},
+				Nonce:         "nonce",
+				Email:         "ann@example.com",
+				EmailVerified: test.emailVerified,
+			})
+			token.Header["kid"] = mockIssuerKid
+			idToken, err := token.SignedString(issuer.key)
+			if err != nil {
+				t.Fatalf("sign error = %v", err)
+			}
+
+			identity, err := provider.verifyIdToken(context.Background(), idToken, "nonce")
+			if err != nil {
+				t.Fatalf("verify error = %v", err)
+			}
+			if identity.EmailVerified != test.want {
+				t.Errorf("email verified = %v, want %v", identity.EmailVerified, test.want)
+			}
+		})
+	}
+}
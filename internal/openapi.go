@@ -0,0 +1,562 @@
+package internal
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	OpenAPIPath = "/openapi.json"
+	DocsPath    = "/docs"
+	// Redoc bundle served with the docs page, fetched by go generate
+	RedocPath    = DocsPath + "/redoc.standalone.js"
+	redocVersion = "2.1.5"
+	redocBundle  = "docs/redoc.standalone.js"
+)
+
+//go:generate curl -fsSL -o docs/redoc.standalone.js https://cdn.jsdelivr.net/npm/redoc@2.1.5/bundles/redoc.standalone.js
+
+// Docs page and the Redoc bundle when it was fetched
+//
+//go:embed docs
+var docsFS embed.FS
+
+type jsonObject map[string]interface{}
+
+// Operations of the routes that are not served by an Endpoint, keyed by method
+// and path template. Every such route needs an entry, see BuildOpenAPI.
+var rawOperations = map[string]jsonObject{
+	"GET /": {
+		"summary":     "API status",
+		"operationId": "getStatus",
+		"responses":   jsonObject{"200": envelopeResponse("API is running", statusSchema())},
+	},
+	"GET /health": {
+		"summary":     "Health check of the API and its database",
+		"operationId": "getHealth",
+		"responses": jsonObject{
+			"200": envelopeResponse("API and database are healthy", statusSchema()),
+			"500": envelopeResponse("Database connection error", statusSchema()),
+		},
+	},
+	"GET " + OpenAPIPath: {
+		"summary":     "OpenAPI document of the API",
+		"operationId": "getOpenAPI",
+		"responses":   jsonObject{"200": jsonObject{"description": "OpenAPI 3.1 document", "content": jsonObject{"application/json": jsonObject{"schema": jsonObject{"type": "object"}}}}},
+	},
+	"GET " + DocsPath: {
+		"summary":     "Documentation of the API",
+		"operationId": "getDocs",
+		"responses":   jsonObject{"200": jsonObject{"description": "Documentation page", "content": jsonObject{"text/html": jsonObject{"schema": jsonObject{"type": "string"}}}}},
+	},
+	"GET " + RedocPath: {
+		"summary":     "Redoc bundle of the documentation page",
+		"operationId": "getRedoc",
+		"responses":   jsonObject{"200": jsonObject{"description": "Redoc standalone bundle", "content": jsonObject{"text/javascript": jsonObject{"schema": jsonObject{"type": "string"}}}}},
+	},
+	"POST " + GraphQLPath: {
+		"summary":     "GraphQL query or mutation over the users, expenses and balances",
+		"operationId": "graphql",
+		"requestBody": jsonObject{"required": true, "content": jsonObject{"application/json": jsonObject{"schema": jsonObject{
+			"type":     "object",
+			"required": []string{"query"},
+			"properties": jsonObject{
+				"query":         jsonObject{"type": "string"},
+				"operationName": jsonObject{"type": "string"},
+				"variables":     jsonObject{"type": "object"},
+			},
+		}}}},
+		"responses": jsonObject{
+			"200": jsonObject{"description": "GraphQL response, errors carry the code of the error in their extensions", "content": jsonObject{"application/json": jsonObject{"schema": jsonObject{
+				"type": "object",
+				"properties": jsonObject{
+					"data":   jsonObject{"type": "object"},
+					"errors": jsonObject{"type": "array", "items": jsonObject{"type": "object"}},
+				},
+			}}}},
+			"default": errorResponse(),
+		},
+	},
+	"GET /user/{uid}/export": {
+		"summary":     "Export user",
+		"operationId": "exportUser",
+		"parameters":  []jsonObject{pathParameter("uid", jsonObject{"type": "string", "format": "uuid"})},
+		"responses": jsonObject{
+			"200":     jsonObject{"description": "Zip archive of the data of the user", "content": jsonObject{"application/zip": jsonObject{"schema": jsonObject{"type": "string", "contentMediaType": "application/zip"}}}},
+			"default": errorResponse(),
+		},
+	},
+	"GET /auth/oidc/login": {
+		"summary":     "Login with the identity provider",
+		"operationId": "oidcLogin",
+		"parameters":  []jsonObject{{"name": "loginHint", "in": "query", "schema": jsonObject{"type": "string"}, "description": "Email prefilled at the identity provider"}},
+		"responses": jsonObject{
+			"302":     jsonObject{"description": "Redirect to the identity provider, the login state is kept in the oidc_state cookie"},
+			"default": errorResponse(),
+		},
+	},
+	"GET /auth/oidc/callback": {
+		"summary":     "Redirect back from the identity provider",
+		"operationId": "oidcCallback",
+		"parameters": []jsonObject{
+			{"name": "code", "in": "query", "schema": jsonObject{"type": "string"}},
+			{"name": "state", "in": "query", "schema": jsonObject{"type": "string"}},
+			{"name": "error", "in": "query", "schema": jsonObject{"type": "string"}},
+			{"name": "error_description", "in": "query", "schema": jsonObject{"type": "string"}},
+		},
+		"responses": jsonObject{
+			"200":     envelopeResponse("Logged in successfully", jsonObject{"$ref": "#/components/schemas/TokenPair"}),
+			"default": errorResponse(),
+		},
+	},
+}
+
+func statusSchema() jsonObject {
+	return jsonObject{"type": "object", "properties": jsonObject{"status": jsonObject{"type": "string"}}}
+}
+
+func pathParameter(name string, schema jsonObject) jsonObject {
+	return jsonObject{"name": name, "in": "path", "required": true, "schema": schema}
+}
+
+// Response with the envelope, data is described by the given schema
+func envelopeResponse(description string, data jsonObject) jsonObject {
+	schema := jsonObject{"$ref": "#/components/schemas/Response"}
+	if data != nil {
+		schema = jsonObject{"allOf": []jsonObject{schema, {"type": "object", "properties": jsonObject{"data": data}}}}
+	}
+	return jsonObject{"description": description, "content": jsonObject{"application/json": jsonObject{"schema": schema}}}
+}
+
+func errorResponse() jsonObject {
+	return envelopeResponse("Error, see code and details", nil)
+}
+
+// Builds the schemas of Go types, named structs are added to the components
+type schemaBuilder struct {
+	schemas jsonObject
+}
+
+func (b *schemaBuilder) schemaOf(t reflect.Type) jsonObject {
+	switch t {
+	case reflect.TypeOf(uuid.UUID{}):
+		return jsonObject{"type": "string", "format": "uuid"}
+	case reflect.TypeOf(time.Time{}):
+		return jsonObject{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return jsonObject{}
+	case reflect.TypeOf(ErrorCode("")):
+		return jsonObject{"type": "string", "enum": []ErrorCode{
+			CodeValidation, CodeInvalidRef, CodeUnauthorized, CodeForbidden, CodeNotFound,
+			CodeConflict, CodePayloadTooLarge, CodeRateLimited, CodeInternal,
+		}}
+	case reflect.TypeOf(UserRef{}):
+		// Users are referenced by id, email or phone number, or by an object
+		return jsonObject{"oneOf": []jsonObject{
+			{"type": "string", "description": "User id, email or phone number"},
+			b.structSchema(t),
+		}}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.schemaOf(t.Elem())
+	case reflect.Interface:
+		return jsonObject{}
+	case reflect.Bool:
+		return jsonObject{"type": "boolean"}
+	case reflect.String:
+		return jsonObject{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonObject{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonObject{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return jsonObject{"type": "string", "contentEncoding": "base64"}
+		}
+		return jsonObject{"type": "array", "items": b.schemaOf(t.Elem())}
+	case reflect.Map:
+		return jsonObject{"type": "object", "additionalProperties": b.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		name := schemaName(t)
+		if _, ok := b.schemas[name]; !ok {
+			// Registered before it is built, for the types referencing themselves
+			b.schemas[name] = jsonObject{}
+			b.schemas[name] = b.structSchema(t)
+		}
+		return jsonObject{"$ref": "#/components/schemas/" + name}
+	}
+	return jsonObject{}
+}
+
+// Name of a component schema, type arguments are appended, e.g. PageUser
+func schemaName(t reflect.Type) string {
+	name, typeArgs, found := strings.Cut(t.Name(), "[")
+	if !found {
+		return name
+	}
+	for _, typeArg := range strings.Split(strings.TrimSuffix(typeArgs, "]"), ",") {
+		name += typeArg[strings.LastIndex(typeArg, ".")+1:]
+	}
+	return name
+}
+
+// Object schema of the JSON fields of a struct, embedded structs are flattened
+func (b *schemaBuilder) structSchema(t reflect.Type) jsonObject {
+	properties := jsonObject{}
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" || !field.IsExported() {
+				continue
+			}
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+				addFields(fieldType)
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			schema := b.schemaOf(field.Type)
+			rules := strings.Split(field.Tag.Get("validate"), ",")
+			for _, rule := range rules {
+				if rule == "required" {
+					required = append(required, name)
+				}
+			}
+			properties[name] = withRules(schema, fieldType, rules)
+		}
+	}
+	addFields(t)
+	schema := jsonObject{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// Add the constraints of validate rules to a schema
+func withRules(schema jsonObject, t reflect.Type, rules []string) jsonObject {
+	if _, ok := schema["$ref"]; ok {
+		return schema
+	}
+	isString := schema["type"] == "string"
+	for _, rule := range rules {
+		tag, param, _ := strings.Cut(rule, "=")
+		switch tag {
+		case "email":
+			schema["format"] = "email"
+		case "oneof":
+			schema["enum"] = strings.Fields(param)
+		case "min", "max", "len":
+			var value float64
+			if _, err := fmt.Sscan(param, &value); err != nil {
+				continue
+			}
+			switch {
+			case isString && tag == "len":
+				schema["minLength"], schema["maxLength"] = value, value
+			case isString:
+				schema[tag+"Length"] = value
+			case schema["type"] == "array":
+				schema[tag+"Items"] = value
+			case tag != "len":
+				schema[map[string]string{"min": "minimum", "max": "maximum"}[tag]] = value
+			}
+		case "gt", "lt":
+			var value float64
+			if _, err := fmt.Sscan(param, &value); err == nil && t.Kind() != reflect.String {
+				schema[map[string]string{"gt": "exclusiveMinimum", "lt": "exclusiveMaximum"}[tag]] = value
+			}
+		}
+	}
+	return schema
+}
+
+// Parameters of the fields tagged path or query of a request type
+func (b *schemaBuilder) parameters(t reflect.Type) []jsonObject {
+	var parameters []jsonObject
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			parameters = append(parameters, b.parameters(field.Type)...)
+			continue
+		}
+		rules := strings.Split(field.Tag.Get("validate"), ",")
+		schema := withRules(b.schemaOf(field.Type), field.Type, rules)
+		if name := field.Tag.Get("path"); name != "" {
+			parameters = append(parameters, pathParameter(name, schema))
+		} else if name := field.Tag.Get("query"); name != "" {
+			if value := field.Tag.Get("default"); value != "" {
+				schema["default"] = value
+				if schema["type"] == "integer" {
+					var parsed int
+					fmt.Sscan(value, &parsed)
+					schema["default"] = parsed
+				}
+			}
+			parameter := jsonObject{"name": name, "in": "query", "schema": schema}
+			for _, rule := range rules {
+				if rule == "required" {
+					parameter["required"] = true
+				}
+			}
+			parameters = append(parameters, parameter)
+		}
+	}
+	return parameters
+}
+
+// Whether a request type has fields decoded from the JSON body
+func hasBody(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if hasBody(field.Type) {
+				return true
+			}
+			continue
+		}
+		if field.IsExported() && field.Tag.Get("json") != "-" {
+			return true
+		}
+	}
+	return false
+}
+
+// Operation of an Endpoint
+func (b *schemaBuilder) operation(method string, endpoint *Endpoint) jsonObject {
+	summary := endpoint.Operation
+	if summary != "" {
+		summary = strings.ToUpper(summary[:1]) + summary[1:]
+	}
+	operation := jsonObject{"summary": summary, "operationId": operationId(endpoint.Operation)}
+	if parameters := b.parameters(endpoint.Request); len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+	if method != http.MethodGet && hasBody(endpoint.Request) {
+		// The body can be left out when it has no required field and no Validate method
+		_, hasRequired := b.structSchema(endpoint.Request)["required"]
+		_, validates := reflect.New(endpoint.Request).Interface().(interface{ Validate() error })
+		operation["requestBody"] = jsonObject{
+			"required": hasRequired || validates,
+			"content":  jsonObject{"application/json": jsonObject{"schema": b.schemaOf(endpoint.Request)}},
+		}
+	}
+	var data jsonObject
+	if endpoint.Response.Kind() != reflect.Interface {
+		data = b.schemaOf(endpoint.Response)
+	}
+	description := "Success"
+	if endpoint.message != nil {
+		description = *endpoint.message
+	}
+	operation["responses"] = jsonObject{
+		fmt.Sprint(endpoint.Status): envelopeResponse(description, data),
+		"default":                   errorResponse(),
+	}
+	return operation
+}
+
+// Build the OpenAPI document of the routes of a router. Endpoints are described
+// from their request and response types, the other routes need an entry in
+// rawOperations: an error listing the routes without one is returned.
+// @param r *mux.Router: Router with every route registered
+// @return []byte: The OpenAPI document
+// @return error: The error if any
+func BuildOpenAPI(r *mux.Router) ([]byte, error) {
+	builder := &schemaBuilder{schemas: jsonObject{}}
+	builder.schemaOf(reflect.TypeOf(Response{}))
+	paths := jsonObject{}
+	operationIds := map[string]bool{}
+	// Routes already walked, versions are added before the legacy routes
+	seen := map[string]bool{}
+	var missing []string
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		handler := route.GetHandler()
+		template, err := route.GetPathTemplate()
+		if handler == nil || err != nil {
+			return nil
+		}
+		// The mock issuer is a development tool, not part of the API
+		if strings.HasPrefix(template, mockIssuerPath+"/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			missing = append(missing, "* "+template)
+			return nil
+		}
+		version, unversioned := SplitVersion(template)
+		for _, method := range methods {
+			seen[method+" "+template] = true
+			var operation jsonObject
+			if endpoint, ok := handler.(*Endpoint); ok {
+				operation = builder.operation(method, endpoint)
+			} else if raw, ok := rawOperations[method+" "+unversioned]; ok {
+				operation = jsonObject{}
+				for key, value := range raw {
+					operation[key] = value
+				}
+			} else {
+				missing = append(missing, method+" "+template)
+				continue
+			}
+			tag, _, _ := strings.Cut(strings.TrimPrefix(unversioned, "/"), "/")
+			if tag == "" {
+				tag = "health"
+			}
+			operation["tags"] = []string{tag}
+			id, _ := operation["operationId"].(string)
+			if id == "" {
+				id = operationId(method + " " + unversioned)
+			}
+			// Operations of the legacy version keep their ids, the other versions are prefixed
+			if version == "" && seen[method+" /"+LegacyVersion+unversioned] {
+				id += "Legacy"
+				operation["deprecated"] = true
+				operation["description"] = fmt.Sprintf("Deprecated alias of %s /%s%s", method, LegacyVersion, unversioned)
+			} else if version != "" && version != LegacyVersion {
+				id = version + strings.ToUpper(id[:1]) + id[1:]
+			}
+			if operationIds[id] {
+				return fmt.Errorf("openapi: duplicate operation id %s of %s %s", id, method, template)
+			}
+			operationIds[id] = true
+			operation["operationId"] = id
+			if IsPublicRoute(method, template) {
+				operation["security"] = []jsonObject{}
+			} else if method != http.MethodGet && method != http.MethodHead {
+				// Raw operations are shared by the versions, their parameters are copied
+				parameters, _ := operation["parameters"].([]jsonObject)
+				operation["parameters"] = append(parameters[:len(parameters):len(parameters)], jsonObject{"$ref": "#/components/parameters/IdempotencyKey"})
+			}
+			pathItem, _ := paths[template].(jsonObject)
+			if pathItem == nil {
+				pathItem = jsonObject{}
+				paths[template] = pathItem
+			}
+			pathItem[strings.ToLower(method)] = operation
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("openapi: routes without a spec entry: %s", strings.Join(missing, ", "))
+	}
+	builder.schemaOf(reflect.TypeOf(TokenPair{}))
+	return json.Marshal(jsonObject{
+		"openapi": "3.1.0",
+		"info": jsonObject{
+			"title":   "Splitwise API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": jsonObject{
+			"schemas": builder.schemas,
+			"parameters": jsonObject{
+				"IdempotencyKey": jsonObject{
+					"name":        IdempotencyKeyHeader,
+					"in":          "header",
+					"schema":      jsonObject{"type": "string", "maxLength": maxIdempotencyKeyLength},
+					"description": "Key making the request safe to retry: the first response is replayed to the retries with the same body, marked by the Idempotent-Replayed header",
+				},
+			},
+			"securitySchemes": jsonObject{
+				"bearerAuth": jsonObject{"type": "http", "scheme": "bearer", "description": "Access token or API key"},
+			},
+		},
+		"security": []jsonObject{{"bearerAuth": []string{}}},
+	})
+}
+
+// Operation id in camel case, e.g. get dashboard is getDashboard and
+// GET /auth/oidc/login is getAuthOidcLogin
+func operationId(name string) string {
+	id := ""
+	for i, word := range strings.FieldsFunc(name, func(c rune) bool { return strings.ContainsRune(" /{}-._", c) }) {
+		if i == 0 {
+			id += strings.ToLower(word)
+		} else {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return id
+}
+
+// Docs page loading the embedded Redoc bundle, the pinned release of the CDN
+// when the bundle was not fetched
+func docsPage() ([]byte, []byte, error) {
+	page, err := template.ParseFS(docsFS, "docs/index.html")
+	if err != nil {
+		return nil, nil, err
+	}
+	bundle, err := fs.ReadFile(docsFS, redocBundle)
+	script := RedocPath
+	if err != nil {
+		Log.Warn(fmt.Sprintf("redoc bundle not embedded, the docs page loads redoc %s from its CDN, run go generate to embed it", redocVersion))
+		script, bundle = "https://cdn.jsdelivr.net/npm/redoc@"+redocVersion+"/bundles/redoc.standalone.js", nil
+	}
+	var html bytes.Buffer
+	if err := page.Execute(&html, map[string]string{"SpecURL": OpenAPIPath, "Script": script}); err != nil {
+		return nil, nil, err
+	}
+	return html.Bytes(), bundle, nil
+}
+
+// Add the OpenAPI document and docs page routes. It should be called once
+// every other route is registered, startup fails if one is not in the document.
+func OpenAPIRouter(r *mux.Router) error {
+	page, bundle, err := docsPage()
+	if err != nil {
+		Log.Error(fmt.Sprintf("docs page error: %s", err.Error()))
+		return err
+	}
+	var spec []byte
+	r.HandleFunc(OpenAPIPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	}).Methods("GET")
+	r.HandleFunc(DocsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	}).Methods("GET")
+	if bundle != nil {
+		r.HandleFunc(RedocPath, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+			w.Write(bundle)
+		}).Methods("GET")
+	}
+	if spec, err = BuildOpenAPI(r); err != nil {
+		Log.Error(fmt.Sprintf("openapi build error: %s", err.Error()))
+		return err
+	}
+	return nil
+}
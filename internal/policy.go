@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// Returned when the caller is not allowed to perform an action
+var ErrForbidden = errors.New("forbidden")
+
+type Action string
+
+const (
+	ActionExpenseCreate  Action = "expense:create"
+	ActionExpenseRead    Action = "expense:read"
+	ActionBalanceRead    Action = "balance:read"
+	ActionBalanceSettle  Action = "balance:settle"
+	ActionPaymentConfirm Action = "payment:confirm"
+	ActionUserRead       Action = "user:read"
+	ActionUserContact    Action = "user:contact"
+	ActionUserManage     Action = "user:manage"
+	ActionAdmin          Action = "admin"
+)
+
+// Resource an action is performed on. Owner is the user the resource belongs
+// to, e.g. the lender of an expense or the creditor of a balance, and
+// Participants are the other users involved in it.
+type Resource struct {
+	Owner        uuid.UUID
+	Participants []uuid.UUID
+}
+
+// Structured error returned when a policy denies an action
+type PolicyError struct {
+	Action Action `json:"action"`
+	Reason string `json:"reason"`
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("forbidden: %s: %s", e.Action, e.Reason)
+}
+
+func (e *PolicyError) Is(target error) bool {
+	return target == ErrForbidden
+}
+
+type rule func(user *User, resource Resource) string
+
+func isOwner(user *User, resource Resource) string {
+	if user.UId != resource.Owner {
+		return "only the owner is allowed"
+	}
+	return ""
+}
+
+func isParticipant(user *User, resource Resource) string {
+	if user.UId != resource.Owner && !slices.Contains(resource.Participants, user.UId) {
+		return "only participants are allowed"
+	}
+	return ""
+}
+
+func isAuthenticated(user *User, resource Resource) string {
+	return ""
+}
+
+func isAdmin(user *User, resource Resource) string {
+	if !user.IsAdmin {
+		return "only administrators are allowed"
+	}
+	return ""
+}
+
+// Rule of every action
+var policies = map[Action]rule{
+	ActionExpenseCreate:  isParticipant,
+	ActionExpenseRead:    isParticipant,
+	ActionBalanceRead:    isParticipant,
+	ActionBalanceSettle:  isOwner,
+	ActionPaymentConfirm: isOwner,
+	ActionUserRead:       isAuthenticated,
+	ActionUserContact:    isParticipant,
+	ActionUserManage:     isOwner,
+	ActionAdmin:          isAdmin,
+}
+
+// Check that the caller of the request is allowed to perform the action on the resource.
+// API keys act for a service rather than a user, so only their scopes are checked.
+// @param ctx context.Context: Request context holding the authenticated caller
+// @param action Action: The action to perform
+// @param resource Resource: The resource the action is performed on
+// @return error: ErrUnauthorized for anonymous callers, a *PolicyError when denied
+func Authorize(ctx context.Context, action Action, resource Resource) error {
+	err := authorize(ctx, action, resource)
+	if policyErr, ok := err.(*PolicyError); ok {
+		principal := PrincipalFromContext(ctx)
+		if principal.ApiKey != nil {
+			Log.Warn(fmt.Sprintf("api key: %s denied %s: %s", principal.ApiKey.KId, action, policyErr.Reason))
+		} else {
+			Log.Warn(fmt.Sprintf("user: %s denied %s: %s", principal.User.UId, action, policyErr.Reason))
+		}
+	}
+	return err
+}
+
+// Whether the caller is allowed to perform the action, for the checks where a
+// denial is expected and is not logged
+func Allowed(ctx context.Context, action Action, resource Resource) bool {
+	return authorize(ctx, action, resource) == nil
+}
+
+func authorize(ctx context.Context, action Action, resource Resource) error {
+	principal := PrincipalFromContext(ctx)
+	if principal == nil || (principal.User == nil && principal.ApiKey == nil) {
+		return fmt.Errorf("%w: authentication required", ErrUnauthorized)
+	}
+	policy, ok := policies[action]
+	if !ok {
+		return &PolicyError{Action: action, Reason: "unknown action"}
+	}
+	if principal.ApiKey != nil {
+		if scope := actionScopes[action]; !principal.ApiKey.HasScope(scope) {
+			return &PolicyError{Action: action, Reason: fmt.Sprintf("api key lacks scope %s", scope)}
+		}
+		return nil
+	}
+	if reason := policy(principal.User, resource); reason != "" {
+		return &PolicyError{Action: action, Reason: reason}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAuthorize(t *testing.T) {
+	owner := NewUser("Ann", "ann@example.com", "")
+	participant := NewUser("Bob", "bob@example.com", "")
+	stranger := NewUser("Eve", "eve@example.com", "")
+	admin := NewUser("Root", "root@example.com", "")
+	admin.IsAdmin = true
+	resource := Resource{Owner: owner.UId, Participants: []uuid.UUID{participant.UId}}
+
+	principals := []struct {
+		name string
+		ctx  context.Context
+	}{
+		{"owner", userContext(owner)},
+		{"participant", userContext(participant)},
+		{"stranger", userContext(stranger)},
+		{"admin", userContext(admin)},
+		{"anonymous", context.Background()},
+		{"empty principal", ContextWithPrincipal(context.Background(), &Principal{})},
+	}
+	// Error of every principal above, in order
+	tests := []struct {
+		action Action
+		errs   []error
+	}{
+		{ActionExpenseCreate, []error{nil, nil, ErrForbidden, ErrForbidden, ErrUnauthorized, ErrUnauthorized}},
+		{ActionExpenseRead, []error{nil, nil, ErrForbidden, ErrForbidden, ErrUnauthorized, ErrUnauthorized}},
+		{ActionBalanceRead, []error{nil, nil, ErrForbidden, ErrForbidden, ErrUnauthorized, ErrUnauthorized}},
+		{ActionBalanceSettle, []error{nil, ErrForbidden, ErrForbidden, ErrForbidden, ErrUnauthorized, ErrUnauthorized}},
+		{ActionPaymentConfirm, []error{nil, ErrForbidden, ErrForbidden, ErrForbidden, ErrUnauthorized, ErrUnauthorized}},
+		{ActionUserRead, []error{nil, nil, nil, nil, ErrUnauthorized, ErrUnauthorized}},
+		{ActionUserContact, []error{nil, nil, ErrForbidden, ErrForbidden, ErrUnauthorized, ErrUnauthorized}},
+		{ActionUserManage, []error{nil, ErrForbidden, ErrForbidden, ErrForbidden, ErrUnauthorized, ErrUnauthorized}},
+		{ActionAdmin, []error{ErrForbidden, ErrForbidden, ErrForbidden, nil, ErrUnauthorized, ErrUnauthorized}},
+		{Action("unknown"), []error{ErrForbidden, ErrForbidden, ErrForbidden, ErrForbidden, ErrUnauthorized, ErrUnauthorized}},
+	}
+	for _, test := range tests {
+		for i, principal := range principals {
+			t.Run(string(test.action)+"/"+principal.name, func(t *testing.T) {
+				assertAuthorized(t, principal.ctx, test.action, resource, test.errs[i])
+			})
+		}
+	}
+}
+
+func TestAuthorizeApiKey(t *testing.T) {
+	// API keys are not users, so neither the owner nor the participants matter
+	resource := Resource{Owner: GenerateUUIdV6()}
+	var scopes []string
+	for _, scope := range actionScopes {
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	for action, scope := range actionScopes {
+		others := slices.DeleteFunc(slices.Clone(scopes), func(s string) bool { return s == scope })
+		tests := []struct {
+			name   string
+			scopes []string
+			err    error
+		}{
+			{"with scope", []string{scope}, nil},
+			{"without scope", others, ErrForbidden},
+			{"no scopes", nil, ErrForbidden},
+		}
+		for _, test := range tests {
+			t.Run(string(action)+"/"+test.name, func(t *testing.T) {
+				ctx := ContextWithPrincipal(context.Background(), &Principal{ApiKey: &ApiKey{KId: GenerateUUIdV6(), Scopes: test.scopes}})
+				assertAuthorized(t, ctx, action, resource, test.err)
+			})
+		}
+	}
+}
+
+func assertAuthorized(t *testing.T, ctx context.Context, action Action, resource Resource, want error) {
+	t.Helper()
+	err := Authorize(ctx, action, resource)
+	if !errors.Is(err, want) || (want == nil) != (err == nil) {
+		t.Fatalf("authorize error = %v, want %v", err, want)
+	}
+	var policyErr *PolicyError
+	if errors.Is(want, ErrForbidden) && (!errors.As(err, &policyErr) || policyErr.Action != action || policyErr.Reason == "") {
+		t.Errorf("authorize error = %#v, want a policy error of %s", err, action)
+	}
+	if allowed := Allowed(ctx, action, resource); allowed != (want == nil) {
+		t.Errorf("allowed = %v, want %v", allowed, want == nil)
+	}
+}
@@ -0,0 +1,349 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Budget of a token bucket: Requests can be made in a burst, and the bucket
+// refills at Requests per Window. A zero budget disables the limit.
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// Parse a budget of the form <requests>/<window>, e.g. 120/1m
+func ParseRateLimit(value string) (RateLimit, error) {
+	if value == "0" || value == "off" {
+		return RateLimit{}, nil
+	}
+	requests, window, found := strings.Cut(value, "/")
+	limit := RateLimit{}
+	var err error
+	if limit.Requests, err = strconv.Atoi(requests); err != nil || !found || limit.Requests < 0 {
+		return limit, fmt.Errorf("invalid rate limit %q, expected <requests>/<window>", value)
+	}
+	if limit.Window, err = time.ParseDuration(window); err != nil || limit.Window <= 0 {
+		return limit, fmt.Errorf("invalid rate limit window %q", window)
+	}
+	return limit, nil
+}
+
+// Parse a comma separated list of addresses or CIDRs, e.g. 10.0.0.0/8,192.0.2.1
+func ParseTrustedProxies(value string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		addr = addr.Unmap()
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Requests > 0
+}
+
+// Tokens added per second
+func (l RateLimit) rate() float64 {
+	return float64(l.Requests) / l.Window.Seconds()
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Rate limiter with token buckets per client IP, API key and user. Writes
+// also take from a separate, smaller budget per caller. The IP buckets are
+// taken before authentication by IPMiddleware, the others after it by Middleware.
+type RateLimiter struct {
+	ip         RateLimit
+	user       RateLimit
+	apiKey     RateLimit
+	write      RateLimit
+	trustProxy bool
+	// Proxies whose X-Forwarded-For entries are skipped, the peer only when empty
+	trustedProxies []netip.Prefix
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// Rate limiter configured by the environment, with the defaults in brackets:
+// RATE_LIMIT_IP (300/1m), RATE_LIMIT_USER (600/1m), RATE_LIMIT_API_KEY (1200/1m),
+// RATE_LIMIT_WRITE (60/1m), TRUST_PROXY_HEADERS to use X-Forwarded-For and
+// TRUSTED_PROXIES, the comma separated addresses or CIDRs of the proxies in front
+// of the server when there are several
+func RateLimiterFromEnv() (*RateLimiter, error) {
+	rl := &RateLimiter{buckets: map[string]*tokenBucket{}, trustProxy: os.Getenv("TRUST_PROXY_HEADERS") == "true"}
+	proxies, err := ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		Log.Error(fmt.Sprintf("rate limiter init error: TRUSTED_PROXIES: %s", err.Error()))
+		return nil, err
+	}
+	rl.trustedProxies = proxies
+	limits := []struct {
+		env      string
+		fallback string
+		limit    *RateLimit
+	}{
+		{"RATE_LIMIT_IP", "300/1m", &rl.ip},
+		{"RATE_LIMIT_USER", "600/1m", &rl.user},
+		{"RATE_LIMIT_API_KEY", "1200/1m", &rl.apiKey},
+		{"RATE_LIMIT_WRITE", "60/1m", &rl.write},
+	}
+	for _, l := range limits {
+		value := os.Getenv(l.env)
+		if value == "" {
+			value = l.fallback
+		}
+		limit, err := ParseRateLimit(value)
+		if err != nil {
+			Log.Error(fmt.Sprintf("rate limiter init error: %s: %s", l.env, err.Error()))
+			return nil, err
+		}
+		*l.limit = limit
+	}
+	return rl, nil
+}
+
+type rateLimitCheck struct {
+	key   string
+	limit RateLimit
+}
+
+// Result of the most restrictive bucket of a request
+type rateLimitResult struct {
+	allowed    bool
+	limit      RateLimit
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// Take a token from every bucket, or from none when any of them is empty
+func (rl *RateLimiter) take(checks []rateLimitCheck, now time.Time) *rateLimitResult {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.sweep(now)
+	var result *rateLimitResult
+	buckets := make([]*tokenBucket, len(checks))
+	allowed := true
+	for i, check := range checks {
+		bucket, ok := rl.buckets[check.key]
+		if !ok {
+			bucket = &tokenBucket{tokens: float64(check.limit.Requests), updated: now}
+			rl.buckets[check.key] = bucket
+		}
+		bucket.tokens = math.Min(float64(check.limit.Requests), bucket.tokens+now.Sub(bucket.updated).Seconds()*check.limit.rate())
+		bucket.updated = now
+		buckets[i] = bucket
+		if bucket.tokens < 1 {
+			allowed = false
+		}
+	}
+	for i, check := range checks {
+		bucket := buckets[i]
+		if allowed {
+			bucket.tokens--
+		}
+		remaining := int(math.Max(0, math.Floor(bucket.tokens)))
+		reset := time.Duration((float64(check.limit.Requests) - bucket.tokens) / check.limit.rate() * float64(time.Second))
+		retryAfter := time.Duration(0)
+		if bucket.tokens < 1 {
+			retryAfter = time.Duration((1 - bucket.tokens) / check.limit.rate() * float64(time.Second))
+		}
+		if result == nil || remaining < result.remaining || retryAfter > result.retryAfter {
+			result = &rateLimitResult{limit: check.limit, remaining: remaining, reset: reset, retryAfter: retryAfter}
+		}
+	}
+	if result != nil {
+		result.allowed = allowed
+	}
+	return result
+}
+
+// Drop the buckets that refilled, at most once a minute
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+	rl.lastSweep = now
+	longest := time.Duration(0)
+	for _, limit := range []RateLimit{rl.ip, rl.user, rl.apiKey, rl.write} {
+		longest = max(longest, limit.Window)
+	}
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.updated) > longest {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// IP address of the client. Behind trusted proxies it is the rightmost entry of
+// X-Forwarded-For not added by one of them, the entries on its left are set by
+// the client and cannot be trusted.
+func (rl *RateLimiter) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	// Without a list of proxies the peer is the only one
+	if !rl.trustProxy || (len(rl.trustedProxies) > 0 && !rl.isTrustedProxy(ip)) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !rl.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (rl *RateLimiter) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, proxy := range rl.trustedProxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func isWrite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// Result of the bucket of the client IP, kept for the headers of the caller buckets
+const rateLimitContextKey contextKey = "rateLimit"
+
+// Take a token from the bucket of a client IP
+// @return *rateLimitResult: The result of the bucket, nil when it is disabled
+func (rl *RateLimiter) checkIP(ip string) *rateLimitResult {
+	if !rl.ip.enabled() {
+		return nil
+	}
+	return rl.take([]rateLimitCheck{{key: "ip:" + ip, limit: rl.ip}}, time.Now())
+}
+
+// Take a token from the buckets of the caller of a request and of its writes.
+// Anonymous writes take from the write budget of their client IP.
+// @return *rateLimitResult: The most restrictive bucket, nil when no limit applies
+// @return string: The caller of the request
+func (rl *RateLimiter) checkCaller(ctx context.Context, ip string, write bool) (*rateLimitResult, string) {
+	caller := "ip:" + ip
+	var checks []rateLimitCheck
+	if principal := PrincipalFromContext(ctx); principal != nil && principal.User != nil {
+		caller = "user:" + principal.User.UId.String()
+		if rl.user.enabled() {
+			checks = append(checks, rateLimitCheck{key: caller, limit: rl.user})
+		}
+	} else if principal != nil && principal.ApiKey != nil {
+		caller = "key:" + principal.ApiKey.KId.String()
+		if rl.apiKey.enabled() {
+			checks = append(checks, rateLimitCheck{key: caller, limit: rl.apiKey})
+		}
+	}
+	if write && rl.write.enabled() {
+		checks = append(checks, rateLimitCheck{key: "write:" + caller, limit: rl.write})
+	}
+	if len(checks) == 0 {
+		return nil, caller
+	}
+	return rl.take(checks, time.Now()), caller
+}
+
+// Write the headers of the most restrictive bucket, and the error response
+// when the request is rejected
+// @return bool: Whether the request is allowed
+func writeRateLimit(w http.ResponseWriter, r *http.Request, result *rateLimitResult, caller string) bool {
+	if ipResult, _ := r.Context().Value(rateLimitContextKey).(*rateLimitResult); ipResult != nil && ipResult.remaining < result.remaining {
+		result = &rateLimitResult{allowed: result.allowed, limit: ipResult.limit, remaining: ipResult.remaining, reset: ipResult.reset, retryAfter: result.retryAfter}
+	}
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", result.limit.Requests, seconds(result.limit.Window)))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.limit.Requests))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(result.reset)))
+	if result.allowed {
+		return true
+	}
+	statusCode, resp := NewErrorResp(fmt.Errorf("%w: rate limit exceeded, retry later", ErrRateLimited))
+	Log.Warn(fmt.Sprintf("rate limit exceeded: %s %s %s", caller, r.Method, r.URL.Path))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, seconds(result.retryAfter))))
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(resp)
+	return false
+}
+
+// Middleware limiting the request rate per client IP. It should run before the
+// authentication middleware, so requests failing authentication are limited too.
+func (rl *RateLimiter) IPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := rl.clientIP(r)
+		result := rl.checkIP(ip)
+		if result == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if writeRateLimit(w, r, result, "ip:"+ip) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rateLimitContextKey, result)))
+		}
+	})
+}
+
+// Middleware limiting the request rate per caller and the writes. It should run
+// after the authentication middleware so the callers can be told apart.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, caller := rl.checkCaller(r.Context(), rl.clientIP(r), isWrite(r))
+		if result == nil || writeRateLimit(w, r, result, caller) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
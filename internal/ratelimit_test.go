@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatalf("parse trusted proxies: %v", err)
+	}
+	tests := []struct {
+		name       string
+		trustProxy bool
+		proxies    bool
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"proxy headers ignored", false, false, "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"no forwarded header", true, false, "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"single proxy", true, false, "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed entry of a single proxy", true, false, "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"spoofed entry of the trusted proxies", true, true, "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1, 192.0.2.1, 10.1.2.3"}, "198.51.100.1"},
+		{"several headers", true, true, "10.0.0.1:1234", []string{"1.2.3.4", "198.51.100.1", "10.1.2.3"}, "198.51.100.1"},
+		{"untrusted peer", true, true, "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"only trusted proxies", true, true, "10.0.0.1:1234", []string{"10.0.0.2, 192.0.2.1"}, "10.0.0.2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rl := &RateLimiter{trustProxy: test.trustProxy}
+			if test.proxies {
+				rl.trustedProxies = proxies
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, forwarded := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", forwarded)
+			}
+			if got := rl.clientIP(r); got != test.want {
+				t.Errorf("client ip = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, value := range []string{"10.0.0.0/33", "proxy.local", "10.0.0.1,,nope"} {
+		if _, err := ParseTrustedProxies(value); err == nil {
+			t.Errorf("parse %q: expected an error", value)
+		}
+	}
+	proxies, err := ParseTrustedProxies("")
+	if err != nil || len(proxies) != 0 {
+		t.Errorf("parse empty = %v, %v, want none", proxies, err)
+	}
+}
+
+func TestRateLimitBeforeAuthentication(t *testing.T) {
+	rl := &RateLimiter{buckets: map[string]*tokenBucket{}, ip: RateLimit{Requests: 2, Window: time.Minute}}
+	// Authentication rejecting every bearer token
+	rejected := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, "authenticate", ErrUnauthorized)
+	})
+	handler := rl.IPMiddleware(rl.Middleware(rejected))
+
+	var statuses []int
+	for range 3 {
+		r := httptest.NewRequest(http.MethodGet, "/v1/lender", nil)
+		r.RemoteAddr = "203.0.113.7:1234"
+		r.Header.Set("Authorization", "Bearer sk_garbage")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		statuses = append(statuses, w.Code)
+	}
+	want := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Fatalf("statuses = %v, want %v", statuses, want)
+		}
+	}
+}
+
+func TestRateLimitHeadersOfMostRestrictiveBucket(t *testing.T) {
+	rl := &RateLimiter{
+		buckets: map[string]*tokenBucket{},
+		ip:      RateLimit{Requests: 2, Window: time.Minute},
+		user:    RateLimit{Requests: 10, Window: time.Minute},
+	}
+	authenticated := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(ContextWithPrincipal(r.Context(), &Principal{User: NewUser("Ann", "", "")})))
+		})
+	}
+	handler := rl.IPMiddleware(authenticated(rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))))
+	r := httptest.NewRequest(http.MethodGet, "/v1/lender", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != "1" {
+		t.Errorf("headers = %v, want the IP bucket", w.Header())
+	}
+}
+
+func TestIPRateLimitInterceptorBeforeAuthentication(t *testing.T) {
+	rl := &RateLimiter{buckets: map[string]*tokenBucket{}, ip: RateLimit{Requests: 1, Window: time.Minute}}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 1234}})
+	info := &grpc.UnaryServerInfo{FullMethod: "/splitwise.v1.BalanceService/GetBalance"}
+	unauthenticated := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, ErrUnauthorized }
+
+	interceptor := ipRateLimitInterceptor(rl)
+	if _, err := interceptor(ctx, nil, info, unauthenticated); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("first call error = %v, want %v", err, ErrUnauthorized)
+	}
+	if _, err := interceptor(ctx, nil, info, unauthenticated); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("second call error = %v, want %v", err, ErrRateLimited)
+	}
+}
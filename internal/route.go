@@ -2,17 +2,15 @@ package internal
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
-	"strconv"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/mux"
 )
 
 type UserHandler struct {
-	service *UserService
+	service       *UserService
+	lenderService *LenderService
 }
 
 func NewUserHandler() (*UserHandler, error) {
@@ -21,92 +19,151 @@ func NewUserHandler() (*UserHandler, error) {
 		Log.Error(fmt.Sprintf("user service initialization error: %s", err.Error()))
 		return nil, err
 	}
-	return &UserHandler{service: userService}, nil
+	lenderService, err := LenderServiceInit()
+	if err != nil {
+		return nil, err
+	}
+	return &UserHandler{service: userService, lenderService: lenderService}, nil
 }
 
-func (h *UserHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	var statusCode int = http.StatusOK
-	var ctx context.Context = r.Context()
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		statusCode = http.StatusBadRequest
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("create user error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
+func (h *UserHandler) CreateUser(ctx context.Context, req *CreateUserRequest) (*User, error) {
+	return h.service.Add(&ctx, req.Name, req.Email, req.PhoneNo, req.Password)
+}
+
+func (h *UserHandler) UpdateUser(ctx context.Context, req *UpdateUserRequest) (*User, error) {
+	if err := Authorize(ctx, ActionUserManage, Resource{Owner: req.UId}); err != nil {
+		return nil, err
 	}
-	if err := h.service.Add(&ctx, user.Name, user.Email, user.PhoneNo); err != nil {
-		statusCode = http.StatusInternalServerError
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("create user error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
+	return h.service.Update(&ctx, req.UId, *req)
+}
+
+func (h *UserHandler) ListUsers(ctx context.Context, filter *UserFilter) (*Page[User], error) {
+	if err := Authorize(ctx, ActionUserRead, Resource{}); err != nil {
+		return nil, err
+	}
+	page, err := h.service.Search(&ctx, *filter)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]*User, len(page.Items))
+	for i := range page.Items {
+		users[i] = &page.Items[i]
 	}
-	w.WriteHeader(statusCode)
-	msg := "User added successfully"
-	json.NewEncoder(w).Encode(SuccessResp(&statusCode, &msg, nil))
+	return page, h.RedactContacts(ctx, users...)
 }
 
-func (h *UserHandler) GetUser(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	var params map[string]string = mux.Vars(r)
-	var statusCode int = http.StatusOK
-	var ctx context.Context = r.Context()
-	uidParsed, err := uuid.Parse(params["uid"])
+func (h *UserHandler) GetUser(ctx context.Context, req *UserPath) (*User, error) {
+	if err := Authorize(ctx, ActionUserRead, Resource{}); err != nil {
+		return nil, err
+	}
+	user, err := h.service.Get(&ctx, req.UId)
 	if err != nil {
-		statusCode = http.StatusBadRequest
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("get user error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
+		return nil, err
+	}
+	return user, h.RedactContacts(ctx, user)
+}
+
+// Strip the email and phone number of the users the caller shares no balance
+// or expense with, the users themselves and API keys reading users see them
+func (h *UserHandler) RedactContacts(ctx context.Context, users ...*User) error {
+	principal := PrincipalFromContext(ctx)
+	shared := map[uuid.UUID]bool{}
+	if principal != nil && principal.User != nil && len(users) > 0 {
+		ids := make([]uuid.UUID, len(users))
+		for i, user := range users {
+			ids[i] = user.UId
+		}
+		var err error
+		if shared, err = h.service.SharingWith(&ctx, principal.User.UId, ids); err != nil {
+			return err
+		}
+	}
+	for _, user := range users {
+		resource := Resource{Owner: user.UId}
+		if shared[user.UId] {
+			resource.Participants = []uuid.UUID{principal.User.UId}
+		}
+		if !Allowed(ctx, ActionUserContact, resource) {
+			user.Email, user.PhoneNo, user.EmailVerifiedAt, user.PhoneNoVerifiedAt = "", "", nil, nil
+		}
+	}
+	return nil
+}
+
+func (h *UserHandler) DeleteUser(ctx context.Context, req *UserPath) (interface{}, error) {
+	if err := Authorize(ctx, ActionUserManage, Resource{Owner: req.UId}); err != nil {
+		return nil, err
+	}
+	return nil, h.service.Delete(&ctx, req.UId)
+}
+
+func (h *UserHandler) GetDashboard(ctx context.Context, req *DashboardRequest) (*Dashboard, error) {
+	if err := Authorize(ctx, ActionUserManage, Resource{Owner: req.UId}); err != nil {
+		return nil, err
+	}
+	return h.lenderService.GetDashboard(&ctx, req.UId, req.Limit)
+}
+
+func (h *UserHandler) MergeUser(ctx context.Context, req *MergeUserRequest) (*User, error) {
+	// Administrators merge any placeholder, users the ones of their verified contact details
+	admin := Allowed(ctx, ActionAdmin, Resource{})
+	if !admin {
+		if err := Authorize(ctx, ActionUserManage, Resource{Owner: req.UId}); err != nil {
+			return nil, err
+		}
+	}
+	return h.service.Merge(&ctx, req.UId, req.PlaceholderId, !admin)
+}
+
+// Download the data of a user as a zip archive
+func (h *UserHandler) ExportUser(w http.ResponseWriter, r *http.Request) {
+	var ctx context.Context = r.Context()
+	var req UserPath
+	if err := Bind(r, &req); err != nil {
+		WriteError(w, "export user", err)
 		return
 	}
-	user, err := h.service.Get(&ctx, uidParsed)
+	if err := Authorize(ctx, ActionUserManage, Resource{Owner: req.UId}); err != nil {
+		WriteError(w, "export user", err)
+		return
+	}
+	export, err := h.service.Export(&ctx, req.UId)
 	if err != nil {
-		statusCode = http.StatusInternalServerError
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("get user error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
+		WriteError(w, "export user", err)
 		return
 	}
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(SuccessResp(&statusCode, nil, user))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"user-%s-export.zip\"", req.UId))
+	w.WriteHeader(http.StatusOK)
+	if err := export.WriteArchive(w); err != nil {
+		Log.Error(fmt.Sprintf("export user error: %s", err.Error()))
+	}
 }
 
-func (h *UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	var statusCode int = http.StatusOK
-	var ctx context.Context = r.Context()
-	var params map[string]string = mux.Vars(r)
+func (h *UserHandler) EraseUser(ctx context.Context, req *UserPath) (*User, error) {
+	if err := Authorize(ctx, ActionUserManage, Resource{Owner: req.UId}); err != nil {
+		return nil, err
+	}
+	return h.service.Erase(&ctx, req.UId)
+}
 
-	uidParsed, err := uuid.Parse(params["uid"])
-	if err != nil {
-		statusCode = http.StatusBadRequest
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("delete user error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
+func (h *UserHandler) GetPreferences(ctx context.Context, req *UserPath) (*UserPreferences, error) {
+	if err := Authorize(ctx, ActionUserManage, Resource{Owner: req.UId}); err != nil {
+		return nil, err
 	}
-	if err := h.service.Delete(&ctx, uidParsed); err != nil {
-		statusCode = http.StatusInternalServerError
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("delete user error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
+	return h.service.GetPreferences(&ctx, req.UId)
+}
+
+func (h *UserHandler) UpdatePreferences(ctx context.Context, req *UpdatePreferencesRequest) (*UserPreferences, error) {
+	if err := Authorize(ctx, ActionUserManage, Resource{Owner: req.UId}); err != nil {
+		return nil, err
 	}
-	w.WriteHeader(statusCode)
-	msg := "User deleted successfully"
-	json.NewEncoder(w).Encode(SuccessResp(&statusCode, &msg, nil))
+	return h.service.UpdatePreferences(&ctx, req.UId, *req)
 }
 
 type ExpenseHandler struct {
-	service       *ExpenseService
-	lenderService *LenderService
+	service     *ExpenseService
+	userService *UserService
 }
 
 func NewExpenseHandler() (*ExpenseHandler, error) {
@@ -115,106 +172,57 @@ func NewExpenseHandler() (*ExpenseHandler, error) {
 		Log.Error(fmt.Sprintf("user service initialization error: %s", err.Error()))
 		return nil, err
 	}
-	lenderService, err := LenderServiceInit()
+	userService, err := UserServiceInit()
 	if err != nil {
 		return nil, err
 	}
-	return &ExpenseHandler{service: expenseService, lenderService: lenderService}, nil
+	return &ExpenseHandler{service: expenseService, userService: userService}, nil
 }
 
-func (es *ExpenseHandler) CreateExpense(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	var expenseRequest ExpenseRequest
-	var statusCode int = http.StatusOK
-	var ctx context.Context = r.Context()
-	if err := json.NewDecoder(r.Body).Decode(&expenseRequest); err != nil {
-		statusCode = http.StatusBadRequest
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("create expense error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
-	}
+func (es *ExpenseHandler) CreateExpense(ctx context.Context, expenseRequest *ExpenseRequest) (interface{}, error) {
+	_, err := es.AddExpense(ctx, expenseRequest)
+	return nil, err
+}
 
-	if err := Validate(expenseRequest); err != nil {
-		statusCode = http.StatusBadRequest
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("create expense error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
-	}
-	// Split the expense amount based on the type of expense
-	splitService, err := SplitServiceInit(expenseRequest)
-	if err != nil {
-		statusCode = http.StatusBadRequest
-		errMsg := "error: expenseType should be in equal, percent, exact"
-		Log.Error(fmt.Sprintf("create expense error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
-	}
-	expenseBorrowers := splitService.SplitAmount()
-
-	lenderId := expenseRequest.LenderId
-	expenseType := expenseRequest.Type
-	amount := expenseRequest.Amount
-	description := expenseRequest.Description
-	// Add Expense to Database
-	Log.Info("Adding Expense To Database")
-	if err := es.service.Add(&ctx, expenseType, amount, description, lenderId, expenseBorrowers); err != nil {
-		statusCode = http.StatusInternalServerError
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("create expense error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
+// Split an expense between its users and record what they owe the lender
+func (es *ExpenseHandler) AddExpense(ctx context.Context, expenseRequest *ExpenseRequest) (*Expense, error) {
+	if err := Authorize(ctx, ActionExpenseCreate, Resource{Owner: expenseRequest.LenderId, Participants: expenseRequest.UserIds()}); err != nil {
+		return nil, err
 	}
-	var lenders []*Lend
-	for _, expenseBorrower := range expenseBorrowers {
-		lenders = append(lenders, NewLender(lenderId, expenseBorrower.BorrowerId, expenseBorrower.Amount))
-	}
-	// Upsert the lenders to database
-	Log.Info("Upserting Lenders To Database")
-	if err := Parallelize(&ctx, es.lenderService.Upsert, lenders); err != nil {
-		statusCode = http.StatusInternalServerError
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("create expense error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
+
+	if expenseRequest.Type == "" {
+		preferences, err := es.userService.GetPreferences(&ctx, expenseRequest.LenderId)
+		if err != nil {
+			return nil, err
+		}
+		expenseRequest.Type = preferences.DefaultSplitType
 	}
 
-	w.WriteHeader(statusCode)
-	msg := "Expense added successfully"
-	json.NewEncoder(w).Encode(SuccessResp(&statusCode, &msg, nil))
+	if err := Validate(*expenseRequest); err != nil {
+		return nil, NewValidationError(err)
+	}
+	// Add the expense with its placeholder users, ledger entries and balances
+	return es.service.Add(&ctx, expenseRequest)
 }
 
-func (es *ExpenseHandler) GetExpense(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	var params map[string]string = mux.Vars(r)
-	var statusCode int = http.StatusOK
-	var ctx context.Context = r.Context()
-	uidParsed, err := ParseUUIDString(params["exId"])
+func (es *ExpenseHandler) GetExpense(ctx context.Context, req *ExpensePath) (*Expense, error) {
+	expense, err := es.service.Get(&ctx, req.ExId)
 	if err != nil {
-		statusCode = http.StatusBadRequest
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("get expense error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
+		return nil, err
 	}
-	expense, err := es.service.Get(&ctx, *uidParsed)
-	if err != nil {
-		statusCode = http.StatusInternalServerError
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("get expense error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
+	if err := Authorize(ctx, ActionExpenseRead, Resource{Owner: expense.LenderId, Participants: expense.Participants()}); err != nil {
+		return nil, err
 	}
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(SuccessResp(&statusCode, nil, expense))
+	// Render the timestamps in the time zone of the caller, API keys get UTC
+	expense.CreatedAt = expense.CreatedAt.UTC()
+	if principal := PrincipalFromContext(ctx); principal.User != nil {
+		preferences, err := es.userService.GetPreferences(&ctx, principal.User.UId)
+		if err != nil {
+			return nil, err
+		}
+		expense.CreatedAt = expense.CreatedAt.In(preferences.Location())
+	}
+	return expense, nil
 }
 
 type LenderHandler struct {
@@ -230,106 +238,232 @@ func NewLenderHandler() (*LenderHandler, error) {
 	return &LenderHandler{service: lenderService}, nil
 }
 
-func (lh *LenderHandler) GetBalance(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	var statusCode int = http.StatusOK
-	var ctx context.Context = r.Context()
-	queryParams := r.URL.Query()
-	userId1 := queryParams.Get("userId1")
-	userId2 := queryParams.Get("userId2")
-	userId1Parsed, err := ParseUUIDString(userId1)
+func (lh *LenderHandler) GetBalance(ctx context.Context, req *BalanceRequest) (*Lend, error) {
+	if err := Authorize(ctx, ActionBalanceRead, Resource{Participants: []uuid.UUID{req.UserId1, req.UserId2}}); err != nil {
+		return nil, err
+	}
+	if req.AsOf != nil {
+		return lh.service.GetBalanceAsOf(&ctx, req.UserId1, req.UserId2, *req.AsOf)
+	}
+	return lh.service.GetBalance(&ctx, req.UserId1, req.UserId2)
+}
+
+func (lh *LenderHandler) GetHistory(ctx context.Context, req *HistoryRequest) (*BalanceHistory, error) {
+	if err := Authorize(ctx, ActionBalanceRead, Resource{Participants: []uuid.UUID{req.UserId1, req.UserId2}}); err != nil {
+		return nil, err
+	}
+	return lh.service.GetHistory(&ctx, req.UserId1, req.UserId2, req.From, req.To)
+}
+
+func (lh *LenderHandler) GetLendSummary(ctx context.Context, req *LendSummaryPath) ([]*Lend, error) {
+	if err := Authorize(ctx, ActionBalanceRead, Resource{Owner: req.UserId}); err != nil {
+		return nil, err
+	}
+	return lh.service.GetLendSummary(&ctx, req.UserId)
+}
+
+func (lh *LenderHandler) UpdatePayment(ctx context.Context, req *PaymentRequest) (interface{}, error) {
+	if err := Authorize(ctx, ActionPaymentConfirm, Resource{Owner: req.LenderId, Participants: []uuid.UUID{req.BorrowerId}}); err != nil {
+		return nil, err
+	}
+	return nil, lh.service.UpdatePayment(&ctx, req.LenderId, req.BorrowerId, req.Amount)
+}
+
+func (lh *LenderHandler) SettleAll(ctx context.Context, settleRequest *SettleAllRequest) (*Settlement, error) {
+	// Only the creditor can confirm that everything was paid
+	lend, err := lh.service.GetBalance(&ctx, settleRequest.UserId1, settleRequest.UserId2)
 	if err != nil {
-		statusCode = http.StatusBadRequest
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("get balance error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
+		return nil, err
+	}
+	creditorId, debtorId := lend.LenderId, lend.BorrowerId
+	if lend.Amount < 0 {
+		creditorId, debtorId = debtorId, creditorId
 	}
-	userId2Parsed, err := ParseUUIDString(userId2)
+	if err := Authorize(ctx, ActionBalanceSettle, Resource{Owner: creditorId, Participants: []uuid.UUID{debtorId}}); err != nil {
+		return nil, err
+	}
+	return lh.service.SettleAll(&ctx, *settleRequest)
+}
+
+type AdminHandler struct {
+	lenderService *LenderService
+	apiKeyService *ApiKeyService
+}
+
+func NewAdminHandler() (*AdminHandler, error) {
+	lenderService, err := LenderServiceInit()
 	if err != nil {
-		statusCode = http.StatusBadRequest
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("get balance error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
+		Log.Error(fmt.Sprintf("lender service initialization error: %s", err.Error()))
+		return nil, err
 	}
-	lender, err := lh.service.GetBalance(&ctx, *userId1Parsed, *userId2Parsed)
+	apiKeyService, err := ApiKeyServiceInit()
 	if err != nil {
-		statusCode = http.StatusInternalServerError
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("get balance error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
+		Log.Error(fmt.Sprintf("api key service initialization error: %s", err.Error()))
+		return nil, err
 	}
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(SuccessResp(&statusCode, nil, lender))
+	return &AdminHandler{lenderService: lenderService, apiKeyService: apiKeyService}, nil
 }
 
-func (lh *LenderHandler) GetLendSummary(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	var params map[string]string = mux.Vars(r)
-	var statusCode int = http.StatusOK
-	var ctx context.Context = r.Context()
-	uidParsed, err := ParseUUIDString(params["userId"])
+// Report the drift between the lends and the ledger
+func (ah *AdminHandler) Reconcile(ctx context.Context, _ *Empty) (*ReconciliationReport, error) {
+	if err := Authorize(ctx, ActionAdmin, Resource{}); err != nil {
+		return nil, err
+	}
+	return ah.lenderService.Reconcile(&ctx, false)
+}
+
+// Report and repair the drift between the lends and the ledger
+func (ah *AdminHandler) Repair(ctx context.Context, _ *Empty) (*ReconciliationReport, error) {
+	if err := Authorize(ctx, ActionAdmin, Resource{}); err != nil {
+		return nil, err
+	}
+	return ah.lenderService.Reconcile(&ctx, true)
+}
+
+func (ah *AdminHandler) RebuildLends(ctx context.Context, _ *Empty) ([]*Lend, error) {
+	if err := Authorize(ctx, ActionAdmin, Resource{}); err != nil {
+		return nil, err
+	}
+	return ah.lenderService.RebuildLends(&ctx)
+}
+
+// Create an API key, the secret is only returned in this response
+func (ah *AdminHandler) CreateApiKey(ctx context.Context, apiKeyRequest *ApiKeyRequest) (*ApiKeySecret, error) {
+	if err := Authorize(ctx, ActionAdmin, Resource{}); err != nil {
+		return nil, err
+	}
+	var createdBy *uuid.UUID
+	if principal := PrincipalFromContext(ctx); principal.User != nil {
+		createdBy = &principal.User.UId
+	}
+	return ah.apiKeyService.Create(&ctx, *apiKeyRequest, createdBy)
+}
+
+func (ah *AdminHandler) ListApiKeys(ctx context.Context, _ *Empty) ([]*ApiKey, error) {
+	if err := Authorize(ctx, ActionAdmin, Resource{}); err != nil {
+		return nil, err
+	}
+	return ah.apiKeyService.List(&ctx)
+}
+
+func (ah *AdminHandler) RevokeApiKey(ctx context.Context, req *ApiKeyPath) (*ApiKey, error) {
+	if err := Authorize(ctx, ActionAdmin, Resource{}); err != nil {
+		return nil, err
+	}
+	return ah.apiKeyService.Revoke(&ctx, req.KId)
+}
+
+// Replace the secret of an API key, the previous secret stops working immediately
+func (ah *AdminHandler) RotateApiKey(ctx context.Context, req *ApiKeyPath) (*ApiKeySecret, error) {
+	if err := Authorize(ctx, ActionAdmin, Resource{}); err != nil {
+		return nil, err
+	}
+	return ah.apiKeyService.Rotate(&ctx, req.KId)
+}
+
+type AuditHandler struct {
+	service *AuditService
+}
+
+func NewAuditHandler() (*AuditHandler, error) {
+	auditService, err := AuditServiceInit()
 	if err != nil {
-		statusCode = http.StatusBadRequest
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("get lend summary error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
-		return
+		Log.Error(fmt.Sprintf("audit service initialization error: %s", err.Error()))
+		return nil, err
 	}
-	lenders, err := lh.service.GetLendSummary(&ctx, *uidParsed)
+	return &AuditHandler{service: auditService}, nil
+}
+
+// List the audit log, filtered by the actorId, action, entityType, entityId,
+// requestId, from and to query parameters
+func (ah *AuditHandler) ListAudit(ctx context.Context, filter *AuditFilter) (*Page[AuditEntry], error) {
+	if err := Authorize(ctx, ActionAdmin, Resource{}); err != nil {
+		return nil, err
+	}
+	return ah.service.Search(&ctx, *filter)
+}
+
+type AuthHandler struct {
+	service *AuthService
+}
+
+func NewAuthHandler() (*AuthHandler, error) {
+	authService, err := AuthServiceInit()
+	if err != nil {
+		Log.Error(fmt.Sprintf("auth service initialization error: %s", err.Error()))
+		return nil, err
+	}
+	return &AuthHandler{service: authService}, nil
+}
+
+// Middleware authenticating the requests, see AuthService.Middleware
+func (ah *AuthHandler) Middleware(next http.Handler) http.Handler {
+	return ah.service.Middleware(next)
+}
+
+func (ah *AuthHandler) Login(ctx context.Context, loginRequest *LoginRequest) (*TokenPair, error) {
+	return ah.service.Login(&ctx, *loginRequest)
+}
+
+// Redirect to the identity provider. The optional loginHint query parameter is
+// passed on to prefill the email.
+func (ah *AuthHandler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	var ctx context.Context = r.Context()
+	authURL, stateToken, err := ah.service.OIDCLogin(&ctx, r.URL.Query().Get("loginHint"))
 	if err != nil {
-		statusCode = http.StatusInternalServerError
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("get lend summary error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
+		WriteError(w, "oidc login", err)
 		return
 	}
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(SuccessResp(&statusCode, nil, lenders))
+	http.SetCookie(w, &http.Cookie{
+		Name:  OIDCStateCookie,
+		Value: stateToken,
+		// Sent to the callback of every API version
+		Path:     "/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
 }
 
-func (lh *LenderHandler) UpdatePayment(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func (ah *AuthHandler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
 	var statusCode int = http.StatusOK
-	successMsg := "payment recieved"
 	var ctx context.Context = r.Context()
-	queryParams := r.URL.Query()
-	lId := queryParams.Get("lenderId")
-	bId := queryParams.Get("borrowerId")
-	lIdParsed, err1 := ParseUUIDString(lId)
-	bIdParsed, err2 := ParseUUIDString(bId)
-	if err1 != nil || err2 != nil {
-		statusCode = http.StatusBadRequest
-		errMsg := "error: invalid lenderId or borrowerId"
-		Log.Error(fmt.Sprintf("update expense error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
+	var req OIDCCallbackRequest
+	// The login state can only be used once
+	http.SetCookie(w, &http.Cookie{Name: OIDCStateCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	if err := Bind(r, &req); err != nil {
+		WriteError(w, "oidc callback", err)
 		return
 	}
-	amount, err := strconv.ParseFloat(queryParams.Get("amount"), 64)
-	if err != nil {
-		statusCode = http.StatusBadRequest
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("update expense error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
+	if req.Error != "" {
+		WriteError(w, "oidc callback", fmt.Errorf("%w: %s %s", ErrUnauthorized, req.Error, req.ErrorDescription))
+		return
+	}
+	cookie, err := r.Cookie(OIDCStateCookie)
+	if err != nil || req.Code == "" {
+		WriteError(w, "oidc callback", Invalidf("code and login state cookie are required"))
 		return
 	}
-	if err = lh.service.UpdatePayment(&ctx, *lIdParsed, *bIdParsed, amount); err != nil {
-		statusCode = http.StatusInternalServerError
-		errMsg := err.Error()
-		Log.Error(fmt.Sprintf("update expense error: %s", errMsg))
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(ErrorResp(&statusCode, &errMsg, nil))
+	tokens, err := ah.service.OIDCCallback(&ctx, req.Code, req.State, cookie.Value)
+	if err != nil {
+		WriteError(w, "oidc callback", err)
 		return
 	}
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(SuccessResp(&statusCode, &successMsg, nil))
+	w.Header().Set("Cache-Control", "no-store")
+	msg := "Logged in successfully"
+	WriteJSON(w, statusCode, SuccessResp(&statusCode, &msg, tokens))
+}
+
+func (ah *AuthHandler) Refresh(ctx context.Context, refreshRequest *RefreshRequest) (*TokenPair, error) {
+	return ah.service.Refresh(&ctx, refreshRequest.RefreshToken)
+}
+
+func (ah *AuthHandler) Logout(ctx context.Context, logoutRequest *LogoutRequest) (interface{}, error) {
+	return nil, ah.service.Logout(&ctx, PrincipalFromContext(ctx), logoutRequest.All)
+}
+
+func (ah *AuthHandler) ChangePassword(ctx context.Context, passwordRequest *ChangePasswordRequest) (interface{}, error) {
+	return nil, ah.service.ChangePassword(&ctx, PrincipalFromContext(ctx), *passwordRequest)
 }
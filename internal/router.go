@@ -1,23 +1,73 @@
 package internal
 
-import "github.com/gorilla/mux"
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
 
 func UserRouter(r *mux.Router, handler UserHandler) {
 	userRoute := r.PathPrefix("/user").Subrouter()
-	userRoute.HandleFunc("", handler.CreateUser).Methods("POST")
-	userRoute.HandleFunc("/{uid}", handler.GetUser).Methods("GET")
-	userRoute.HandleFunc("/{uid}", handler.DeleteUser).Methods("DELETE")
+	userRoute.Handle("", Handle("create user", handler.CreateUser, WithMessage("User added successfully"))).Methods("POST")
+	userRoute.Handle("", Handle("list users", handler.ListUsers)).Methods("GET")
+	userRoute.Handle("/{uid}", Handle("get user", handler.GetUser)).Methods("GET")
+	userRoute.Handle("/{uid}", Handle("update user", handler.UpdateUser, WithMessage("User updated successfully"))).Methods("PATCH")
+	userRoute.Handle("/{uid}/dashboard", Handle("get dashboard", handler.GetDashboard)).Methods("GET")
+	userRoute.Handle("/{uid}/merge", Handle("merge user", handler.MergeUser, WithMessage("User merged successfully"))).Methods("POST")
+	userRoute.HandleFunc("/{uid}/export", handler.ExportUser).Methods("GET")
+	userRoute.Handle("/{uid}/erase", Handle("erase user", handler.EraseUser, WithMessage("User personal data erased"))).Methods("POST")
+	userRoute.Handle("/{uid}/preferences", Handle("get preferences", handler.GetPreferences)).Methods("GET")
+	userRoute.Handle("/{uid}/preferences", Handle("update preferences", handler.UpdatePreferences, WithMessage("Preferences updated successfully"))).Methods("PATCH")
+	userRoute.Handle("/{uid}", Handle("delete user", handler.DeleteUser, WithMessage("User deleted successfully"))).Methods("DELETE")
 }
 
 func ExpenseRouter(r *mux.Router, handler ExpenseHandler) {
 	expenseRoute := r.PathPrefix("/expense").Subrouter()
-	expenseRoute.HandleFunc("", handler.CreateExpense).Methods("POST")
-	expenseRoute.HandleFunc("/{exId}", handler.GetExpense).Methods("GET")
+	expenseRoute.Handle("", Handle("create expense", handler.CreateExpense, WithMessage("Expense added successfully"))).Methods("POST")
+	expenseRoute.Handle("/{exId}", Handle("get expense", handler.GetExpense)).Methods("GET")
 }
 
 func LenderRouter(r *mux.Router, handler LenderHandler) {
 	lenderRoute := r.PathPrefix("/lender").Subrouter()
-	lenderRoute.HandleFunc("", handler.GetBalance).Methods("GET")
-	lenderRoute.HandleFunc("/{userId}", handler.GetLendSummary).Methods("GET")
-	lenderRoute.HandleFunc("", handler.UpdatePayment).Methods("PUT")
+	lenderRoute.Handle("", Handle("get balance", handler.GetBalance)).Methods("GET")
+	lenderRoute.Handle("/history", Handle("get history", handler.GetHistory)).Methods("GET")
+	lenderRoute.Handle("/{userId}", Handle("get lend summary", handler.GetLendSummary)).Methods("GET")
+	lenderRoute.Handle("", Handle("update payment", handler.UpdatePayment, WithMessage("payment recieved"))).Methods("PUT")
+	lenderRoute.Handle("/settle-all", Handle("settle all", handler.SettleAll, WithMessage("Settled up successfully"))).Methods("POST")
+}
+
+func AdminRouter(r *mux.Router, handler AdminHandler) {
+	adminRoute := r.PathPrefix("/admin").Subrouter()
+	adminRoute.Handle("/reconcile", Handle("reconcile", handler.Reconcile, WithMessage("Reconciliation completed"))).Methods("GET")
+	adminRoute.Handle("/reconcile", Handle("repair lends", handler.Repair, WithMessage("Reconciliation completed"))).Methods("POST")
+	adminRoute.Handle("/rebuild-lends", Handle("rebuild lends", handler.RebuildLends, WithMessage("Lends rebuilt from ledger"))).Methods("POST")
+	adminRoute.Handle("/api-keys", Handle("create api key", handler.CreateApiKey,
+		WithStatus(http.StatusCreated),
+		WithMessage("API key created, store the key as it is not shown again"),
+		WithHeader("Cache-Control", "no-store"),
+	)).Methods("POST")
+	adminRoute.Handle("/api-keys", Handle("list api keys", handler.ListApiKeys)).Methods("GET")
+	adminRoute.Handle("/api-keys/{kId}", Handle("revoke api key", handler.RevokeApiKey, WithMessage("API key revoked"))).Methods("DELETE")
+	adminRoute.Handle("/api-keys/{kId}/rotate", Handle("rotate api key", handler.RotateApiKey,
+		WithMessage("API key rotated, store the key as it is not shown again"),
+		WithHeader("Cache-Control", "no-store"),
+	)).Methods("POST")
+}
+
+func AuditRouter(r *mux.Router, handler AuditHandler) {
+	r.Handle("/audit", Handle("list audit", handler.ListAudit)).Methods("GET")
+}
+
+func AuthRouter(r *mux.Router, handler AuthHandler) {
+	authRoute := r.PathPrefix("/auth").Subrouter()
+	authRoute.Handle("/login", Handle("login", handler.Login, WithMessage("Logged in successfully"), WithHeader("Cache-Control", "no-store"))).Methods("POST")
+	authRoute.Handle("/refresh", Handle("refresh", handler.Refresh, WithHeader("Cache-Control", "no-store"))).Methods("POST")
+	authRoute.Handle("/logout", Handle("logout", handler.Logout, WithMessage("Logged out successfully"))).Methods("POST")
+	authRoute.Handle("/password", Handle("change password", handler.ChangePassword, WithMessage("Password changed successfully"))).Methods("PUT")
+	authRoute.HandleFunc("/oidc/login", handler.OIDCLogin).Methods("GET")
+	authRoute.HandleFunc("/oidc/callback", handler.OIDCCallback).Methods("GET")
+}
+
+func GraphQLRouter(r *mux.Router, handler *GraphQLHandler) {
+	r.Handle(GraphQLPath, handler).Methods("POST")
 }
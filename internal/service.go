@@ -2,12 +2,25 @@ package internal
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
+// Returned when a write would violate a uniqueness rule or the state of an entity
+var ErrConflict = errors.New("conflict")
+
+// Balances smaller than this are treated as settled
+const balanceEpsilon = 1e-6
+
 type LenderService struct {
 	dao IDao[Lend]
 }
@@ -58,42 +71,388 @@ func (ls *LenderService) GetLendSummary(ctx *context.Context, userId uuid.UUID)
 	if err != nil {
 		return nil, err
 	}
-	resp := dbClient.DbClient(ctx).Where("? = ? OR ? = ?", lenderIdFieldName, borrowerIdFieldName, userId, userId).Find(&lends)
+	resp := dbClient.DbClient(ctx).Where(lenderIdFieldName+" = ? OR "+borrowerIdFieldName+" = ?", userId, userId).Find(&lends)
 	return lends, resp.Error
 }
 
-func (ls *LenderService) UpdatePayment(ctx *context.Context, lenderId uuid.UUID, borrowerId uuid.UUID, amount float64) error {
-	es, err := ExpenseServiceInit()
-	if err != nil {
-		return err
+// Balances of several users with every other user, in a single query
+// @param ctx *context.Context: Context
+// @param userIds []uuid.UUID: The users
+// @return []*Lend: The balances the users are the lender or borrower of
+// @return error: The error if any
+func (ls *LenderService) GetLendSummaries(ctx *context.Context, userIds []uuid.UUID) ([]*Lend, error) {
+	var lends []*Lend
+	resp := ls.dao.Client(ctx).DbClient(ctx).Where("lender_id IN ? OR borrower_id IN ?", userIds, userIds).Find(&lends)
+	return lends, resp.Error
+}
+
+// Totals, per friend balances and recent activity of a user.
+// Balances are signed from the user's perspective.
+// @param ctx *context.Context: Context
+// @param userId uuid.UUID: The dashboard owner
+// @param limit int: Number of recent activities to return
+// @return *Dashboard
+// @return error: The error if any
+func (ls *LenderService) GetDashboard(ctx *context.Context, userId uuid.UUID, limit int) (*Dashboard, error) {
+	dbClient := ls.dao.Client(ctx).DbClient(ctx)
+	var users []User
+	if resp := dbClient.Where("uid = ?", userId).Find(&users); resp.Error != nil {
+		return nil, resp.Error
+	}
+	if len(users) == 0 {
+		return nil, NewNotFoundError("user", userId)
 	}
+	dashboard := &Dashboard{UserId: userId, Name: users[0].Name, Friends: []*FriendBalance{}, RecentActivity: []*Activity{}}
+
+	var lends []*Lend
+	resp := dbClient.Preload("Lender").Preload("Borrower").
+		Where("(lender_id = ? OR borrower_id = ?) AND amount <> 0", userId, userId).
+		Order("updated_at DESC").Find(&lends)
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	for _, lend := range lends {
+		friend, balance := lend.Borrower, lend.Amount
+		if lend.BorrowerId == userId {
+			friend, balance = lend.Lender, -lend.Amount
+		}
+		if balance > 0 {
+			dashboard.YouAreOwed += balance
+		} else {
+			dashboard.YouOwe -= balance
+		}
+		dashboard.Friends = append(dashboard.Friends, &FriendBalance{
+			UserId:    friend.UId,
+			Name:      friend.Name,
+			Balance:   balance,
+			UpdatedAt: lend.UpdatedAt,
+		})
+	}
+	dashboard.Net = dashboard.YouAreOwed - dashboard.YouOwe
+
+	var entries []*LedgerEntry
+	resp = dbClient.Preload("Lender").Preload("Borrower").
+		Where("lender_id = ? OR borrower_id = ?", userId, userId).
+		Order("created_at DESC").Limit(limit).Find(&entries)
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	for _, entry := range entries {
+		friend, amount := entry.Borrower, entry.Amount
+		if entry.BorrowerId == userId {
+			friend, amount = entry.Lender, -entry.Amount
+		}
+		dashboard.RecentActivity = append(dashboard.RecentActivity, &Activity{
+			Timestamp:  entry.CreatedAt,
+			Source:     entry.Source,
+			SourceId:   entry.SourceId,
+			FriendId:   friend.UId,
+			FriendName: friend.Name,
+			Amount:     amount,
+		})
+	}
+	return dashboard, nil
+}
+
+func (ls *LenderService) UpdatePayment(ctx *context.Context, lenderId uuid.UUID, borrowerId uuid.UUID, amount float64) error {
 	lend, err := ls.GetBalance(ctx, lenderId, borrowerId)
 	if err != nil {
 		return err
 	}
 	if lend.Amount != amount && lend.LenderId == lenderId {
-		return fmt.Errorf("amount mismatch error: amount due: %f", lend.Amount)
+		return InvalidField("amount", "eq", fmt.Sprintf("%f", lend.Amount), fmt.Sprintf("amount mismatch error: amount due: %f", lend.Amount))
 	} else if lend.Amount != -amount && lend.LenderId == borrowerId {
-		return fmt.Errorf("amount mismatch error: amount due: %f", -lend.Amount)
+		return InvalidField("amount", "eq", fmt.Sprintf("%f", -lend.Amount), fmt.Sprintf("amount mismatch error: amount due: %f", -lend.Amount))
 	}
 	dbClient := ls.dao.Client(ctx)
-	dbClient.StartSession(ctx)
-	resp := dbClient.DbClient(ctx).Model(lend).Update("amount", 0)
-	if resp.Error != nil {
-		dbClient.AbortSession()
-		return resp.Error
-	}
-	err = es.UpdatePayment(ctx, lenderId, borrowerId)
+	return dbClient.DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		// Taken before the update, which zeroes the amount of the model
+		paymentId := GenerateUUIdV6()
+		entry := NewLedgerEntry(LedgerSourcePayment, &paymentId, lend.LenderId, lend.BorrowerId, -lend.Amount)
+		resp := tx.Model(lend).Update("amount", 0)
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if resp := tx.Create(entry); resp.Error != nil {
+			return resp.Error
+		}
+		// The balance is netted, so shares owed in either direction are cleared
+		if err := markExpensesPaid(tx, lenderId, borrowerId); err != nil {
+			return err
+		}
+		return markExpensesPaid(tx, borrowerId, lenderId)
+	})
+}
+
+// Settle every outstanding obligation between two users in one transaction.
+// The pairwise balance is netted, recorded as a single settlement and all the
+// unpaid expense shares between the two users are marked as paid.
+// @param ctx *context.Context: Context
+// @param req SettleAllRequest: Users to settle and the rate of the paid currency
+// @return *Settlement: The recorded settlement
+// @return error: The error if any
+func (ls *LenderService) SettleAll(ctx *context.Context, req SettleAllRequest) (*Settlement, error) {
+	var settlement *Settlement
+	lId := GenerateUUIDFromUUIDs(req.UserId1, req.UserId2)
+	dbClient := ls.dao.Client(ctx)
+	err := dbClient.DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		var lends []Lend
+		resp := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("l_id = ?", lId).Find(&lends)
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if len(lends) == 0 || lends[0].Amount == 0 {
+			return fmt.Errorf("%w: nothing to settle between %s and %s", ErrConflict, req.UserId1, req.UserId2)
+		}
+		lend := lends[0]
+		// Positive amount means the borrower owes the lender
+		payerId, payeeId, amount := lend.BorrowerId, lend.LenderId, lend.Amount
+		if amount < 0 {
+			payerId, payeeId, amount = lend.LenderId, lend.BorrowerId, -amount
+		}
+		settlement = NewSettlement(payerId, payeeId, amount, req.Currency, req.Rate)
+		if resp := tx.Create(settlement); resp.Error != nil {
+			return resp.Error
+		}
+		// Taken before the update, which zeroes the amount of the model
+		entry := NewLedgerEntry(LedgerSourceSettlement, &settlement.SId, lend.LenderId, lend.BorrowerId, -lend.Amount)
+		if resp := tx.Model(&lend).Updates(map[string]interface{}{"amount": 0, "updated_at": settlement.CreatedAt}); resp.Error != nil {
+			return resp.Error
+		}
+		if resp := tx.Create(entry); resp.Error != nil {
+			return resp.Error
+		}
+		if err := markExpensesPaid(tx, req.UserId1, req.UserId2); err != nil {
+			return err
+		}
+		return markExpensesPaid(tx, req.UserId2, req.UserId1)
+	})
 	if err != nil {
-		dbClient.AbortSession()
-		return err
+		Log.Error(fmt.Sprintf("settle all error: %s", err.Error()))
+		return nil, err
+	}
+	Log.Info(fmt.Sprintf("settled: %+v", settlement))
+	return settlement, nil
+}
+
+// Apply ledger entries to their balances and append them to the ledger. The
+// balances are locked in the order of their ids so concurrent writes touching
+// the same users cannot deadlock.
+func recordLedgerEntries(tx *gorm.DB, entries []*LedgerEntry) error {
+	sorted := slices.Clone(entries)
+	slices.SortStableFunc(sorted, func(a, b *LedgerEntry) int {
+		return strings.Compare(a.LId.String(), b.LId.String())
+	})
+	for _, entry := range sorted {
+		if err := upsertLend(tx, entry.Lend()); err != nil {
+			return err
+		}
+		if resp := tx.Create(entry); resp.Error != nil {
+			return resp.Error
+		}
 	}
-	dbClient.CommitSession()
 	return nil
 }
 
-func (ls *LenderService) Upsert(ctx *context.Context, lend *Lend) error {
+// Balance between two users at a point in time, computed from the ledger.
+// The returned lend keeps the orientation of the current lend between the users.
+func (ls *LenderService) GetBalanceAsOf(ctx *context.Context, userId1 uuid.UUID, userId2 uuid.UUID, asOf time.Time) (*Lend, error) {
+	history, err := ls.GetHistory(ctx, userId1, userId2, nil, &asOf)
+	if err != nil {
+		return nil, err
+	}
+	lend := &Lend{LId: history.LId, LenderId: history.LenderId, BorrowerId: history.BorrowerId}
+	if n := len(history.Points); n > 0 {
+		lend.Amount = history.Points[n-1].Balance
+		lend.UpdatedAt = history.Points[n-1].Timestamp
+	}
+	return lend, nil
+}
+
+// Time series of the balance between two users, optionally bounded by from and to.
+// @param ctx *context.Context: Context
+// @param userId1 uuid.UUID:
+// @param userId2 uuid.UUID:
+// @param from *time.Time: Start of the series (inclusive), nil for the beginning
+// @param to *time.Time: End of the series (inclusive), nil for now
+// @return *BalanceHistory: Running balance after every ledger entry
+// @return error: The error if any
+func (ls *LenderService) GetHistory(ctx *context.Context, userId1 uuid.UUID, userId2 uuid.UUID, from *time.Time, to *time.Time) (*BalanceHistory, error) {
+	lend, err := ls.GetBalance(ctx, userId1, userId2)
+	if err != nil {
+		return nil, err
+	}
+	history := &BalanceHistory{
+		LId:        GenerateUUIDFromUUIDs(userId1, userId2),
+		LenderId:   lend.LenderId,
+		BorrowerId: lend.BorrowerId,
+		Points:     []*BalancePoint{},
+	}
+	if lend.LenderId == uuid.Nil {
+		history.LenderId, history.BorrowerId = userId1, userId2
+	}
+	var entries []LedgerEntry
+	query := ls.dao.Client(ctx).DbClient(ctx).Where("l_id = ?", history.LId)
+	if to != nil {
+		query = query.Where("created_at <= ?", *to)
+	}
+	if resp := query.Order("created_at").Find(&entries); resp.Error != nil {
+		Log.Error(fmt.Sprintf("get history error: %s", resp.Error.Error()))
+		return nil, resp.Error
+	}
+	balance := 0.0
+	for _, entry := range entries {
+		delta := entry.Amount
+		if entry.LenderId != history.LenderId {
+			delta = -delta
+		}
+		balance += delta
+		if from != nil && entry.CreatedAt.Before(*from) {
+			continue
+		}
+		history.Points = append(history.Points, &BalancePoint{
+			Timestamp: entry.CreatedAt,
+			Delta:     delta,
+			Balance:   balance,
+			Source:    entry.Source,
+			SourceId:  entry.SourceId,
+		})
+	}
+	return history, nil
+}
+
+// Rebuild every lend as a projection of the ledger
+// @param ctx *context.Context: Context
+// @return []*Lend: The rebuilt lends
+// @return error: The error if any
+func (ls *LenderService) RebuildLends(ctx *context.Context) ([]*Lend, error) {
+	var lends []*Lend
+	dbClient := ls.dao.Client(ctx)
+	err := dbClient.DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		var current []*Lend
+		if resp := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Find(&current); resp.Error != nil {
+			return resp.Error
+		}
+		projection := make(map[uuid.UUID]*Lend, len(current))
+		for _, lend := range current {
+			lend.Amount = 0
+			projection[lend.LId] = lend
+			lends = append(lends, lend)
+		}
+		var entries []LedgerEntry
+		if resp := tx.Order("created_at").Find(&entries); resp.Error != nil {
+			return resp.Error
+		}
+		for _, entry := range entries {
+			lend, ok := projection[entry.LId]
+			if !ok {
+				lend = NewLender(entry.LenderId, entry.BorrowerId, 0)
+				projection[entry.LId] = lend
+				lends = append(lends, lend)
+			}
+			if lend.LenderId == entry.LenderId {
+				lend.Amount += entry.Amount
+			} else {
+				lend.Amount -= entry.Amount
+			}
+			lend.UpdatedAt = entry.CreatedAt
+		}
+		for _, lend := range lends {
+			if resp := tx.Save(lend); resp.Error != nil {
+				return resp.Error
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Log.Error(fmt.Sprintf("rebuild lends error: %s", err.Error()))
+		return nil, err
+	}
+	return lends, nil
+}
+
+// Recompute every pairwise balance from the unpaid expense shares and compare
+// it with the recorded lends. When repair is set the lends are corrected and the
+// corrections are appended to the ledger in the same transaction.
+// @param ctx *context.Context: Context
+// @param repair bool: Whether to repair the discrepancies
+// @return *ReconciliationReport: Discrepancies per lend
+// @return error: The error if any
+func (ls *LenderService) Reconcile(ctx *context.Context, repair bool) (*ReconciliationReport, error) {
+	report := &ReconciliationReport{CheckedAt: time.Now().UTC(), Discrepancies: []*LendDiscrepancy{}}
 	dbClient := ls.dao.Client(ctx)
+	err := dbClient.DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		var lends []*Lend
+		query := tx
+		if repair {
+			query = tx.Clauses(clause.Locking{Strength: "UPDATE"})
+		}
+		if resp := query.Find(&lends); resp.Error != nil {
+			return resp.Error
+		}
+		var shares []struct {
+			LenderId   uuid.UUID
+			BorrowerId uuid.UUID
+			Amount     float64
+		}
+		resp := tx.Model(&ExpenseBorrower{}).
+			Select("expenses.lender_id, expense_borrowers.borrower_id, SUM(expense_borrowers.amount) AS amount").
+			Joins("JOIN expenses ON expense_borrowers.expense_id = expenses.ex_id").
+			Where("expense_borrowers.is_paid = ? AND expense_borrowers.borrower_id <> expenses.lender_id", false).
+			Group("expenses.lender_id, expense_borrowers.borrower_id").
+			Scan(&shares)
+		if resp.Error != nil {
+			return resp.Error
+		}
+
+		expected := make(map[uuid.UUID]*LendDiscrepancy, len(lends))
+		for _, lend := range lends {
+			expected[lend.LId] = &LendDiscrepancy{LId: lend.LId, LenderId: lend.LenderId, BorrowerId: lend.BorrowerId, Recorded: lend.Amount}
+		}
+		for _, share := range shares {
+			lId := GenerateUUIDFromUUIDs(share.LenderId, share.BorrowerId)
+			balance, ok := expected[lId]
+			if !ok {
+				balance = &LendDiscrepancy{LId: lId, LenderId: share.LenderId, BorrowerId: share.BorrowerId}
+				expected[lId] = balance
+			}
+			if balance.LenderId == share.LenderId {
+				balance.Expected += share.Amount
+			} else {
+				balance.Expected -= share.Amount
+			}
+		}
+		report.Checked = len(expected)
+
+		for _, balance := range expected {
+			balance.Difference = balance.Expected - balance.Recorded
+			if math.Abs(balance.Difference) < balanceEpsilon {
+				continue
+			}
+			report.Discrepancies = append(report.Discrepancies, balance)
+			if !repair {
+				continue
+			}
+			entry := NewLedgerEntry(LedgerSourceReconciliation, nil, balance.LenderId, balance.BorrowerId, balance.Difference)
+			if err := upsertLend(tx, entry.Lend()); err != nil {
+				return err
+			}
+			if resp := tx.Create(entry); resp.Error != nil {
+				return resp.Error
+			}
+		}
+		report.Repaired = repair && len(report.Discrepancies) > 0
+		return nil
+	})
+	if err != nil {
+		Log.Error(fmt.Sprintf("reconcile error: %s", err.Error()))
+		return nil, err
+	}
+	Log.Info(fmt.Sprintf("reconciled %d lends, %d discrepancies", report.Checked, len(report.Discrepancies)))
+	return report, nil
+}
+
+func upsertLend(db *gorm.DB, lend *Lend) error {
 	conflictField, err := GetDbFieldName("LId", lend)
 	if err != nil {
 		Log.Error(fmt.Sprintf("Upsert error: %s", err.Error()))
@@ -111,8 +470,7 @@ func (ls *LenderService) Upsert(ctx *context.Context, lend *Lend) error {
 		return err
 	}
 
-	dbClient.StartSession(ctx)
-	resp := dbClient.DbClient(ctx).Clauses(clause.OnConflict{
+	resp := db.Clauses(clause.OnConflict{
 		Columns: []clause.Column{{Name: conflictField}},
 		DoUpdates: clause.Assignments(map[string]interface{}{
 			updateField: clause.Expr{
@@ -141,12 +499,439 @@ func UserServiceInit() (*UserService, error) {
 	return &UserService{dao: dao}, nil
 }
 
-func (us *UserService) Add(ctx *context.Context, name string, email string, phone string) error {
-	var user *User = NewUser(name, email, phone)
-	if err := us.dao.Create(ctx, &user); err != nil {
-		return err
+// Sign up a user. The placeholder created when the user was invited to an
+// expense becomes the user, keeping its expenses and balances.
+// @param ctx *context.Context: Context
+// @param name string: Name of the user
+// @param email string: Normalized email, may be empty
+// @param phone string: Normalized phone number, may be empty
+// @param password string: Password, empty for users who cannot log in
+// @return *User: The created user
+// @return error: ErrConflict when the email or phone number belongs to another user
+func (us *UserService) Add(ctx *context.Context, name string, email string, phone string, password string) (*User, error) {
+	var hash string
+	if password != "" {
+		var err error
+		if hash, err = HashPassword(password); err != nil {
+			return nil, err
+		}
+	}
+	var user *User
+	converted := false
+	err := us.dao.Client(ctx).DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		placeholder, err := findPlaceholder(tx, email, phone)
+		if err != nil {
+			return err
+		}
+		if placeholder == nil {
+			user = NewUser(name, email, phone)
+			user.PasswordHash = hash
+			if err := checkUniqueContacts(tx, user.UId, email, phone); err != nil {
+				return err
+			}
+			return tx.Create(user).Error
+		}
+		// The contact details of the invitation are replaced by the ones of the
+		// signup, which are not shown to a user who did not give them
+		user, converted = placeholder, true
+		user.Name, user.Email, user.PhoneNo, user.PasswordHash, user.IsPlaceholder = name, email, phone, hash, false
+		if err := checkUniqueContacts(tx, user.UId, email, phone); err != nil {
+			return err
+		}
+		return tx.Model(user).Select("name", "email", "phone_no", "email_index", "phone_no_index", "password_hash", "is_placeholder").Updates(user).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			err = fmt.Errorf("%w: email or phone number already in use", ErrConflict)
+		}
+		Log.Error(fmt.Sprintf("add user error: %s", err.Error()))
+		return nil, err
+	}
+	if converted {
+		Log.Info(fmt.Sprintf("placeholder user: %s signed up", user.UId))
+	} else {
+		Log.Info(fmt.Sprintf("user: %s created", user.UId))
+	}
+	return user, nil
+}
+
+// Update the given fields of a user
+// @param ctx *context.Context: Context
+// @param id uuid.UUID: The user to update
+// @param req UpdateUserRequest: Validated fields to update
+// @return *User: The updated user
+// @return error: The error if any
+func (us *UserService) Update(ctx *context.Context, id uuid.UUID, req UpdateUserRequest) (*User, error) {
+	users, err := us.dao.Read(ctx, map[string]interface{}{"uid": id})
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 || users[0].DeletedAt != nil {
+		return nil, NewNotFoundError("user", id)
+	}
+	user := users[0]
+	if req.Name != nil {
+		user.Name = *req.Name
+	}
+	// A changed contact detail has to be verified again
+	if req.Email != nil && *req.Email != user.Email {
+		user.Email, user.EmailVerifiedAt = *req.Email, nil
+	}
+	if req.PhoneNo != nil && *req.PhoneNo != user.PhoneNo {
+		user.PhoneNo, user.PhoneNoVerifiedAt = *req.PhoneNo, nil
+	}
+	if err := us.checkUnique(ctx, id, user.Email, user.PhoneNo); err != nil {
+		return nil, err
+	}
+	resp := us.dao.Client(ctx).DbClient(ctx).Model(&user).Select("name", "email", "phone_no", "email_index", "phone_no_index", "email_verified_at", "phone_no_verified_at").Updates(&user)
+	if resp.Error != nil {
+		if errors.Is(resp.Error, gorm.ErrDuplicatedKey) {
+			return nil, fmt.Errorf("%w: email or phone number already in use", ErrConflict)
+		}
+		return nil, resp.Error
+	}
+	Log.Info(fmt.Sprintf("user: %s updated", id))
+	return &user, nil
+}
+
+// Grant or revoke the administrator role of a user
+// @param ctx *context.Context: Context
+// @param email string: Email of the user
+// @param isAdmin bool: Whether the user is an administrator
+// @return *User: The updated user
+// @return error: ErrNotFound when no active user has the email
+func (us *UserService) SetAdmin(ctx *context.Context, email string, isAdmin bool) (*User, error) {
+	user, err := findUserByContact(us.dao.Client(ctx).DbClient(ctx), NormalizeEmail(email), "")
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.IsPlaceholder || user.DeletedAt != nil {
+		return nil, fmt.Errorf("%w: no active user with this email", ErrNotFound)
+	}
+	user.IsAdmin = isAdmin
+	if resp := us.dao.Client(ctx).DbClient(ctx).Model(user).Update("is_admin", isAdmin); resp.Error != nil {
+		Log.Error(fmt.Sprintf("set admin error: %s", resp.Error.Error()))
+		return nil, resp.Error
+	}
+	Log.Info(fmt.Sprintf("user: %s admin set to %v", user.UId, isAdmin))
+	return user, nil
+}
+
+// Users sharing a balance or an expense with the user @uid
+const sharedUsersQuery = `SELECT borrower_id FROM lends WHERE lender_id = @uid
+	UNION SELECT lender_id FROM lends WHERE borrower_id = @uid
+	UNION SELECT eb.borrower_id FROM expense_borrowers eb JOIN expenses e ON e.ex_id = eb.expense_id
+		WHERE e.lender_id = @uid OR eb.expense_id IN (SELECT expense_id FROM expense_borrowers WHERE borrower_id = @uid)
+	UNION SELECT e.lender_id FROM expenses e JOIN expense_borrowers eb ON e.ex_id = eb.expense_id WHERE eb.borrower_id = @uid`
+
+// Search users by name prefix, exact email or phone number, or list the users
+// sharing lends or expenses with a user
+// @param ctx *context.Context: Context
+// @param filter UserFilter: Filters and pagination
+// @return *Page[User]: The matching users ordered by name
+// @return error: The error if any
+func (us *UserService) Search(ctx *context.Context, filter UserFilter) (*Page[User], error) {
+	query := us.dao.Client(ctx).DbClient(ctx).Model(&User{}).Where("merged_into IS NULL AND deleted_at IS NULL")
+	if filter.Name != "" {
+		prefix := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(filter.Name)
+		query = query.Where("name ILIKE ?", prefix+"%")
+	}
+	for column, value := range map[string]string{"email": NormalizeEmail(filter.Email), "phone_no": NormalizePhoneNo(filter.PhoneNo)} {
+		if value == "" {
+			continue
+		}
+		index, err := BlindIndex(column, value)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where(column+"_index = ?", index)
+	}
+	if filter.SharedWith != nil {
+		query = query.Where("uid <> @uid AND uid IN ("+sharedUsersQuery+")", sql.Named("uid", *filter.SharedWith))
+	}
+	query = query.Session(&gorm.Session{})
+	page := &Page[User]{Items: []User{}, Page: filter.Page, PageSize: filter.PageSize}
+	if resp := query.Count(&page.Total); resp.Error != nil {
+		Log.Error(fmt.Sprintf("search users error: %s", resp.Error.Error()))
+		return nil, resp.Error
+	}
+	resp := query.Order("name, uid").Offset((filter.Page - 1) * filter.PageSize).Limit(filter.PageSize).Find(&page.Items)
+	if resp.Error != nil {
+		Log.Error(fmt.Sprintf("search users error: %s", resp.Error.Error()))
+		return nil, resp.Error
+	}
+	return page, nil
+}
+
+// Which of the users share a balance or an expense with a user
+// @param ctx *context.Context: Context
+// @param userId uuid.UUID: The user
+// @param ids []uuid.UUID: The users to check
+// @return map[uuid.UUID]bool: The users sharing with the user
+// @return error: The error if any
+func (us *UserService) SharingWith(ctx *context.Context, userId uuid.UUID, ids []uuid.UUID) (map[uuid.UUID]bool, error) {
+	shared := map[uuid.UUID]bool{}
+	if len(ids) == 0 {
+		return shared, nil
+	}
+	var sharing []uuid.UUID
+	resp := us.dao.Client(ctx).DbClient(ctx).Model(&User{}).Where("uid IN @ids AND uid IN ("+sharedUsersQuery+")", sql.Named("ids", ids), sql.Named("uid", userId)).Pluck("uid", &sharing)
+	if resp.Error != nil {
+		Log.Error(fmt.Sprintf("sharing users error: %s", resp.Error.Error()))
+		return nil, resp.Error
+	}
+	for _, id := range sharing {
+		shared[id] = true
+	}
+	return shared, nil
+}
+
+// Resolve the users referenced by email or phone number, creating placeholder
+// users for the people who have not signed up yet
+// @param tx *gorm.DB: Transaction of the expense referencing the users
+// @param refs []UserRef: Validated references, resolved in place
+// @return error: The error if any
+func resolveUserRefs(tx *gorm.DB, refs []UserRef) error {
+	for i := range refs {
+		ref := &refs[i]
+		if ref.UId != uuid.Nil {
+			continue
+		}
+		user, err := findUserByContact(tx, ref.Email, ref.PhoneNo)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			user = NewPlaceholderUser(ref.Name, ref.Email, ref.PhoneNo)
+			// In a savepoint, so a duplicate leaves the transaction usable
+			if err := tx.Transaction(func(tx *gorm.DB) error { return tx.Create(user).Error }); err != nil {
+				if !errors.Is(err, gorm.ErrDuplicatedKey) {
+					return err
+				}
+				// Created concurrently by another request
+				if user, err = findUserByContact(tx, ref.Email, ref.PhoneNo); err != nil || user == nil {
+					return fmt.Errorf("%w: user with this email or phone number changed concurrently", ErrConflict)
+				}
+			} else {
+				Log.Info(fmt.Sprintf("placeholder user: %s created", user.UId))
+			}
+		}
+		ref.UId = user.UId
+	}
+	return nil
+}
+
+// Fold a placeholder user into a real user. Expenses, expense shares and
+// settlements of the placeholder are moved to the user and the balances of the
+// placeholder are transferred through the ledger, all in one transaction.
+// @param ctx *context.Context: Context
+// @param userId uuid.UUID: The real user
+// @param placeholderId uuid.UUID: The placeholder to merge
+// @param verifyContact bool: Whether the user must have verified the email or phone number of the placeholder
+// @return *User: The merged user
+// @return error: The error if any, a *PolicyError when the contact is not verified
+func (us *UserService) Merge(ctx *context.Context, userId uuid.UUID, placeholderId uuid.UUID, verifyContact bool) (*User, error) {
+	var user, placeholder User
+	dbClient := us.dao.Client(ctx)
+	err := dbClient.DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		var users []User
+		resp := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("uid IN ?", []uuid.UUID{userId, placeholderId}).Find(&users)
+		if resp.Error != nil {
+			return resp.Error
+		}
+		for _, u := range users {
+			if u.UId == userId {
+				user = u
+			} else if u.UId == placeholderId {
+				placeholder = u
+			}
+		}
+		if user.UId == uuid.Nil || placeholder.UId == uuid.Nil || userId == placeholderId {
+			return fmt.Errorf("%w: user %s or %s", ErrNotFound, userId, placeholderId)
+		}
+		if user.IsPlaceholder || user.MergedInto != nil || user.DeletedAt != nil {
+			return fmt.Errorf("%w: cannot merge into placeholder user %s", ErrConflict, userId)
+		}
+		if !placeholder.IsPlaceholder || placeholder.MergedInto != nil {
+			return fmt.Errorf("%w: user %s is not an unmerged placeholder", ErrConflict, placeholderId)
+		}
+		// Anyone could otherwise take over the balances of an invitee
+		if verifyContact && !user.HasVerifiedContactOf(&placeholder) {
+			return &PolicyError{Action: ActionUserManage, Reason: "the placeholder has no email or phone number verified by the user"}
+		}
+
+		// Shares between the two users would become debts to self
+		lentBy := func(id uuid.UUID) *gorm.DB { return tx.Model(&Expense{}).Select("ex_id").Where("lender_id = ?", id) }
+		if resp := tx.Where("borrower_id = ? AND expense_id IN (?)", placeholderId, lentBy(userId)).Delete(&ExpenseBorrower{}); resp.Error != nil {
+			return resp.Error
+		}
+		if resp := tx.Where("borrower_id = ? AND expense_id IN (?)", userId, lentBy(placeholderId)).Delete(&ExpenseBorrower{}); resp.Error != nil {
+			return resp.Error
+		}
+		// Fold shares of expenses both users borrowed in, through gorm so the changes are audited
+		var folded []*ExpenseBorrower
+		sharedExpenses := tx.Model(&ExpenseBorrower{}).Select("expense_id").Where("borrower_id = ?", userId)
+		if resp := tx.Where("borrower_id = ? AND expense_id IN (?)", placeholderId, sharedExpenses).Find(&folded); resp.Error != nil {
+			return resp.Error
+		}
+		for _, share := range folded {
+			resp := tx.Model(&ExpenseBorrower{ExpenseId: share.ExpenseId, BorrowerId: userId}).Updates(map[string]interface{}{
+				"amount":  gorm.Expr("amount + ?", share.Amount),
+				"is_paid": gorm.Expr("is_paid AND ?", share.IsPaid),
+			})
+			if resp.Error != nil {
+				return resp.Error
+			}
+			if resp := tx.Delete(share); resp.Error != nil {
+				return resp.Error
+			}
+		}
+		if resp := tx.Model(&ExpenseBorrower{}).Where("borrower_id = ?", placeholderId).Update("borrower_id", userId); resp.Error != nil {
+			return resp.Error
+		}
+		if resp := tx.Model(&Expense{}).Where("lender_id = ?", placeholderId).Update("lender_id", userId); resp.Error != nil {
+			return resp.Error
+		}
+
+		// Transfer the balances of the placeholder to the user
+		replace := func(id uuid.UUID) uuid.UUID {
+			if id == placeholderId {
+				return userId
+			}
+			return id
+		}
+		var lends []*Lend
+		resp = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("(lender_id = ? OR borrower_id = ?) AND amount <> 0", placeholderId, placeholderId).Find(&lends)
+		if resp.Error != nil {
+			return resp.Error
+		}
+		for _, lend := range lends {
+			entries := []*LedgerEntry{NewLedgerEntry(LedgerSourceMerge, &placeholderId, lend.LenderId, lend.BorrowerId, -lend.Amount)}
+			lenderId, borrowerId := replace(lend.LenderId), replace(lend.BorrowerId)
+			if lenderId != borrowerId {
+				entries = append(entries, NewLedgerEntry(LedgerSourceMerge, &placeholderId, lenderId, borrowerId, lend.Amount))
+			}
+			for _, entry := range entries {
+				if err := upsertLend(tx, entry.Lend()); err != nil {
+					return err
+				}
+				if resp := tx.Create(entry); resp.Error != nil {
+					return resp.Error
+				}
+			}
+		}
+
+		var settlements []*Settlement
+		if resp := tx.Where("payer_id = ? OR payee_id = ?", placeholderId, placeholderId).Find(&settlements); resp.Error != nil {
+			return resp.Error
+		}
+		for _, settlement := range settlements {
+			settlement.PayerId, settlement.PayeeId = replace(settlement.PayerId), replace(settlement.PayeeId)
+			settlement.LId = GenerateUUIDFromUUIDs(settlement.PayerId, settlement.PayeeId)
+			if resp := tx.Save(settlement); resp.Error != nil {
+				return resp.Error
+			}
+		}
+
+		// Move the contact details the user does not have yet
+		if user.Email == "" {
+			user.Email, placeholder.Email = placeholder.Email, ""
+		}
+		if user.PhoneNo == "" {
+			user.PhoneNo, placeholder.PhoneNo = placeholder.PhoneNo, ""
+		}
+		placeholder.MergedInto = &userId
+		if resp := tx.Model(&placeholder).Select("email", "phone_no", "email_index", "phone_no_index", "merged_into").Updates(&placeholder); resp.Error != nil {
+			return resp.Error
+		}
+		return tx.Model(&user).Select("email", "phone_no", "email_index", "phone_no_index").Updates(&user).Error
+	})
+	if err != nil {
+		Log.Error(fmt.Sprintf("merge user error: %s", err.Error()))
+		return nil, err
+	}
+	Log.Info(fmt.Sprintf("placeholder user: %s merged into %s", placeholderId, userId))
+	return &user, nil
+}
+
+// Find the user with the email or phone number, following merged placeholders
+func findUserByContact(dbClient *gorm.DB, email string, phoneNo string) (*User, error) {
+	for _, contact := range []struct{ column, value string }{{"email", email}, {"phone_no", phoneNo}} {
+		if contact.value == "" {
+			continue
+		}
+		index, err := BlindIndex(contact.column, contact.value)
+		if err != nil {
+			return nil, err
+		}
+		var users []User
+		if resp := dbClient.Where(contact.column+"_index = ?", index).Find(&users); resp.Error != nil {
+			return nil, resp.Error
+		}
+		if len(users) == 0 {
+			continue
+		}
+		if users[0].MergedInto != nil {
+			if resp := dbClient.Where("uid = ?", *users[0].MergedInto).Find(&users); resp.Error != nil || len(users) == 0 {
+				return nil, resp.Error
+			}
+		}
+		return &users[0], nil
 	}
+	return nil, nil
+}
 
+// Unmerged placeholder with the email or phone number, locked until the end of
+// the transaction
+func findPlaceholder(tx *gorm.DB, email string, phoneNo string) (*User, error) {
+	for _, contact := range []struct{ column, value string }{{"email", email}, {"phone_no", phoneNo}} {
+		if contact.value == "" {
+			continue
+		}
+		index, err := BlindIndex(contact.column, contact.value)
+		if err != nil {
+			return nil, err
+		}
+		var users []*User
+		resp := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where(contact.column+"_index = ? AND is_placeholder AND merged_into IS NULL AND deleted_at IS NULL", index).Find(&users)
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+		if len(users) > 0 {
+			return users[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// Check that no other user has the email or phone number
+func (us *UserService) checkUnique(ctx *context.Context, id uuid.UUID, email string, phoneNo string) error {
+	return checkUniqueContacts(us.dao.Client(ctx).DbClient(ctx), id, email, phoneNo)
+}
+
+func checkUniqueContacts(dbClient *gorm.DB, id uuid.UUID, email string, phoneNo string) error {
+	fields := []struct{ column, name, value string }{
+		{"email", "email", email},
+		{"phone_no", "phone number", phoneNo},
+	}
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		index, err := BlindIndex(field.column, field.value)
+		if err != nil {
+			return err
+		}
+		var count int64
+		resp := dbClient.Model(&User{}).Where(field.column+"_index = ? AND uid <> ?", index, id).Count(&count)
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if count > 0 {
+			return fmt.Errorf("%w: %s already in use", ErrConflict, field.name)
+		}
+	}
 	return nil
 }
 
@@ -155,13 +940,201 @@ func (us *UserService) Get(ctx *context.Context, id uuid.UUID) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(user) == 0 {
+		return nil, NewNotFoundError("user", id)
+	}
 	return &user[0], nil
 }
 
+// Users of several ids in a single query, missing users are left out
+func (us *UserService) GetMany(ctx *context.Context, ids []uuid.UUID) ([]*User, error) {
+	var users []*User
+	resp := us.dao.Client(ctx).DbClient(ctx).Where("uid IN ?", ids).Find(&users)
+	return users, resp.Error
+}
+
+// Delete a user without outstanding balances. The user is anonymised rather
+// than removed so the expenses they took part in stay readable.
+// @param ctx *context.Context: Context
+// @param id uuid.UUID: The user to delete
+// @return error: ErrConflict while the user has outstanding balances
 func (us *UserService) Delete(ctx *context.Context, id uuid.UUID) error {
-	user := User{UId: id}
-	if err := us.dao.Delete(ctx, &user); err != nil {
-		return err
+	dbClient := us.dao.Client(ctx)
+	return dbClient.DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		var users []User
+		if resp := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("uid = ?", id).Find(&users); resp.Error != nil {
+			return resp.Error
+		}
+		if len(users) == 0 {
+			return NewNotFoundError("user", id)
+		}
+		user := users[0]
+		if user.DeletedAt != nil {
+			return nil
+		}
+		var open int64
+		resp := tx.Model(&Lend{}).Where("(lender_id = ? OR borrower_id = ?) AND ABS(amount) > ?", id, id, balanceEpsilon).Count(&open)
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if open > 0 {
+			return fmt.Errorf("%w: user has %d outstanding balances, settle up before deleting", ErrConflict, open)
+		}
+		deletedAt := time.Now().UTC()
+		user.Name, user.Email, user.PhoneNo, user.DeletedAt = DeletedUserName, "", "", &deletedAt
+		if resp := tx.Model(&user).Select("name", "email", "phone_no", "email_index", "phone_no_index", "deleted_at").Updates(&user); resp.Error != nil {
+			return resp.Error
+		}
+		Log.Info(fmt.Sprintf("user: %s deleted", id))
+		return nil
+	})
+}
+
+// Collect the personal data held about a user
+// @param ctx *context.Context: Context
+// @param id uuid.UUID: The user to export
+// @return *UserExport: Profile, expenses, payments and balances of the user
+// @return error: The error if any
+func (us *UserService) Export(ctx *context.Context, id uuid.UUID) (*UserExport, error) {
+	dbClient := us.dao.Client(ctx).DbClient(ctx)
+	export := &UserExport{ExportedAt: time.Now().UTC()}
+	var users []User
+	if resp := dbClient.Where("uid = ?", id).Find(&users); resp.Error != nil {
+		return nil, resp.Error
+	}
+	if len(users) == 0 {
+		return nil, NewNotFoundError("user", id)
+	}
+	export.User = users[0]
+	resp := dbClient.Preload("ExpenseBorrowers").Where("lender_id = ?", id).Order("created_at").Find(&export.ExpensesPaid)
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	resp = dbClient.Model(&ExpenseBorrower{}).
+		Select("expense_borrowers.expense_id, expenses.lender_id, expenses.description, expenses.created_at, expense_borrowers.amount, expense_borrowers.is_paid").
+		Joins("JOIN expenses ON expense_borrowers.expense_id = expenses.ex_id").
+		Where("expense_borrowers.borrower_id = ?", id).Order("expenses.created_at").
+		Scan(&export.ExpenseShares)
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if resp := dbClient.Where("payer_id = ? OR payee_id = ?", id, id).Order("created_at").Find(&export.Settlements); resp.Error != nil {
+		return nil, resp.Error
+	}
+	if resp := dbClient.Where("lender_id = ? OR borrower_id = ?", id, id).Order("created_at").Find(&export.Ledger); resp.Error != nil {
+		return nil, resp.Error
+	}
+	if resp := dbClient.Where("lender_id = ? OR borrower_id = ?", id, id).Find(&export.Balances); resp.Error != nil {
+		return nil, resp.Error
+	}
+	return export, nil
+}
+
+// Scrub the personal data of a user. Expenses, shares and balances are kept
+// so the ledger of the other participants is unchanged.
+// @param ctx *context.Context: Context
+// @param id uuid.UUID: The user to erase
+// @return *User: The erased user
+// @return error: The error if any
+func (us *UserService) Erase(ctx *context.Context, id uuid.UUID) (*User, error) {
+	var user User
+	dbClient := us.dao.Client(ctx)
+	err := dbClient.DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		var users []User
+		if resp := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("uid = ?", id).Find(&users); resp.Error != nil {
+			return resp.Error
+		}
+		if len(users) == 0 {
+			return NewNotFoundError("user", id)
+		}
+		user = users[0]
+		if user.ErasedAt != nil {
+			return nil
+		}
+		erasedAt := time.Now().UTC()
+		user.Name, user.Email, user.PhoneNo, user.ErasedAt = ErasedUserName, "", "", &erasedAt
+		// The identity is unlinked so the person can sign up again
+		user.OidcIssuer, user.OidcSubject = "", ""
+		return tx.Model(&user).Select("name", "email", "phone_no", "email_index", "phone_no_index", "oidc_issuer", "oidc_subject", "erased_at").Updates(&user).Error
+	})
+	if err != nil {
+		Log.Error(fmt.Sprintf("erase user error: %s", err.Error()))
+		return nil, err
+	}
+	Log.Info(fmt.Sprintf("user: %s erased", id))
+	return &user, nil
+}
+
+// Preferences of a user, the defaults when the user has not set any
+// @param ctx *context.Context: Context
+// @param id uuid.UUID: The user
+// @return *UserPreferences
+// @return error: The error if any
+func (us *UserService) GetPreferences(ctx *context.Context, id uuid.UUID) (*UserPreferences, error) {
+	var preferences []*UserPreferences
+	if resp := us.dao.Client(ctx).DbClient(ctx).Where("uid = ?", id).Find(&preferences); resp.Error != nil {
+		Log.Error(fmt.Sprintf("get preferences error: %s", resp.Error.Error()))
+		return nil, resp.Error
+	}
+	if len(preferences) == 0 {
+		return NewUserPreferences(id), nil
+	}
+	return preferences[0], nil
+}
+
+// Update the given preferences of a user
+// @param ctx *context.Context: Context
+// @param id uuid.UUID: The user
+// @param req UpdatePreferencesRequest: Validated preferences to update
+// @return *UserPreferences: The updated preferences
+// @return error: The error if any
+func (us *UserService) UpdatePreferences(ctx *context.Context, id uuid.UUID, req UpdatePreferencesRequest) (*UserPreferences, error) {
+	var preferences *UserPreferences
+	dbClient := us.dao.Client(ctx)
+	err := dbClient.DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		var users []User
+		if resp := tx.Where("uid = ? AND deleted_at IS NULL", id).Find(&users); resp.Error != nil {
+			return resp.Error
+		}
+		if len(users) == 0 {
+			return NewNotFoundError("user", id)
+		}
+		var current []*UserPreferences
+		if resp := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("uid = ?", id).Find(&current); resp.Error != nil {
+			return resp.Error
+		}
+		preferences = NewUserPreferences(id)
+		if len(current) > 0 {
+			preferences = current[0]
+		}
+		req.Apply(preferences)
+		return tx.Save(preferences).Error
+	})
+	if err != nil {
+		Log.Error(fmt.Sprintf("update preferences error: %s", err.Error()))
+		return nil, err
+	}
+	return preferences, nil
+}
+
+// Check that the users exist and are not deleted, erased or merged
+// @param db *gorm.DB: Client or transaction to read the users with
+// @param ids []uuid.UUID: The users to check
+// @return error: The error if any user is unknown, deleted, erased or merged
+func checkActiveUsers(db *gorm.DB, ids []uuid.UUID) error {
+	var users []User
+	resp := db.Where("uid IN ? AND deleted_at IS NULL AND erased_at IS NULL AND merged_into IS NULL", ids).Find(&users)
+	if resp.Error != nil {
+		return resp.Error
+	}
+	active := make(map[uuid.UUID]bool, len(users))
+	for _, user := range users {
+		active[user.UId] = true
+	}
+	for _, id := range ids {
+		if !active[id] {
+			return InvalidField("users", "active", id.String(), fmt.Sprintf("user %s does not exist or was deleted or erased", id))
+		}
 	}
 	return nil
 }
@@ -175,7 +1148,7 @@ type EqualSplitAmount struct {
 }
 
 func (ss *EqualSplitAmount) SplitAmount() []*ExpenseBorrower {
-	users := ss.expenseRequest.Users
+	users := ss.expenseRequest.UserIds()
 	amount := ss.expenseRequest.Amount
 	lenderId := ss.expenseRequest.LenderId
 	var expenseBorrowers []*ExpenseBorrower
@@ -197,7 +1170,7 @@ type ExactSplitAmount struct {
 }
 
 func (ss *ExactSplitAmount) SplitAmount() []*ExpenseBorrower {
-	users := ss.expenseRequest.Users
+	users := ss.expenseRequest.UserIds()
 	values := ss.expenseRequest.Values
 	var expenseBorrowers []*ExpenseBorrower
 	for i, userId := range users {
@@ -215,7 +1188,7 @@ type PercentSplitAmount struct {
 
 func (ss *PercentSplitAmount) SplitAmount() []*ExpenseBorrower {
 	var expenseBorrowers []*ExpenseBorrower
-	users := ss.expenseRequest.Users
+	users := ss.expenseRequest.UserIds()
 	amount := ss.expenseRequest.Amount
 	percents := ss.expenseRequest.Percents
 	lenderId := ss.expenseRequest.LenderId
@@ -246,7 +1219,7 @@ func SplitServiceInit(expenseRequest ExpenseRequest) (ISplitAmount, error) {
 	case "percent":
 		return &PercentSplitAmount{expenseRequest: expenseRequest}, nil
 	}
-	return nil, fmt.Errorf("invalid expense type: %s", expenseType)
+	return nil, InvalidField("type", "oneof", "equal exact percent", fmt.Sprintf("invalid expense type: %s", expenseType))
 }
 
 type ExpenseService struct {
@@ -263,28 +1236,129 @@ func ExpenseServiceInit() (*ExpenseService, error) {
 	return &ExpenseService{dao: dao}, nil
 }
 
-func (es *ExpenseService) Add(
-	ctx *context.Context, category string, amount float64, description string, lenderId uuid.UUID, expenseBorrowers []*ExpenseBorrower,
-) error {
-	var expense *Expense = NewExpense(category, amount, description, lenderId, expenseBorrowers)
-	if err := es.dao.Create(ctx, &expense); err != nil {
-		return err
+// Add an expense and record what its borrowers owe the lender. The placeholder
+// users of the people who have not signed up yet, the expense, its ledger
+// entries and the balances are written in one transaction.
+// @param ctx *context.Context: Context
+// @param expenseRequest *ExpenseRequest: Validated request, its user references are resolved in place
+// @return *Expense: The added expense
+// @return error: The error if any
+func (es *ExpenseService) Add(ctx *context.Context, expenseRequest *ExpenseRequest) (*Expense, error) {
+	var expense *Expense
+	dbClient := es.dao.Client(ctx)
+	err := dbClient.DbClient(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := resolveUserRefs(tx, expenseRequest.Users); err != nil {
+			return err
+		}
+		if err := checkActiveUsers(tx, append(expenseRequest.UserIds(), expenseRequest.LenderId)); err != nil {
+			return err
+		}
+		// Split the expense amount based on the type of expense
+		splitService, err := SplitServiceInit(*expenseRequest)
+		if err != nil {
+			return err
+		}
+		expenseBorrowers := splitService.SplitAmount()
+		expense = NewExpense(expenseRequest.Type, expenseRequest.Amount, expenseRequest.Description, expenseRequest.LenderId, expenseBorrowers)
+		var entries []*LedgerEntry
+		for _, expenseBorrower := range expenseBorrowers {
+			entries = append(entries, NewLedgerEntry(LedgerSourceExpense, &expense.ExId, expense.LenderId, expenseBorrower.BorrowerId, expenseBorrower.Amount))
+		}
+		if resp := tx.Create(expense); resp.Error != nil {
+			return resp.Error
+		}
+		return recordLedgerEntries(tx, entries)
+	})
+	if err != nil {
+		Log.Error(fmt.Sprintf("add expense error: %s", err.Error()))
+		return nil, err
 	}
-
-	return nil
+	Log.Info(fmt.Sprintf("expense: %s added", expense.ExId))
+	return expense, nil
 }
 
 func (es *ExpenseService) Get(ctx *context.Context, id uuid.UUID) (*Expense, error) {
-	expense, err := es.dao.Read(ctx, map[string]interface{}{"ex_id": id})
-	if err != nil {
-		return nil, err
+	var expenses []Expense
+	resp := es.dao.Client(ctx).DbClient(ctx).Preload("ExpenseBorrowers").Where("ex_id = ?", id).Find(&expenses)
+	if resp.Error != nil {
+		return nil, resp.Error
 	}
-	return &expense[0], nil
+	if len(expenses) == 0 {
+		return nil, NewNotFoundError("expense", id)
+	}
+	return &expenses[0], nil
+}
+
+// Expenses of several ids with their borrowers, missing expenses are left out
+func (es *ExpenseService) GetMany(ctx *context.Context, ids []uuid.UUID) ([]*Expense, error) {
+	var expenses []*Expense
+	resp := es.dao.Client(ctx).DbClient(ctx).Preload("ExpenseBorrowers").Where("ex_id IN ?", ids).Find(&expenses)
+	return expenses, resp.Error
+}
+
+// Most recent expenses shared by pairs of users, one paying for the other
+// @param ctx *context.Context: Context
+// @param pairs [][2]uuid.UUID: The pairs of users
+// @param limit int: Number of expenses to return per pair
+// @return map[uuid.UUID][]*Expense: Expenses of every pair keyed by the lend id of the pair, newest first
+// @return error: The error if any
+func (es *ExpenseService) ListShared(ctx *context.Context, pairs [][2]uuid.UUID, limit int) (map[uuid.UUID][]*Expense, error) {
+	shared := make(map[uuid.UUID][]*Expense, len(pairs))
+	if len(pairs) == 0 {
+		return shared, nil
+	}
+	directions := make([][]interface{}, 0, 2*len(pairs))
+	for _, pair := range pairs {
+		directions = append(directions, []interface{}{pair[0], pair[1]}, []interface{}{pair[1], pair[0]})
+	}
+	var rows []struct {
+		ExId       uuid.UUID
+		LenderId   uuid.UUID
+		BorrowerId uuid.UUID
+	}
+	dbClient := es.dao.Client(ctx).DbClient(ctx)
+	resp := dbClient.Raw(`SELECT ex_id, lender_id, borrower_id FROM (
+			SELECT e.ex_id, e.lender_id, eb.borrower_id, ROW_NUMBER() OVER (
+				PARTITION BY LEAST(e.lender_id, eb.borrower_id), GREATEST(e.lender_id, eb.borrower_id)
+				ORDER BY e.created_at DESC, e.ex_id DESC) AS rn
+			FROM expenses e JOIN expense_borrowers eb ON eb.expense_id = e.ex_id
+			WHERE (e.lender_id, eb.borrower_id) IN ?
+		) shared WHERE rn <= ?`, directions, limit).Scan(&rows)
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if len(rows) == 0 {
+		return shared, nil
+	}
+	exIds := make([]uuid.UUID, len(rows))
+	for i, row := range rows {
+		exIds[i] = row.ExId
+	}
+	var expenses []*Expense
+	resp = dbClient.Preload("ExpenseBorrowers").Where("ex_id IN ?", exIds).Order("created_at DESC, ex_id DESC").Find(&expenses)
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	pairOf := make(map[uuid.UUID][]uuid.UUID, len(rows))
+	for _, row := range rows {
+		pairOf[row.ExId] = append(pairOf[row.ExId], GenerateUUIDFromUUIDs(row.LenderId, row.BorrowerId))
+	}
+	for _, expense := range expenses {
+		for _, lId := range pairOf[expense.ExId] {
+			shared[lId] = append(shared[lId], expense)
+		}
+	}
+	return shared, nil
 }
 
 func (es *ExpenseService) UpdatePayment(ctx *context.Context, lenderId uuid.UUID, borrowerId uuid.UUID) error {
-	var expenseBorrowers []ExpenseBorrower
 	dbClient := es.dao.Client(ctx).DbClient(ctx)
+	return markExpensesPaid(dbClient, lenderId, borrowerId)
+}
+
+// Mark every expense share the borrower owes the lender as paid
+func markExpensesPaid(dbClient *gorm.DB, lenderId uuid.UUID, borrowerId uuid.UUID) error {
+	var expenseBorrowers []ExpenseBorrower
 	lenderIdFieldName, err := GetDbFieldName("LenderId", Lend{})
 	if err != nil {
 		return err
@@ -0,0 +1,355 @@
+package internal
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newTestUserService(t *testing.T) (*fakeDB, *UserService) {
+	fake, client := newFakeDB(t)
+	return fake, &UserService{dao: &Dao[User]{dbClient: client}}
+}
+
+func TestMergeUserForbiddenWithoutVerifiedContact(t *testing.T) {
+	verifiedAt := time.Now().UTC()
+	user := NewUser("Ann", "ann@example.com", "")
+	user.EmailVerifiedAt = &verifiedAt
+	placeholder := NewPlaceholderUser("", "someone@example.com", "")
+
+	tests := []struct {
+		name   string
+		caller *User
+	}{
+		{"owner", user},
+		{"other user", NewUser("Bob", "bob@example.com", "")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, service := newTestUserService(t)
+			fake.AddRows(t, user, placeholder)
+			handler := &UserHandler{service: service}
+
+			_, err := handler.MergeUser(userContext(test.caller), &MergeUserRequest{UserPath: UserPath{UId: user.UId}, PlaceholderId: placeholder.UId})
+			if !errors.Is(err, ErrForbidden) {
+				t.Fatalf("merge error = %v, want %v", err, ErrForbidden)
+			}
+			if statements := fake.Find(`UPDATE "`); len(statements) > 0 {
+				t.Errorf("forbidden merge wrote %q", statements[0].Query)
+			}
+		})
+	}
+}
+
+func TestMergeUserVerifiedContactOrAdmin(t *testing.T) {
+	verifiedAt := time.Now().UTC()
+	placeholder := NewPlaceholderUser("", "", "+15550100")
+	user := NewUser("Ann", "ann@example.com", "+15550100")
+	user.PhoneNoVerifiedAt = &verifiedAt
+	admin := NewUser("Admin", "admin@example.com", "")
+	admin.IsAdmin = true
+	unverified := NewUser("Ann", "ann@example.com", "")
+
+	tests := []struct {
+		name   string
+		user   *User
+		caller *User
+	}{
+		{"verified phone number", user, user},
+		{"admin", unverified, admin},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, service := newTestUserService(t)
+			fake.AddRows(t, test.user, placeholder)
+			handler := &UserHandler{service: service}
+
+			merged, err := handler.MergeUser(userContext(test.caller), &MergeUserRequest{UserPath: UserPath{UId: test.user.UId}, PlaceholderId: placeholder.UId})
+			if err != nil {
+				t.Fatalf("merge error = %v", err)
+			}
+			if merged.UId != test.user.UId {
+				t.Errorf("merged user = %s, want %s", merged.UId, test.user.UId)
+			}
+			if len(fake.Find("COMMIT")) == 0 {
+				t.Error("merge was not committed")
+			}
+		})
+	}
+}
+
+func TestHasVerifiedContactOf(t *testing.T) {
+	verifiedAt := time.Now().UTC()
+	tests := []struct {
+		name     string
+		user     User
+		other    User
+		verified bool
+	}{
+		{"verified email", User{Email: "ann@example.com", EmailVerifiedAt: &verifiedAt}, User{Email: "Ann@Example.com"}, true},
+		{"unverified email", User{Email: "ann@example.com"}, User{Email: "ann@example.com"}, false},
+		{"verified phone number", User{PhoneNo: "+15550100", PhoneNoVerifiedAt: &verifiedAt}, User{PhoneNo: "+15550100"}, true},
+		{"other email", User{Email: "ann@example.com", EmailVerifiedAt: &verifiedAt}, User{Email: "bob@example.com"}, false},
+		{"no contact", User{EmailVerifiedAt: &verifiedAt, PhoneNoVerifiedAt: &verifiedAt}, User{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if verified := test.user.HasVerifiedContactOf(&test.other); verified != test.verified {
+				t.Errorf("HasVerifiedContactOf = %v, want %v", verified, test.verified)
+			}
+		})
+	}
+}
+
+func TestAddUserConvertsPlaceholder(t *testing.T) {
+	placeholder := NewPlaceholderUser("Ann from work", "ann@example.com", "+15550100")
+	fake, service := newTestUserService(t)
+	fake.AddRows(t, placeholder)
+
+	ctx := context.Background()
+	user, err := service.Add(&ctx, "Ann", "ann@example.com", "", "password")
+	if err != nil {
+		t.Fatalf("add error = %v", err)
+	}
+	if user.UId != placeholder.UId || user.IsPlaceholder {
+		t.Errorf("user = %s placeholder %v, want the converted placeholder %s", user.UId, user.IsPlaceholder, placeholder.UId)
+	}
+	if user.PhoneNo != "" {
+		t.Errorf("phone number of the invitation %q shown to the user", user.PhoneNo)
+	}
+	if len(fake.Find(`UPDATE "users"`)) != 1 || len(fake.Find(`INSERT INTO "users"`)) != 0 {
+		t.Error("placeholder was not updated in place")
+	}
+}
+
+func TestAddUserWithoutPlaceholder(t *testing.T) {
+	fake, service := newTestUserService(t)
+
+	ctx := context.Background()
+	user, err := service.Add(&ctx, "Ann", "ann@example.com", "", "")
+	if err != nil {
+		t.Fatalf("add error = %v", err)
+	}
+	if user.IsPlaceholder || len(fake.Find(`INSERT INTO "users"`)) != 1 {
+		t.Error("user was not created")
+	}
+}
+
+func TestAddExpenseRollsBackPlaceholders(t *testing.T) {
+	fake, client := newFakeDB(t)
+	service := &ExpenseService{dao: &Dao[Expense]{dbClient: client}}
+	// The lender is unknown, so the expense is rejected after the placeholder is created
+	req := &ExpenseRequest{Type: "equal", LenderId: GenerateUUIdV6(), Amount: 30, Users: []UserRef{{Email: "invitee@example.com"}}}
+
+	ctx := context.Background()
+	if _, err := service.Add(&ctx, req); !errors.Is(err, ErrValidation) {
+		t.Fatalf("add error = %v, want %v", err, ErrValidation)
+	}
+	var created, rolledBack bool
+	for _, statement := range fake.statements {
+		switch {
+		case strings.HasPrefix(statement.Query, `INSERT INTO "users"`):
+			created = true
+		case statement.Query == "ROLLBACK":
+			rolledBack = created
+		case statement.Query == "COMMIT":
+			t.Fatal("expense transaction was committed")
+		}
+	}
+	if !created || !rolledBack {
+		t.Errorf("placeholder created %v, rolled back with the expense %v", created, rolledBack)
+	}
+}
+
+func TestSetAdmin(t *testing.T) {
+	tests := []struct {
+		name string
+		user *User
+		err  error
+	}{
+		{"user", NewUser("Ann", "ann@example.com", ""), nil},
+		{"placeholder", NewPlaceholderUser("Ann", "ann@example.com", ""), ErrNotFound},
+		{"unknown email", nil, ErrNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, service := newTestUserService(t)
+			if test.user != nil {
+				fake.AddRows(t, test.user)
+			}
+
+			ctx := context.Background()
+			user, err := service.SetAdmin(&ctx, "Ann@Example.com", true)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("set admin error = %v, want %v", err, test.err)
+			}
+			if updated := len(fake.Find(`UPDATE "users" SET "is_admin"`)) > 0; updated != (err == nil) {
+				t.Errorf("is_admin updated = %v", updated)
+			}
+			if err == nil && !user.IsAdmin {
+				t.Error("user is not an administrator")
+			}
+		})
+	}
+}
+
+func TestSettleAllRecordsSettledAmount(t *testing.T) {
+	fake, client := newFakeDB(t)
+	service := &LenderService{dao: &Dao[Lend]{dbClient: client}}
+	lenderId, borrowerId := GenerateUUIdV6(), GenerateUUIdV6()
+	fake.AddRows(t, NewLender(lenderId, borrowerId, 10))
+
+	ctx := context.Background()
+	if _, err := service.SettleAll(&ctx, SettleAllRequest{UserId1: lenderId, UserId2: borrowerId}); err != nil {
+		t.Fatalf("settle all error = %v", err)
+	}
+	entries := fake.Find(`INSERT INTO "ledger_entries"`)
+	if len(entries) != 1 {
+		t.Fatalf("ledger entries = %d, want 1", len(entries))
+	}
+	// Columns e_id, l_id, lender_id, borrower_id, amount...
+	if amount := entries[0].Args[4]; amount != -10.0 {
+		t.Errorf("ledger entry amount = %v, want -10", amount)
+	}
+}
+
+func TestUpdatePaymentRecordsPaidAmount(t *testing.T) {
+	fake, client := newFakeDB(t)
+	service := &LenderService{dao: &Dao[Lend]{dbClient: client}}
+	lenderId, borrowerId := GenerateUUIdV6(), GenerateUUIdV6()
+	fake.AddRows(t, NewLender(lenderId, borrowerId, 10))
+
+	ctx := context.Background()
+	if err := service.UpdatePayment(&ctx, lenderId, borrowerId, 10); err != nil {
+		t.Fatalf("update payment error = %v", err)
+	}
+	entries := fake.Find(`INSERT INTO "ledger_entries"`)
+	if len(entries) != 1 {
+		t.Fatalf("ledger entries = %d, want 1", len(entries))
+	}
+	if amount := entries[0].Args[4]; amount != -10.0 {
+		t.Errorf("ledger entry amount = %v, want -10", amount)
+	}
+}
+
+var updatedColumnRegexp = regexp.MustCompile(`"(\w+)"\s*=\s*\$(\d+)`)
+
+// Columns set by the update of a user and the conditions of the update
+func updatedUser(t *testing.T, fake *fakeDB, id uuid.UUID) map[string]driver.Value {
+	t.Helper()
+	for _, statement := range fake.Find(`UPDATE "users"`) {
+		columns := map[string]driver.Value{}
+		for _, match := range updatedColumnRegexp.FindAllStringSubmatch(statement.Query, -1) {
+			i, _ := strconv.Atoi(match[2])
+			columns[match[1]] = statement.Args[i-1]
+		}
+		if columns["uid"] == id.String() {
+			return columns
+		}
+	}
+	t.Fatalf("user %s was not updated", id)
+	return nil
+}
+
+// User with the blind indexes of its contact details, as stored
+func indexedUser(t *testing.T, user *User) *User {
+	t.Helper()
+	if err := user.BeforeSave(nil); err != nil {
+		t.Fatalf("index user: %v", err)
+	}
+	return user
+}
+
+func blindIndex(t *testing.T, column string, value string) string {
+	t.Helper()
+	index, err := BlindIndex(column, value)
+	if err != nil {
+		t.Fatalf("blind index: %v", err)
+	}
+	return index
+}
+
+func TestUserWritesRefreshBlindIndexes(t *testing.T) {
+	setTestKeyring(t)
+	newEmail := "new@example.com"
+	tests := []struct {
+		name  string
+		write func(ctx *context.Context, service *UserService, user *User) error
+		email string
+	}{
+		{"update", func(ctx *context.Context, service *UserService, user *User) error {
+			_, err := service.Update(ctx, user.UId, UpdateUserRequest{Email: &newEmail})
+			return err
+		}, newEmail},
+		{"delete", func(ctx *context.Context, service *UserService, user *User) error {
+			return service.Delete(ctx, user.UId)
+		}, ""},
+		{"erase", func(ctx *context.Context, service *UserService, user *User) error {
+			_, err := service.Erase(ctx, user.UId)
+			return err
+		}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, service := newTestUserService(t)
+			user := indexedUser(t, NewUser("Ann", "ann@example.com", "+15550100"))
+			fake.AddRows(t, user)
+
+			ctx := context.Background()
+			if err := test.write(&ctx, service, user); err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+			columns := updatedUser(t, fake, user.UId)
+			if got, want := columns["email_index"], blindIndex(t, "email", test.email); got != want {
+				t.Errorf("email index = %q, want %q", got, want)
+			}
+			if test.email == "" && columns["phone_no_index"] != "" {
+				t.Errorf("phone number index = %q, want empty", columns["phone_no_index"])
+			}
+		})
+	}
+}
+
+func TestEraseUnlinksIdentity(t *testing.T) {
+	fake, service := newTestUserService(t)
+	user := NewUser("Ann", "ann@example.com", "")
+	user.OidcIssuer, user.OidcSubject = "https://issuer.example.com", "subject"
+	fake.AddRows(t, user)
+
+	ctx := context.Background()
+	if _, err := service.Erase(&ctx, user.UId); err != nil {
+		t.Fatalf("erase error = %v", err)
+	}
+	columns := updatedUser(t, fake, user.UId)
+	for _, column := range []string{"oidc_issuer", "oidc_subject"} {
+		if value, ok := columns[column]; !ok || value != "" {
+			t.Errorf("%s = %v, want empty", column, value)
+		}
+	}
+}
+
+func TestMergeUserRefreshesBlindIndexes(t *testing.T) {
+	setTestKeyring(t)
+	fake, service := newTestUserService(t)
+	user := indexedUser(t, NewUser("Ann", "", "+15550100"))
+	placeholder := indexedUser(t, NewPlaceholderUser("", "ann@example.com", ""))
+	fake.AddRows(t, user, placeholder)
+
+	ctx := context.Background()
+	if _, err := service.Merge(&ctx, user.UId, placeholder.UId, false); err != nil {
+		t.Fatalf("merge error = %v", err)
+	}
+	if got, want := updatedUser(t, fake, user.UId)["email_index"], blindIndex(t, "email", "ann@example.com"); got != want {
+		t.Errorf("user email index = %q, want %q", got, want)
+	}
+	if got := updatedUser(t, fake, placeholder.UId)["email_index"]; got != "" {
+		t.Errorf("placeholder email index = %q, want empty", got)
+	}
+}
@@ -1,15 +1,15 @@
 package internal
 
 import (
-	"context"
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm/schema"
 )
 
-type Function[T interface{}] func(*context.Context, T) error
-
 func ParseUUIDString(uid string) (*uuid.UUID, error) {
 	uidParsed, err := uuid.Parse(uid)
 	if err != nil {
@@ -18,6 +18,39 @@ func ParseUUIDString(uid string) (*uuid.UUID, error) {
 	return &uidParsed, nil
 }
 
+// Parse a time query parameter given either as RFC3339 or as a date (midnight UTC)
+func ParseTimeString(value string) (*time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse(time.DateOnly, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q: expected RFC3339 or YYYY-MM-DD", value)
+		}
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Normalize a phone number towards E.164 by removing formatting characters
+// and replacing the international 00 prefix with +
+func NormalizePhoneNo(phoneNo string) string {
+	phoneNo = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(phoneNo))
+	if strings.HasPrefix(phoneNo, "00") {
+		phoneNo = "+" + phoneNo[2:]
+	}
+	return phoneNo
+}
+
 func GenerateUUIdV6() uuid.UUID {
 	uuid, err := uuid.NewV6()
 	if err != nil {
@@ -75,23 +108,3 @@ func GetDbFieldName(fieldName string, entity interface{}) (string, error) {
 	}
 	return "", nil
 }
-
-// Run task concurrently using goroutines
-// @param fn Function to run
-// @param inputs Inputs to pass to the function
-// @return error If any of the tasks return an error
-func Parallelize[I interface{}](ctx *context.Context, fn Function[I], inputs []I) error {
-	errCh := make(chan error, len(inputs))
-	for _, input := range inputs {
-		go func() {
-			errCh <- fn(ctx, input)
-		}()
-	}
-	for range inputs {
-		err := <-errCh
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Version the unversioned legacy routes are aliases of
+const LegacyVersion = "v1"
+
+// Date the unversioned routes were deprecated, the default of LEGACY_ROUTES_DEPRECATED
+const legacyDeprecatedAt = "2026-10-18"
+
+// Time the unversioned routes are kept after their deprecation by default
+const legacySunsetAfter = 180 * 24 * time.Hour
+
+var versionPrefix = regexp.MustCompile(`^/(v[0-9]+)(/|$)`)
+
+// Split the version prefix off a path template, e.g. /v1/user/{uid} is v1 and
+// /user/{uid}. Unversioned templates have no version.
+func SplitVersion(template string) (string, string) {
+	match := versionPrefix.FindStringSubmatch(template)
+	if match == nil {
+		return "", template
+	}
+	unversioned := template[len(match[1])+1:]
+	if unversioned == "" {
+		unversioned = "/"
+	}
+	return match[1], unversioned
+}
+
+// Subrouter of the routes of an API version, mounted under /<version>. Versions
+// are served side by side: a breaking change gets a new version, e.g. v2, with
+// its own handlers while the previous version keeps its routes.
+func VersionRouter(r *mux.Router, version string) *mux.Router {
+	return r.PathPrefix("/" + version).Subrouter()
+}
+
+// Deprecation of the unversioned routes, announced with the Deprecation and
+// Sunset headers (RFC 9745 and RFC 8594) and a Link to the successor version
+type Deprecation struct {
+	Enabled      bool
+	DeprecatedAt time.Time
+	Sunset       time.Time
+}
+
+// Deprecation configured by the environment:
+// LEGACY_ROUTES: off to remove the unversioned routes, on by default
+// LEGACY_ROUTES_DEPRECATED: date the unversioned routes were deprecated, YYYY-MM-DD
+// LEGACY_ROUTES_SUNSET: date the unversioned routes are removed, 180 days after their deprecation by default
+func DeprecationFromEnv() (*Deprecation, error) {
+	deprecation := &Deprecation{Enabled: os.Getenv("LEGACY_ROUTES") != "off"}
+	deprecatedAt := os.Getenv("LEGACY_ROUTES_DEPRECATED")
+	if deprecatedAt == "" {
+		deprecatedAt = legacyDeprecatedAt
+	}
+	var err error
+	if deprecation.DeprecatedAt, err = time.Parse(time.DateOnly, deprecatedAt); err != nil {
+		Log.Error("invalid env: LEGACY_ROUTES_DEPRECATED")
+		return nil, fmt.Errorf("LEGACY_ROUTES_DEPRECATED should be a YYYY-MM-DD date: %s", deprecatedAt)
+	}
+	deprecation.Sunset = deprecation.DeprecatedAt.Add(legacySunsetAfter)
+	if sunset := os.Getenv("LEGACY_ROUTES_SUNSET"); sunset != "" {
+		if deprecation.Sunset, err = time.Parse(time.DateOnly, sunset); err != nil {
+			Log.Error("invalid env: LEGACY_ROUTES_SUNSET")
+			return nil, fmt.Errorf("LEGACY_ROUTES_SUNSET should be a YYYY-MM-DD date: %s", sunset)
+		}
+	}
+	return deprecation, nil
+}
+
+// Middleware adding the deprecation headers, the Link points to the same route
+// of the version the legacy routes are aliases of
+func (d *Deprecation) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", d.DeprecatedAt.Unix()))
+		w.Header().Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+		w.Header().Set("Link", fmt.Sprintf("</%s%s>; rel=\"successor-version\"", LegacyVersion, r.URL.EscapedPath()))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Subrouter of the unversioned legacy routes, aliases of the LegacyVersion
+// routes kept for a transition period. It should be added after the version
+// subrouters. Nil is returned once the legacy routes are turned off.
+func LegacyRouter(r *mux.Router, deprecation *Deprecation) *mux.Router {
+	if !deprecation.Enabled {
+		return nil
+	}
+	Log.Info(fmt.Sprintf("unversioned routes are deprecated aliases of /%s until %s", LegacyVersion, deprecation.Sunset.Format(time.DateOnly)))
+	legacy := r.NewRoute().Subrouter()
+	legacy.Use(deprecation.Middleware)
+	return legacy
+}
@@ -9,6 +9,9 @@ Email: pranjalkgupta99@gmail.com
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -27,6 +30,13 @@ func main() {
 		panic(err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Exit(reconcile(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(setAdmin(os.Args[2:]))
+	}
+
 	if err := api.Init(); err != nil {
 		log.Error(fmt.Sprintf("error occurred in app initialization: %s", err))
 		panic(err)
@@ -40,9 +50,69 @@ func main() {
 	// Wait for termination signal
 	signal.Notify(exitChn, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 
-	<-exitChn
+	select {
+	case <-exitChn:
+	case err := <-api.Done():
+		log.Error(fmt.Sprintf("application server stopped: %s", err))
+	}
 	// Gracefull Shutdown
 	log.Info("stopping application...")
 	api.Stop(5 * time.Second)
 	log.Info("application stopped")
 }
+
+// Reconcile the lends with the expenses and report the discrepancies
+// Usage: splitwise-api reconcile [-repair]
+// @return int: Exit code, 2 when unrepaired discrepancies were found
+func reconcile(args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "repair the discrepancies found")
+	flags.Parse(args)
+
+	lenderService, err := internal.LenderServiceInit()
+	if err != nil {
+		log.Error(fmt.Sprintf("error occurred in reconcile: %s", err))
+		return 1
+	}
+	ctx := context.Background()
+	report, err := lenderService.Reconcile(&ctx, *repair)
+	if err != nil {
+		log.Error(fmt.Sprintf("error occurred in reconcile: %s", err))
+		return 1
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if len(report.Discrepancies) > 0 && !*repair {
+		return 2
+	}
+	return 0
+}
+
+// Grant the administrator role to a user, or revoke it. The first administrator
+// can only be appointed this way.
+// Usage: splitwise-api admin [-revoke] <email>
+// @return int: Exit code
+func setAdmin(args []string) int {
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	revoke := flags.Bool("revoke", false, "revoke the administrator role")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: splitwise-api admin [-revoke] <email>")
+		return 1
+	}
+
+	userService, err := internal.UserServiceInit()
+	if err != nil {
+		log.Error(fmt.Sprintf("error occurred in admin: %s", err))
+		return 1
+	}
+	ctx := context.Background()
+	user, err := userService.SetAdmin(&ctx, flags.Arg(0), !*revoke)
+	if err != nil {
+		log.Error(fmt.Sprintf("error occurred in admin: %s", err))
+		return 1
+	}
+	fmt.Printf("user %s admin: %v\n", user.UId, user.IsAdmin)
+	return 0
+}